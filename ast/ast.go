@@ -2,6 +2,8 @@ package ast
 
 import (
 	"bytes"
+	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/ZeroBl21/go-interpreter/token"
@@ -121,6 +123,168 @@ func (rs *ReturnStatenment) String() string {
 	return out.String()
 }
 
+// WhileStatement represents a `while (condition) { body }` loop. It produces
+// no value.
+type WhileStatement struct {
+	Token     token.Token // The token.WHILE token
+	Condition Expression
+	Body      *BlockStatement
+}
+
+// statementNode marks the WhileStatement struct as a statement.
+func (ws *WhileStatement) statementNode() {}
+
+// TokenLiteral returns the literal value of the WhileStatement's token.
+func (ws *WhileStatement) TokenLiteral() string { return ws.Token.Literal }
+
+func (ws *WhileStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("while")
+	out.WriteString(ws.Condition.String())
+	out.WriteString(" ")
+	out.WriteString(ws.Body.String())
+
+	return out.String()
+}
+
+// DoWhileStatement represents a `do { body } while (condition)` loop, which
+// runs its body once before checking the condition. It produces no value.
+type DoWhileStatement struct {
+	Token     token.Token // The token.DO token
+	Body      *BlockStatement
+	Condition Expression
+}
+
+// statementNode marks the DoWhileStatement struct as a statement.
+func (dws *DoWhileStatement) statementNode() {}
+
+// TokenLiteral returns the literal value of the DoWhileStatement's token.
+func (dws *DoWhileStatement) TokenLiteral() string { return dws.Token.Literal }
+
+func (dws *DoWhileStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("do ")
+	out.WriteString(dws.Body.String())
+	out.WriteString(" while")
+	out.WriteString(dws.Condition.String())
+
+	return out.String()
+}
+
+// ForEachStatement represents a `for (value in iterable) { body }` or
+// `for (key, value in iterable) { body }` loop. A single variable takes the
+// elements of an array or the keys of a hash; with two, the first takes the
+// index or key and the second the element or value. It produces no value.
+type ForEachStatement struct {
+	Token    token.Token // The token.FOR token
+	Key      *Identifier // nil with a single loop variable
+	Value    *Identifier
+	Iterable Expression
+	Body     *BlockStatement
+}
+
+// statementNode marks the ForEachStatement struct as a statement.
+func (fs *ForEachStatement) statementNode() {}
+
+// TokenLiteral returns the literal value of the ForEachStatement's token.
+func (fs *ForEachStatement) TokenLiteral() string { return fs.Token.Literal }
+
+func (fs *ForEachStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("for (")
+	if fs.Key != nil {
+		out.WriteString(fs.Key.String())
+		out.WriteString(", ")
+	}
+	out.WriteString(fs.Value.String())
+	out.WriteString(" in ")
+	out.WriteString(fs.Iterable.String())
+	out.WriteString(") ")
+	out.WriteString(fs.Body.String())
+
+	return out.String()
+}
+
+// SwitchStatement represents
+// `switch (subject) { case value: ... default: ... }`. Only the first case
+// whose value equals the subject runs, there is no fallthrough. Like an if
+// expression it produces the value of the block that ran, or null.
+type SwitchStatement struct {
+	Token   token.Token // The token.SWITCH token
+	Subject Expression
+	Cases   []*CaseClause
+	Default *BlockStatement // nil without a default clause
+}
+
+// statementNode marks the SwitchStatement struct as a statement.
+func (ss *SwitchStatement) statementNode() {}
+
+// TokenLiteral returns the literal value of the SwitchStatement's token.
+func (ss *SwitchStatement) TokenLiteral() string { return ss.Token.Literal }
+
+func (ss *SwitchStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("switch")
+	out.WriteString(ss.Subject.String())
+	out.WriteString(" {")
+
+	for _, c := range ss.Cases {
+		out.WriteString(" ")
+		out.WriteString(c.String())
+	}
+
+	if ss.Default != nil {
+		out.WriteString(" default: ")
+		out.WriteString(ss.Default.String())
+	}
+
+	out.WriteString(" }")
+
+	return out.String()
+}
+
+// CaseClause is one `case value: ...` of a SwitchStatement.
+type CaseClause struct {
+	Token token.Token // The token.CASE token
+	Value Expression
+	Body  *BlockStatement
+}
+
+func (cc *CaseClause) String() string {
+	return "case " + cc.Value.String() + ": " + cc.Body.String()
+}
+
+// BreakStatement represents a `break` leaving the innermost loop.
+type BreakStatement struct {
+	Token token.Token // The token.BREAK token
+}
+
+// statementNode marks the BreakStatement struct as a statement.
+func (bs *BreakStatement) statementNode() {}
+
+// TokenLiteral returns the literal value of the BreakStatement's token.
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+
+func (bs *BreakStatement) String() string { return bs.TokenLiteral() + ";" }
+
+// ContinueStatement represents a `continue` jumping to the next iteration of
+// the innermost loop.
+type ContinueStatement struct {
+	Token token.Token // The token.CONTINUE token
+}
+
+// statementNode marks the ContinueStatement struct as a statement.
+func (cs *ContinueStatement) statementNode() {}
+
+// TokenLiteral returns the literal value of the ContinueStatement's token.
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+
+func (cs *ContinueStatement) String() string { return cs.TokenLiteral() + ";" }
+
 type ExpressionStatement struct {
 	Token      token.Token // The first Token of the expression
 	Expression Expression
@@ -146,6 +310,15 @@ func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
 
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode()      {}
+func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
+
 type StringLiteral struct {
 	Token token.Token
 	Value string
@@ -155,6 +328,33 @@ func (sl *StringLiteral) expressionNode()      {}
 func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
 func (sl *StringLiteral) String() string       { return sl.Token.Literal }
 
+// TemplateLiteral represents a string with `${...}` interpolations. Parts
+// alternates between the text, as StringLiterals, and the interpolated
+// expressions, starting and ending with text, which may be empty.
+type TemplateLiteral struct {
+	Token token.Token // The token.TEMPLATE_HEAD token
+	Parts []Expression
+}
+
+func (tl *TemplateLiteral) expressionNode()      {}
+func (tl *TemplateLiteral) TokenLiteral() string { return tl.Token.Literal }
+func (tl *TemplateLiteral) String() string {
+	var out bytes.Buffer
+
+	for _, part := range tl.Parts {
+		if text, ok := part.(*StringLiteral); ok {
+			out.WriteString(text.Value)
+			continue
+		}
+
+		out.WriteString("${")
+		out.WriteString(part.String())
+		out.WriteString("}")
+	}
+
+	return out.String()
+}
+
 type PrefixExpression struct {
 	Token    token.Token // The prefix token, e.g. !
 	Operator string
@@ -204,6 +404,27 @@ func (ie *InfixExpression) String() string {
 	return out.String()
 }
 
+// AssignExpression represents `target = value`, rebinding an existing
+// variable or, when Target is an IndexExpression, storing into an array
+// element or hash entry. It evaluates to the assigned value.
+type AssignExpression struct {
+	Token  token.Token // The '=' token
+	Target Expression
+	Value  Expression
+}
+
+func (ae *AssignExpression) expressionNode()      {}
+func (ae *AssignExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AssignExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ae.Target.String())
+	out.WriteString(" = ")
+	out.WriteString(ae.Value.String())
+
+	return out.String()
+}
+
 type IfExpression struct {
 	Token       token.Token // The "if" token
 	Condition   Expression
@@ -250,6 +471,7 @@ type FunctionLiteral struct {
 	Token      token.Token // The 'fn' Token
 	Parameters []*Identifier
 	Body       *BlockStatement
+	Name       string // Name of the let binding the literal is bound to, if any
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
@@ -263,6 +485,9 @@ func (fl *FunctionLiteral) String() string {
 	}
 
 	out.WriteString(fl.TokenLiteral())
+	if fl.Name != "" {
+		out.WriteString(fmt.Sprintf("<%s>", fl.Name))
+	}
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
 	out.WriteString(")")
@@ -271,6 +496,33 @@ func (fl *FunctionLiteral) String() string {
 	return out.String()
 }
 
+// MacroLiteral represents `macro(params) { body }`. Macros are bound with
+// let at the top level and expanded away before compilation.
+type MacroLiteral struct {
+	Token      token.Token // The 'macro' token
+	Parameters []*Identifier
+	Body       *BlockStatement
+}
+
+func (ml *MacroLiteral) expressionNode()      {}
+func (ml *MacroLiteral) TokenLiteral() string { return ml.Token.Literal }
+func (ml *MacroLiteral) String() string {
+	var out bytes.Buffer
+
+	params := []string{}
+	for _, p := range ml.Parameters {
+		params = append(params, p.String())
+	}
+
+	out.WriteString(ml.TokenLiteral())
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(")")
+	out.WriteString(ml.Body.String())
+
+	return out.String()
+}
+
 type CallExpression struct {
 	Token     token.Token // The '(' token
 	Function  Expression  // Identifier or FunctionLiteral
@@ -337,9 +589,39 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+// SliceExpression represents `left[low:high]`. Low and High are nil when
+// omitted.
+type SliceExpression struct {
+	Token token.Token // The '[' Token
+	Left  Expression
+	Low   Expression
+	High  Expression
+}
+
+func (se *SliceExpression) expressionNode()      {}
+func (se *SliceExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SliceExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(se.Left.String())
+	out.WriteString("[")
+	if se.Low != nil {
+		out.WriteString(se.Low.String())
+	}
+	out.WriteString(":")
+	if se.High != nil {
+		out.WriteString(se.High.String())
+	}
+	out.WriteString("])")
+
+	return out.String()
+}
+
 type HashLiteral struct {
-	Token    token.Token // the '{' Token
+	Token token.Token // the '{' Token
 	Pairs map[Expression]Expression
+	Keys  []Expression // the keys of Pairs in source order
 }
 
 func (hl *HashLiteral) expressionNode()      {}
@@ -348,8 +630,8 @@ func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for key, value := range hl.Pairs {
-		pairs = append(pairs, key.String()+":"+value.String())
+	for _, key := range hl.OrderedKeys() {
+		pairs = append(pairs, key.String()+":"+hl.Pairs[key].String())
 	}
 
 	out.WriteString("{")
@@ -358,3 +640,22 @@ func (hl *HashLiteral) String() string {
 
 	return out.String()
 }
+
+// OrderedKeys returns the keys of Pairs in source order. Literals built
+// without Keys, as tests and macros may do, get their keys sorted by String
+// instead so the order is at least stable.
+func (hl *HashLiteral) OrderedKeys() []Expression {
+	if len(hl.Keys) == len(hl.Pairs) {
+		return hl.Keys
+	}
+
+	keys := make([]Expression, 0, len(hl.Pairs))
+	for key := range hl.Pairs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	return keys
+}
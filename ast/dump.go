@@ -0,0 +1,195 @@
+package ast
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dump formats node as an indented tree, one node per line with its
+// children below it, to show how a program was parsed. Unlike String it
+// spells out every node, so precedence and nesting are explicit. Children
+// whose role isn't obvious from their position are labeled.
+func Dump(node Node) string {
+	var out bytes.Buffer
+	dumpNode(&out, 0, "", node)
+	return out.String()
+}
+
+func dumpNode(out *bytes.Buffer, depth int, label string, node Node) {
+	line := func(format string, a ...any) {
+		out.WriteString(strings.Repeat("  ", depth))
+		if label != "" {
+			out.WriteString(label + ": ")
+		}
+		fmt.Fprintf(out, format, a...)
+		out.WriteString("\n")
+	}
+	child := func(label string, node Node) {
+		dumpNode(out, depth+1, label, node)
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		line("Program")
+		for _, s := range node.Statements {
+			child("", s)
+		}
+
+	case *LetStatement:
+		line("LetStatement %s", node.Name.Value)
+		child("", node.Value)
+
+	case *ReturnStatenment:
+		line("ReturnStatement")
+		if node.ReturnValue != nil {
+			child("", node.ReturnValue)
+		}
+
+	case *WhileStatement:
+		line("WhileStatement")
+		child("condition", node.Condition)
+		child("body", node.Body)
+
+	case *DoWhileStatement:
+		line("DoWhileStatement")
+		child("body", node.Body)
+		child("condition", node.Condition)
+
+	case *ForEachStatement:
+		if node.Key != nil {
+			line("ForEachStatement %s, %s", node.Key.Value, node.Value.Value)
+		} else {
+			line("ForEachStatement %s", node.Value.Value)
+		}
+		child("iterable", node.Iterable)
+		child("body", node.Body)
+
+	case *SwitchStatement:
+		line("SwitchStatement")
+		child("subject", node.Subject)
+		for _, c := range node.Cases {
+			child("case", c.Value)
+			child("body", c.Body)
+		}
+		if node.Default != nil {
+			child("default", node.Default)
+		}
+
+	case *BreakStatement:
+		line("BreakStatement")
+
+	case *ContinueStatement:
+		line("ContinueStatement")
+
+	case *ExpressionStatement:
+		line("ExpressionStatement")
+		if node.Expression != nil {
+			child("", node.Expression)
+		}
+
+	case *BlockStatement:
+		line("BlockStatement")
+		for _, s := range node.Statements {
+			child("", s)
+		}
+
+	case *Identifier:
+		line("Identifier %s", node.Value)
+
+	case *IntegerLiteral:
+		line("IntegerLiteral %s", node.Token.Literal)
+
+	case *FloatLiteral:
+		line("FloatLiteral %s", node.Token.Literal)
+
+	case *StringLiteral:
+		line("StringLiteral %s", strconv.Quote(node.Value))
+
+	case *TemplateLiteral:
+		line("TemplateLiteral")
+		for _, part := range node.Parts {
+			child("", part)
+		}
+
+	case *Boolean:
+		line("Boolean %t", node.Value)
+
+	case *PrefixExpression:
+		line("PrefixExpression %s", node.Operator)
+		child("", node.Right)
+
+	case *InfixExpression:
+		line("InfixExpression %s", node.Operator)
+		child("", node.Left)
+		child("", node.Right)
+
+	case *AssignExpression:
+		line("AssignExpression")
+		child("target", node.Target)
+		child("value", node.Value)
+
+	case *IfExpression:
+		line("IfExpression")
+		child("condition", node.Condition)
+		child("consequence", node.Consequence)
+		if node.Alternative != nil {
+			child("alternative", node.Alternative)
+		}
+
+	case *FunctionLiteral:
+		params := []string{}
+		for _, p := range node.Parameters {
+			params = append(params, p.Value)
+		}
+		line("FunctionLiteral (%s)", strings.Join(params, ", "))
+		child("", node.Body)
+
+	case *MacroLiteral:
+		params := []string{}
+		for _, p := range node.Parameters {
+			params = append(params, p.Value)
+		}
+		line("MacroLiteral (%s)", strings.Join(params, ", "))
+		child("", node.Body)
+
+	case *CallExpression:
+		line("CallExpression")
+		child("function", node.Function)
+		for _, arg := range node.Arguments {
+			child("argument", arg)
+		}
+
+	case *ArrayLiteral:
+		line("ArrayLiteral")
+		for _, el := range node.Elements {
+			child("", el)
+		}
+
+	case *IndexExpression:
+		line("IndexExpression")
+		child("", node.Left)
+		child("index", node.Index)
+
+	case *SliceExpression:
+		line("SliceExpression")
+		child("", node.Left)
+		if node.Low != nil {
+			child("low", node.Low)
+		}
+		if node.High != nil {
+			child("high", node.High)
+		}
+
+	case *HashLiteral:
+		line("HashLiteral")
+		for _, key := range node.OrderedKeys() {
+			child("key", key)
+			child("value", node.Pairs[key])
+		}
+
+	default:
+		line("%T %s", node, node)
+	}
+}
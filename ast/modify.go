@@ -0,0 +1,120 @@
+package ast
+
+// ModifierFunc returns the node to put in place of node.
+type ModifierFunc func(node Node) Node
+
+// Modify walks the tree rooted at node, replacing every node, children
+// first, with what modifier returns for it. Children are updated in place;
+// the result for node itself is returned. A replacement of the wrong kind
+// for its position, like a statement where an expression belongs, is
+// dropped and leaves that child nil.
+func Modify(node Node, modifier ModifierFunc) Node {
+	switch node := node.(type) {
+	case *Program:
+		for i, statement := range node.Statements {
+			node.Statements[i], _ = Modify(statement, modifier).(Statement)
+		}
+
+	case *ExpressionStatement:
+		node.Expression, _ = Modify(node.Expression, modifier).(Expression)
+
+	case *BlockStatement:
+		for i, statement := range node.Statements {
+			node.Statements[i], _ = Modify(statement, modifier).(Statement)
+		}
+
+	case *LetStatement:
+		node.Value, _ = Modify(node.Value, modifier).(Expression)
+
+	case *ReturnStatenment:
+		if node.ReturnValue != nil {
+			node.ReturnValue, _ = Modify(node.ReturnValue, modifier).(Expression)
+		}
+
+	case *WhileStatement:
+		node.Condition, _ = Modify(node.Condition, modifier).(Expression)
+		node.Body, _ = Modify(node.Body, modifier).(*BlockStatement)
+
+	case *DoWhileStatement:
+		node.Body, _ = Modify(node.Body, modifier).(*BlockStatement)
+		node.Condition, _ = Modify(node.Condition, modifier).(Expression)
+
+	case *ForEachStatement:
+		node.Iterable, _ = Modify(node.Iterable, modifier).(Expression)
+		node.Body, _ = Modify(node.Body, modifier).(*BlockStatement)
+
+	case *SwitchStatement:
+		node.Subject, _ = Modify(node.Subject, modifier).(Expression)
+		for _, c := range node.Cases {
+			c.Value, _ = Modify(c.Value, modifier).(Expression)
+			c.Body, _ = Modify(c.Body, modifier).(*BlockStatement)
+		}
+		if node.Default != nil {
+			node.Default, _ = Modify(node.Default, modifier).(*BlockStatement)
+		}
+
+	case *PrefixExpression:
+		node.Right, _ = Modify(node.Right, modifier).(Expression)
+
+	case *InfixExpression:
+		node.Left, _ = Modify(node.Left, modifier).(Expression)
+		node.Right, _ = Modify(node.Right, modifier).(Expression)
+
+	case *AssignExpression:
+		node.Target, _ = Modify(node.Target, modifier).(Expression)
+		node.Value, _ = Modify(node.Value, modifier).(Expression)
+
+	case *IfExpression:
+		node.Condition, _ = Modify(node.Condition, modifier).(Expression)
+		node.Consequence, _ = Modify(node.Consequence, modifier).(*BlockStatement)
+		if node.Alternative != nil {
+			node.Alternative, _ = Modify(node.Alternative, modifier).(*BlockStatement)
+		}
+
+	case *FunctionLiteral:
+		node.Body, _ = Modify(node.Body, modifier).(*BlockStatement)
+
+	case *CallExpression:
+		node.Function, _ = Modify(node.Function, modifier).(Expression)
+		for i, arg := range node.Arguments {
+			node.Arguments[i], _ = Modify(arg, modifier).(Expression)
+		}
+
+	case *ArrayLiteral:
+		for i, el := range node.Elements {
+			node.Elements[i], _ = Modify(el, modifier).(Expression)
+		}
+
+	case *IndexExpression:
+		node.Left, _ = Modify(node.Left, modifier).(Expression)
+		node.Index, _ = Modify(node.Index, modifier).(Expression)
+
+	case *SliceExpression:
+		node.Left, _ = Modify(node.Left, modifier).(Expression)
+		if node.Low != nil {
+			node.Low, _ = Modify(node.Low, modifier).(Expression)
+		}
+		if node.High != nil {
+			node.High, _ = Modify(node.High, modifier).(Expression)
+		}
+
+	case *TemplateLiteral:
+		for i, part := range node.Parts {
+			node.Parts[i], _ = Modify(part, modifier).(Expression)
+		}
+
+	case *HashLiteral:
+		pairs := make(map[Expression]Expression, len(node.Pairs))
+		keys := make([]Expression, 0, len(node.Pairs))
+		for _, key := range node.OrderedKeys() {
+			newKey, _ := Modify(key, modifier).(Expression)
+			newValue, _ := Modify(node.Pairs[key], modifier).(Expression)
+			pairs[newKey] = newValue
+			keys = append(keys, newKey)
+		}
+		node.Pairs = pairs
+		node.Keys = keys
+	}
+
+	return modifier(node)
+}
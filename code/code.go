@@ -47,6 +47,40 @@ const (
 
 	OpClosure
 	OpGetFree
+
+	OpJumpTruthy
+
+	OpCurrentClosure
+
+	OpMod
+
+	OpBitAnd
+	OpBitOr
+	OpBitXor
+	OpBitNot
+	OpShiftLeft
+	OpShiftRight
+
+	OpSlice
+
+	OpTailCall
+
+	OpDup
+
+	OpIterItems
+
+	OpPow
+
+	OpConstantWide
+
+	OpSetIndex
+
+	OpMatch
+
+	OpLessThan
+
+	OpGetGlobalWide
+	OpSetGlobalWide
 )
 
 var definitions = map[Opcode]*Definition{
@@ -67,8 +101,10 @@ var definitions = map[Opcode]*Definition{
 	OpMinus: {"OpMinus", []int{}},
 	OpBang:  {"OpBang", []int{}},
 
-	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
-	OpJump:          {"OpJump", []int{2}},
+	// Jumps take four byte operands so a program can grow past 65535 bytes
+	// of instructions without its jump targets being truncated.
+	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{4}},
+	OpJump:          {"OpJump", []int{4}},
 
 	OpNull: {"OpNull", []int{}},
 
@@ -90,26 +126,83 @@ var definitions = map[Opcode]*Definition{
 
 	OpClosure: {"OpClosure", []int{2, 1}},
 	OpGetFree: {"OpGetFree", []int{1}},
+
+	OpJumpTruthy: {"OpJumpTruthy", []int{4}},
+
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+
+	OpMod: {"OpMod", []int{}},
+
+	OpBitAnd:     {"OpBitAnd", []int{}},
+	OpBitOr:      {"OpBitOr", []int{}},
+	OpBitXor:     {"OpBitXor", []int{}},
+	OpBitNot:     {"OpBitNot", []int{}},
+	OpShiftLeft:  {"OpShiftLeft", []int{}},
+	OpShiftRight: {"OpShiftRight", []int{}},
+
+	OpSlice: {"OpSlice", []int{}},
+
+	OpTailCall: {"OpTailCall", []int{1}},
+
+	OpDup: {"OpDup", []int{}},
+
+	OpIterItems: {"OpIterItems", []int{1}},
+
+	OpPow: {"OpPow", []int{}},
+
+	// OpConstantWide is OpConstant for constant indexes past 65535. The
+	// compiler only emits it when needed, keeping common programs compact.
+	OpConstantWide: {"OpConstantWide", []int{4}},
+
+	OpSetIndex: {"OpSetIndex", []int{}},
+
+	// OpMatch compares a switch subject with a case value. Unlike OpEqual it
+	// never fails: values of types that can't be compared don't match.
+	OpMatch: {"OpMatch", []int{}},
+
+	OpLessThan: {"OpLessThan", []int{}},
+
+	// OpGetGlobalWide and OpSetGlobalWide are OpGetGlobal and OpSetGlobal for
+	// global indexes past 65535, emitted only when needed like
+	// OpConstantWide.
+	OpGetGlobalWide: {"OpGetGlobalWide", []int{4}},
+	OpSetGlobalWide: {"OpSetGlobalWide", []int{4}},
 }
 
 type Instructions []byte
 
 func (ins Instructions) String() string {
+	return ins.Annotate(nil)
+}
+
+// Annotate formats ins like String, appending `// comment` to every
+// instruction for which comment returns a non-empty string. A nil comment
+// adds nothing.
+func (ins Instructions) Annotate(
+	comment func(op Opcode, operands []int) string,
+) string {
 	var out bytes.Buffer
 
-	i := 0
-	for i < len(ins) {
-		def, err := Lookup(ins[i])
-		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
-			continue
+	it := NewInstructionIterator(ins)
+	for {
+		offset := it.Offset()
+		op, operands, _, ok := it.Next()
+		if !ok {
+			break
 		}
 
-		operands, read := ReadOperands(def, ins[i+1:])
-
-		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
+		def := definitions[op]
+		fmt.Fprintf(&out, "%04d %s", offset, ins.fmtInstruction(def, operands))
+		if comment != nil {
+			if c := comment(op, operands); c != "" {
+				fmt.Fprintf(&out, " // %s", c)
+			}
+		}
+		out.WriteString("\n")
+	}
 
-		i += 1 + read
+	if err := it.Err(); err != nil {
+		fmt.Fprintf(&out, "ERROR: %s\n", err)
 	}
 
 	return out.String()
@@ -138,11 +231,17 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 
 type Opcode byte
 
+// Definition describes an opcode: its readable name and the width in bytes
+// of each of its operands, in order. Widths are 1, 2 or 4; operands are
+// big-endian and unsigned.
 type Definition struct {
 	Name          string
 	OperandWidths []int
 }
 
+// Lookup returns the definition of op, or an error if op is not a defined
+// opcode. It takes a byte rather than an Opcode so it can be called directly
+// on an instruction stream.
 func Lookup(op byte) (*Definition, error) {
 	def, ok := definitions[Opcode(op)]
 	if !ok {
@@ -170,6 +269,8 @@ func Make(op Opcode, operands ...int) []byte {
 	for i, o := range operands {
 		width := def.OperandWidths[i]
 		switch width {
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
 		case 1:
@@ -181,12 +282,18 @@ func Make(op Opcode, operands ...int) []byte {
 	return instruction
 }
 
+// ReadOperands decodes the operands of an instruction described by def from
+// ins, which must start right after the opcode byte. It returns the operands
+// and the number of bytes read, so the next instruction starts that many
+// bytes further on. It is the inverse of Make.
 func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	operands := make([]int, len(def.OperandWidths))
 	offset := 0
 
 	for i, width := range def.OperandWidths {
 		switch width {
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
 		case 1:
@@ -199,6 +306,10 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	return operands, offset
 }
 
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
@@ -10,8 +10,11 @@ func TestMake(t *testing.T) {
 	}{
 		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
 		{OpAdd, []int{}, []byte{byte(OpAdd)}},
+		{OpArray, []int{3}, []byte{byte(OpArray), 0, 3}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
 		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpJump, []int{65536}, []byte{byte(OpJump), 0, 1, 0, 0}},
+		{OpConstantWide, []int{70000}, []byte{byte(OpConstantWide), 0, 1, 17, 112}},
 	}
 
 	for _, tt := range tests {
@@ -90,3 +93,88 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestSourceMap(t *testing.T) {
+	first := Span{Line: 1, StartCol: 1, EndCol: 4}
+	second := Span{Line: 2, StartCol: 3, EndCol: 5}
+
+	sm := &SourceMap{}
+	sm.Add(0, first)
+	sm.Add(3, second)
+	sm.Add(5, Span{Line: 3, StartCol: 1, EndCol: 2})
+	sm.Truncate(5)
+
+	tests := []struct {
+		offset   int
+		expected Span
+		ok       bool
+	}{
+		{-1, Span{}, false},
+		{0, first, true},
+		{2, first, true},
+		{3, second, true},
+		{6, second, true},
+	}
+
+	for _, tt := range tests {
+		span, ok := sm.SpanForOffset(tt.offset)
+		if ok != tt.ok || span != tt.expected {
+			t.Errorf("wrong span for offset %d. want=%s (%t), got=%s (%t)",
+				tt.offset, tt.expected, tt.ok, span, ok)
+		}
+	}
+
+	var empty *SourceMap
+	if _, ok := empty.SpanForOffset(0); ok {
+		t.Errorf("nil source map returned a span")
+	}
+}
+
+func TestReadOperandsRoundTrip(t *testing.T) {
+	for op, def := range definitions {
+		operands := make([]int, len(def.OperandWidths))
+		width := 1
+		for i, w := range def.OperandWidths {
+			operands[i] = 1<<(8*w) - 1 - i
+			width += w
+		}
+
+		instruction := Make(op, operands...)
+		if len(instruction) != width {
+			t.Fatalf("%s: instruction has wrong length. want=%d, got=%d",
+				def.Name, width, len(instruction))
+		}
+
+		looked, err := Lookup(instruction[0])
+		if err != nil {
+			t.Fatalf("%s: lookup failed: %s", def.Name, err)
+		}
+
+		if looked != def {
+			t.Fatalf("%s: lookup returned definition %s", def.Name, looked.Name)
+		}
+
+		operandsRead, n := ReadOperands(looked, instruction[1:])
+		if n != width-1 {
+			t.Errorf("%s: n wrong. want=%d, got=%d", def.Name, width-1, n)
+		}
+
+		for i, want := range operands {
+			if operandsRead[i] != want {
+				t.Errorf("%s: operand %d wrong. want=%d, got=%d",
+					def.Name, i, want, operandsRead[i])
+			}
+		}
+	}
+}
+
+func TestLookupUndefined(t *testing.T) {
+	_, err := Lookup(255)
+	if err == nil {
+		t.Fatalf("expected error for undefined opcode")
+	}
+
+	if err.Error() != "opcode 255 undefined" {
+		t.Errorf("wrong error. got=%q", err)
+	}
+}
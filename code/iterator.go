@@ -0,0 +1,72 @@
+package code
+
+import "fmt"
+
+// InstructionIterator decodes Instructions one instruction at a time, so
+// tools walking bytecode don't have to repeat the offset arithmetic around
+// ReadOperands.
+//
+//	it := NewInstructionIterator(ins)
+//	for {
+//		op, operands, width, ok := it.Next()
+//		if !ok {
+//			break
+//		}
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type InstructionIterator struct {
+	ins    Instructions
+	offset int
+	err    error
+}
+
+func NewInstructionIterator(ins Instructions) *InstructionIterator {
+	return &InstructionIterator{ins: ins}
+}
+
+// Next decodes the instruction at the current offset and advances past it.
+// It returns the opcode, its decoded operands and the instruction's width in
+// bytes. ok is false once the end is reached or an undefined opcode or
+// truncated instruction is found, in which case Err reports why.
+func (it *InstructionIterator) Next() (Opcode, []int, int, bool) {
+	if it.err != nil || it.offset >= len(it.ins) {
+		return 0, nil, 0, false
+	}
+
+	def, err := Lookup(it.ins[it.offset])
+	if err != nil {
+		it.err = fmt.Errorf("instruction at %d: %w", it.offset, err)
+		return 0, nil, 0, false
+	}
+
+	width := 1
+	for _, w := range def.OperandWidths {
+		width += w
+	}
+	if it.offset+width > len(it.ins) {
+		it.err = fmt.Errorf("instruction at %d: truncated %s",
+			it.offset, def.Name)
+		return 0, nil, 0, false
+	}
+
+	op := Opcode(it.ins[it.offset])
+	operands, _ := ReadOperands(def, it.ins[it.offset+1:])
+	it.offset += width
+
+	return op, operands, width, true
+}
+
+// Offset returns the offset of the instruction the next call to Next
+// decodes.
+func (it *InstructionIterator) Offset() int {
+	return it.offset
+}
+
+// Err returns the error that stopped the iteration, or nil if it stopped at
+// the end of the instructions.
+func (it *InstructionIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,84 @@
+package code
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestInstructionIterator(t *testing.T) {
+	ins := Instructions{}
+	for _, i := range []Instructions{
+		Make(OpConstant, 1),
+		Make(OpGetLocal, 2),
+		Make(OpClosure, 65535, 255),
+		Make(OpAdd),
+	} {
+		ins = append(ins, i...)
+	}
+
+	expected := []struct {
+		offset   int
+		op       Opcode
+		operands []int
+		width    int
+	}{
+		{0, OpConstant, []int{1}, 3},
+		{3, OpGetLocal, []int{2}, 2},
+		{5, OpClosure, []int{65535, 255}, 4},
+		{9, OpAdd, []int{}, 1},
+	}
+
+	it := NewInstructionIterator(ins)
+	for i, tt := range expected {
+		if it.Offset() != tt.offset {
+			t.Fatalf("tests[%d] - wrong offset. want=%d, got=%d",
+				i, tt.offset, it.Offset())
+		}
+
+		op, operands, width, ok := it.Next()
+		if !ok {
+			t.Fatalf("tests[%d] - iteration stopped early: %v", i, it.Err())
+		}
+
+		if op != tt.op || width != tt.width ||
+			fmt.Sprint(operands) != fmt.Sprint(tt.operands) {
+			t.Errorf("tests[%d] - wrong instruction. want=%d %v (%d), got=%d %v (%d)",
+				i, tt.op, tt.operands, tt.width, op, operands, width)
+		}
+	}
+
+	if _, _, _, ok := it.Next(); ok {
+		t.Errorf("expected the iteration to end")
+	}
+	if err := it.Err(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestInstructionIteratorErrors(t *testing.T) {
+	tests := []struct {
+		ins      Instructions
+		expected string
+	}{
+		{Instructions{byte(OpAdd), 255}, "instruction at 1: opcode 255 undefined"},
+		{Instructions{byte(OpConstant), 0}, "instruction at 0: truncated OpConstant"},
+	}
+
+	for _, tt := range tests {
+		it := NewInstructionIterator(tt.ins)
+		for {
+			if _, _, _, ok := it.Next(); !ok {
+				break
+			}
+		}
+
+		if it.Err() == nil || it.Err().Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, it.Err())
+		}
+
+		// The iterator stays stopped.
+		if _, _, _, ok := it.Next(); ok {
+			t.Errorf("iterator continued after an error")
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package code
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Span is a range of source text on a single line. Columns are 1-based and
+// EndCol is exclusive.
+type Span struct {
+	Line     int
+	StartCol int
+	EndCol   int
+}
+
+func (s Span) String() string {
+	return fmt.Sprintf("%d:%d-%d", s.Line, s.StartCol, s.EndCol)
+}
+
+// SourceMap links instruction offsets to the source span each instruction
+// was compiled from. Entries are kept in offset order, one per instruction.
+type SourceMap struct {
+	entries []sourceMapEntry
+}
+
+type sourceMapEntry struct {
+	offset int
+	span   Span
+}
+
+// Add records that the instruction starting at offset was compiled from
+// span. Offsets must be added in increasing order.
+func (sm *SourceMap) Add(offset int, span Span) {
+	sm.entries = append(sm.entries, sourceMapEntry{offset: offset, span: span})
+}
+
+// Truncate drops the entries of every instruction starting at or after
+// offset, mirroring instructions being cut back to offset.
+func (sm *SourceMap) Truncate(offset int) {
+	i := sort.Search(len(sm.entries), func(i int) bool {
+		return sm.entries[i].offset >= offset
+	})
+	sm.entries = sm.entries[:i]
+}
+
+// SpanForOffset returns the span of the instruction that contains the byte
+// at offset. It reports false when sm is nil or no instruction starts at or
+// before offset.
+func (sm *SourceMap) SpanForOffset(offset int) (Span, bool) {
+	if sm == nil {
+		return Span{}, false
+	}
+
+	i := sort.Search(len(sm.entries), func(i int) bool {
+		return sm.entries[i].offset > offset
+	})
+	if i == 0 {
+		return Span{}, false
+	}
+
+	return sm.entries[i-1].span, true
+}
@@ -0,0 +1,104 @@
+package compiler
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ZeroBl21/go-interpreter/lexer"
+	"github.com/ZeroBl21/go-interpreter/parser"
+)
+
+// Cache holds bytecode compiled from source code, keyed by the SHA-256 of
+// the source, so a server running the same scripts over and over lexes,
+// parses and compiles each of them once. Nothing is ever invalidated: the
+// same source always compiles to the same bytecode. A Cache is safe for
+// concurrent use.
+type Cache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[[sha256.Size]byte]*Bytecode
+	order      [][sha256.Size]byte // keys of entries, oldest first
+}
+
+// NewCache returns a cache holding at most maxEntries programs, dropping the
+// oldest when a new one doesn't fit. Values below 1 mean no limit.
+func NewCache(maxEntries int) *Cache {
+	return &Cache{
+		maxEntries: maxEntries,
+		entries:    make(map[[sha256.Size]byte]*Bytecode),
+	}
+}
+
+// Compile returns the bytecode for source, compiling it with constant
+// folding and the peephole pass on a miss. Sources that fail to parse or
+// compile are not cached. The bytecode is shared by every caller asking for
+// the same source and must not be modified.
+func (c *Cache) Compile(source string) (*Bytecode, error) {
+	key := sha256.Sum256([]byte(source))
+
+	c.mu.Lock()
+	bytecode, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return bytecode, nil
+	}
+
+	// Compile without holding the lock, so a slow compilation doesn't hold
+	// up hits for other sources.
+	bytecode, err := compileSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another caller may have compiled the same source meanwhile; hand out
+	// one Bytecode for it.
+	if cached, ok := c.entries[key]; ok {
+		return cached, nil
+	}
+
+	if c.maxEntries > 0 && len(c.order) >= c.maxEntries {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = bytecode
+	c.order = append(c.order, key)
+
+	return bytecode, nil
+}
+
+// Len returns the number of programs in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+var defaultCache = NewCache(0)
+
+// CompileCached compiles source like Cache.Compile, using a cache shared by
+// the whole program that is never trimmed. Use a Cache of your own to bound
+// memory use.
+func CompileCached(source string) (*Bytecode, error) {
+	return defaultCache.Compile(source)
+}
+
+func compileSource(source string) (*Bytecode, error) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) != 0 {
+		return nil, fmt.Errorf("parser errors: %s", strings.Join(errs, "; "))
+	}
+
+	comp := New(WithOptimizations(OptimizeAggressive))
+	if err := comp.Compile(program); err != nil {
+		return nil, err
+	}
+
+	return comp.Bytecode(), nil
+}
@@ -0,0 +1,118 @@
+package compiler
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCacheCompile(t *testing.T) {
+	cache := NewCache(0)
+
+	first, err := cache.Compile("let a = 1; a + 2")
+	if err != nil {
+		t.Fatalf("compile failed: %s", err)
+	}
+
+	second, err := cache.Compile("let a = 1; a + 2")
+	if err != nil {
+		t.Fatalf("compile failed: %s", err)
+	}
+
+	if first != second {
+		t.Errorf("identical source was compiled twice")
+	}
+
+	other, err := cache.Compile("let a = 1; a + 3")
+	if err != nil {
+		t.Fatalf("compile failed: %s", err)
+	}
+
+	if other == first {
+		t.Errorf("different sources share bytecode")
+	}
+
+	if cache.Len() != 2 {
+		t.Errorf("wrong cache size. want=2, got=%d", cache.Len())
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	cache := NewCache(0)
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			"let = 1",
+			"parser errors: expected next token to be IDENT, got = instead; " +
+				"no prefix parse function for = found",
+		},
+		{"a", "undefined variable a"},
+	}
+
+	for _, tt := range tests {
+		_, err := cache.Compile(tt.input)
+		if err == nil {
+			t.Fatalf("expected error for %q", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err.Error())
+		}
+	}
+
+	if cache.Len() != 0 {
+		t.Errorf("failed compilations were cached: %d entries", cache.Len())
+	}
+}
+
+func TestCacheEvictsOldest(t *testing.T) {
+	cache := NewCache(2)
+
+	first, _ := cache.Compile("1")
+	cache.Compile("2")
+	cache.Compile("3")
+
+	if cache.Len() != 2 {
+		t.Errorf("wrong cache size. want=2, got=%d", cache.Len())
+	}
+
+	if again, _ := cache.Compile("1"); again == first {
+		t.Errorf("oldest entry was not evicted")
+	}
+}
+
+func TestCacheConcurrentCompile(t *testing.T) {
+	cache := NewCache(0)
+
+	var wg sync.WaitGroup
+	results := make([]*Bytecode, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = cache.Compile(fmt.Sprintf("%d + 1", i%2))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, bytecode := range results {
+		if bytecode != results[i%2] {
+			t.Errorf("result %d differs from the cached bytecode", i)
+		}
+	}
+}
+
+func TestCompileCached(t *testing.T) {
+	first, err := CompileCached("fn(x) { x * 2 }(21)")
+	if err != nil {
+		t.Fatalf("compile failed: %s", err)
+	}
+
+	second, _ := CompileCached("fn(x) { x * 2 }(21)")
+	if first != second {
+		t.Errorf("identical source was compiled twice")
+	}
+}
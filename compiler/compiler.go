@@ -2,11 +2,13 @@ package compiler
 
 import (
 	"fmt"
-	"sort"
+	"math"
+	"strings"
 
 	"github.com/ZeroBl21/go-interpreter/ast"
 	"github.com/ZeroBl21/go-interpreter/code"
 	"github.com/ZeroBl21/go-interpreter/object"
+	"github.com/ZeroBl21/go-interpreter/token"
 )
 
 type EmittedInstruction struct {
@@ -16,21 +18,86 @@ type EmittedInstruction struct {
 
 type CompilationScope struct {
 	instructions        code.Instructions
+	lines               []int           // source line of each byte in instructions
+	sourceMap           *code.SourceMap // nil unless source maps are enabled
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+
+	loops []*Loop // loops being compiled in this scope, innermost last
+}
+
+// Loop records the jump targets of a loop being compiled. `break` jumps are
+// emitted before the loop exit is known, so their positions are kept until
+// the loop is finished and they can be backpatched. The same goes for
+// `continue` in loops that check their condition after the body, whose
+// continuePos is -1 until the condition is compiled.
+type Loop struct {
+	continuePos      int
+	breakJumpPoss    []int
+	continueJumpPoss []int
 }
 
 type Compiler struct {
 	constants []object.Object
+	// constantIndexes maps hashable constants to their position in constants
+	// so repeated literals share a single entry.
+	constantIndexes map[object.HashKey]int
 
 	symbolTable *SymbolTable
+	builtins    []string // names added with RegisterBuiltin, in index order
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	line int // source line of the statement being compiled
+
+	sourceMaps bool
+	span       code.Span // source span of the node being compiled
+
+	optimizations int // see WithOptimizations
+}
+
+// Optimization levels for WithOptimizations.
+const (
+	OptimizeNone = iota
+	OptimizeSafe
+	OptimizeAggressive
+)
+
+// Option configures optional compiler behaviour, see New.
+type Option func(*Compiler)
+
+// WithOptimizations sets how much the compiler optimizes what it emits:
+//
+//   - OptimizeNone (0) compiles every node as written, which makes the
+//     bytecode easy to follow while debugging and stable across changes to
+//     the optimizer.
+//   - OptimizeSafe (1), the default, shares one constant between equal
+//     literals, compiles - on a number literal and ! on a boolean literal
+//     to a constant, drops statements after return, break or continue, and
+//     runs the peephole pass (see Peephole) over each function as it is
+//     finished and over the main program in Bytecode.
+//   - OptimizeAggressive (2) also runs FoldConstants over each program
+//     before compiling it, rewriting the AST in place. Folding applies
+//     Monkey's truthiness rules to ! on any literal, whatever the VM is
+//     configured with.
+//
+// Levels outside this range are clamped to it.
+func WithOptimizations(level int) Option {
+	return func(c *Compiler) {
+		switch {
+		case level < OptimizeNone:
+			level = OptimizeNone
+		case level > OptimizeAggressive:
+			level = OptimizeAggressive
+		}
+
+		c.optimizations = level
+	}
 }
 
-// New creates a new Lexer instance.
-func New() *Compiler {
+// New creates a new Compiler configured by opts.
+func New(opts ...Option) *Compiler {
 	mainScope := CompilationScope{
 		instructions:        code.Instructions{},
 		lastInstruction:     EmittedInstruction{},
@@ -43,26 +110,133 @@ func New() *Compiler {
 		symbolTable.DefineBuiltin(i, v.Name)
 	}
 
-	return &Compiler{
-		constants:   []object.Object{},
-		symbolTable: symbolTable,
-		scopes:      []CompilationScope{mainScope},
-		scopeIndex:  0,
+	compiler := &Compiler{
+		constants:       []object.Object{},
+		constantIndexes: make(map[object.HashKey]int),
+		symbolTable:     symbolTable,
+		scopes:          []CompilationScope{mainScope},
+		scopeIndex:      0,
+		optimizations:   OptimizeSafe,
+	}
+
+	for _, opt := range opts {
+		opt(compiler)
 	}
+
+	return compiler
 }
 
-func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
-	compiler := New()
+func NewWithState(
+	s *SymbolTable,
+	constants []object.Object,
+	opts ...Option,
+) *Compiler {
+	compiler := New(opts...)
 	compiler.symbolTable = s
 	compiler.constants = constants
 
+	for i, constant := range constants {
+		if hashable, ok := constant.(object.Hashable); ok {
+			if _, ok := compiler.constantIndexes[hashable.HashKey()]; !ok {
+				compiler.constantIndexes[hashable.HashKey()] = i
+			}
+		}
+	}
+
 	return compiler
 }
 
+// RegisterBuiltin makes name resolve to a builtin supplied by the embedder
+// rather than one of object.Builtins. Registered builtins are numbered after
+// object.Builtins in registration order and listed by name in
+// Bytecode.Builtins, which the VM uses to find the function registered under
+// the same name with VM.RegisterBuiltin.
+func (c *Compiler) RegisterBuiltin(name string) error {
+	index := len(object.Builtins) + len(c.builtins)
+	if index > math.MaxUint8 {
+		return fmt.Errorf("too many builtins: cannot register %s", name)
+	}
+
+	c.globalSymbolTable().DefineBuiltin(index, name)
+	c.builtins = append(c.builtins, name)
+
+	return nil
+}
+
+// Reset prepares c to compile another program. The emitted instructions,
+// line table, loop and last/previous instruction bookkeeping are discarded
+// and any scopes left open by a failed compilation are closed. The constant
+// pool and the global symbol table are kept, as with NewWithState, so names
+// and constants defined by earlier programs stay available. Use ResetState
+// to drop them as well.
+//
+// Bytecode returned before the reset is not modified.
+func (c *Compiler) Reset() {
+	c.symbolTable = c.globalSymbolTable()
+
+	c.scopes = c.scopes[:1]
+	c.scopes[0] = CompilationScope{instructions: code.Instructions{}}
+	c.scopeIndex = 0
+	c.line = 0
+
+	if c.sourceMaps {
+		c.scopes[0].sourceMap = &code.SourceMap{}
+		c.span = code.Span{}
+	}
+}
+
+// ResetState resets c like Reset and also empties the constant pool and the
+// symbol table, so the next program is compiled as if by a new Compiler.
+// Options, source maps and builtins added with RegisterBuiltin are kept.
+func (c *Compiler) ResetState() {
+	c.Reset()
+
+	c.constants = []object.Object{}
+	c.constantIndexes = make(map[object.HashKey]int)
+
+	c.symbolTable = NewSymbolTable()
+	for i, v := range object.Builtins {
+		c.symbolTable.DefineBuiltin(i, v.Name)
+	}
+	for i, name := range c.builtins {
+		c.symbolTable.DefineBuiltin(len(object.Builtins)+i, name)
+	}
+}
+
+// EnableSourceMaps makes c record the source span of every instruction it
+// emits from now on, available through Bytecode.SpanForOffset and the
+// SourceMap of each compiled function. It is off by default since the maps
+// are only needed by tooling.
+func (c *Compiler) EnableSourceMaps() {
+	c.sourceMaps = true
+
+	if c.scopes[c.scopeIndex].sourceMap == nil {
+		c.scopes[c.scopeIndex].sourceMap = &code.SourceMap{}
+	}
+}
+
 func (c *Compiler) Compile(node ast.Node) error {
+	if line := lineOf(node); line > 0 {
+		previousLine := c.line
+		c.line = line
+		defer func() { c.line = previousLine }()
+	}
+
+	if c.sourceMaps {
+		if span, ok := spanOf(node); ok {
+			previousSpan := c.span
+			c.span = span
+			defer func() { c.span = previousSpan }()
+		}
+	}
+
 	switch node := node.(type) {
 	// Statements
 	case *ast.Program:
+		if c.optimizations >= OptimizeAggressive {
+			FoldConstants(node)
+		}
+
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
@@ -82,6 +256,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 			if err := c.Compile(s); err != nil {
 				return err
 			}
+
+			// Anything after an unconditional control transfer is unreachable.
+			if c.optimizations >= OptimizeSafe && isControlTransfer(s) {
+				break
+			}
 		}
 
 	case *ast.LetStatement:
@@ -90,12 +269,225 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 		symbol := c.symbolTable.Define(node.Name.Value)
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
+		c.storeSymbol(symbol)
+
+	case *ast.WhileStatement:
+		conditionPos := len(c.currentInstructions())
+		if err := c.Compile(node.Condition); err != nil {
+			return err
+		}
+
+		// Emit an `OpJumpNotTruthy` with a bogus value
+		exitJumpPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		loop := c.enterLoop(conditionPos)
+		if err := c.Compile(node.Body); err != nil {
+			return err
+		}
+		c.leaveLoop()
+
+		c.emit(code.OpJump, conditionPos)
+
+		afterBodyPos := len(c.currentInstructions())
+		c.changeOperand(exitJumpPos, afterBodyPos)
+		for _, pos := range loop.breakJumpPoss {
+			c.changeOperand(pos, afterBodyPos)
+		}
+
+	case *ast.DoWhileStatement:
+		bodyPos := len(c.currentInstructions())
+
+		loop := c.enterLoop(-1)
+		if err := c.Compile(node.Body); err != nil {
+			return err
+		}
+		c.leaveLoop()
+
+		conditionPos := len(c.currentInstructions())
+		for _, pos := range loop.continueJumpPoss {
+			c.changeOperand(pos, conditionPos)
+		}
+
+		if err := c.Compile(node.Condition); err != nil {
+			return err
+		}
+
+		c.emit(code.OpJumpTruthy, bodyPos)
+
+		afterLoopPos := len(c.currentInstructions())
+		for _, pos := range loop.breakJumpPoss {
+			c.changeOperand(pos, afterLoopPos)
+		}
+
+	case *ast.ForEachStatement:
+		if err := c.Compile(node.Iterable); err != nil {
+			return err
+		}
+
+		// The loop walks items, the array elements or hash keys bound to
+		// the loop variables, with a counter. All three live in hidden
+		// variables of the enclosing scope.
+		iterable := c.symbolTable.DefineHidden()
+		c.storeSymbol(iterable)
+
+		numVars := 1
+		if node.Key != nil {
+			numVars = 2
+		}
+
+		c.loadSymbol(iterable)
+		c.emit(code.OpIterItems, numVars)
+		items := c.symbolTable.DefineHidden()
+		c.storeSymbol(items)
+
+		c.emitConstant(&object.Integer{Value: 0})
+		counter := c.symbolTable.DefineHidden()
+		c.storeSymbol(counter)
+
+		// counter < len(items)
+		conditionPos := len(c.currentInstructions())
+		c.emit(code.OpGetBuiltin, builtinIndex("len"))
+		c.loadSymbol(items)
+		c.emit(code.OpCall, 1)
+		c.loadSymbol(counter)
+		c.emit(code.OpGreaterThan)
+
+		// Emit an `OpJumpNotTruthy` with a bogus value
+		exitJumpPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		c.loadSymbol(items)
+		c.loadSymbol(counter)
+		c.emit(code.OpIndex)
+		if node.Key == nil {
+			c.storeSymbol(c.symbolTable.Define(node.Value.Value))
+		} else {
+			key := c.symbolTable.Define(node.Key.Value)
+			c.storeSymbol(key)
+
+			c.loadSymbol(iterable)
+			c.loadSymbol(key)
+			c.emit(code.OpIndex)
+			c.storeSymbol(c.symbolTable.Define(node.Value.Value))
+		}
+
+		// The counter is advanced before the body, so `continue` can jump
+		// straight back to the condition.
+		c.loadSymbol(counter)
+		c.emitConstant(&object.Integer{Value: 1})
+		c.emit(code.OpAdd)
+		c.storeSymbol(counter)
+
+		loop := c.enterLoop(conditionPos)
+		if err := c.Compile(node.Body); err != nil {
+			return err
+		}
+		c.leaveLoop()
+
+		c.emit(code.OpJump, conditionPos)
+
+		afterBodyPos := len(c.currentInstructions())
+		c.changeOperand(exitJumpPos, afterBodyPos)
+		for _, pos := range loop.breakJumpPoss {
+			c.changeOperand(pos, afterBodyPos)
+		}
+
+	case *ast.SwitchStatement:
+		if err := c.Compile(node.Subject); err != nil {
+			return err
+		}
+
+		// Each case compares a copy of the subject, which stays on the stack
+		// until a case matches or none does.
+		endJumpPoss := []int{}
+		for _, clause := range node.Cases {
+			c.emit(code.OpDup)
+			if err := c.Compile(clause.Value); err != nil {
+				return err
+			}
+			c.emit(code.OpMatch)
+
+			// Emit an `OpJumpNotTruthy` with a bogus value
+			nextCasePos := c.emit(code.OpJumpNotTruthy, 9999)
+
+			c.emit(code.OpPop)
+			if err := c.compileBlockValue(clause.Body); err != nil {
+				return err
+			}
+
+			// Emit an `OpJump` with a bogus value
+			endJumpPoss = append(endJumpPoss, c.emit(code.OpJump, 9999))
+
+			c.changeOperand(nextCasePos, len(c.currentInstructions()))
+		}
+
+		c.emit(code.OpPop)
+		if node.Default == nil {
+			c.emit(code.OpNull)
+		} else if err := c.compileBlockValue(node.Default); err != nil {
+			return err
+		}
+
+		afterSwitchPos := len(c.currentInstructions())
+		for _, pos := range endJumpPoss {
+			c.changeOperand(pos, afterSwitchPos)
+		}
+
+		c.emit(code.OpPop)
+
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("break outside of a loop")
+		}
+
+		// Emit an `OpJump` with a bogus value, patched when the loop ends
+		pos := c.emit(code.OpJump, 9999)
+		loop.breakJumpPoss = append(loop.breakJumpPoss, pos)
+
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("continue outside of a loop")
+		}
+
+		if loop.continuePos >= 0 {
+			c.emit(code.OpJump, loop.continuePos)
 		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
+			// Emit an `OpJump` with a bogus value, patched at the condition
+			pos := c.emit(code.OpJump, 9999)
+			loop.continueJumpPoss = append(loop.continueJumpPoss, pos)
 		}
 
+	case *ast.AssignExpression:
+		if index, ok := node.Target.(*ast.IndexExpression); ok {
+			return c.compileIndexAssignment(index, node.Value)
+		}
+
+		ident, ok := node.Target.(*ast.Identifier)
+		if !ok {
+			return fmt.Errorf("invalid assignment target %s", node.Target)
+		}
+
+		symbol, ok := c.symbolTable.Resolve(ident.Value)
+		if !ok {
+			return fmt.Errorf("undefined variable %s", ident.Value)
+		}
+
+		if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+
+		switch symbol.Scope {
+		case GlobalScope, LocalScope:
+			c.storeSymbol(symbol)
+		default:
+			return fmt.Errorf("cannot assign to %s variable %s",
+				strings.ToLower(string(symbol.Scope)), ident.Value)
+		}
+
+		// Assignment is an expression, so leave the new value on the stack.
+		c.loadSymbol(symbol)
+
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
@@ -113,17 +505,8 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		// Expressions
 	case *ast.InfixExpression:
-		if node.Operator == "<" {
-			if err := c.Compile(node.Right); err != nil {
-				return err
-			}
-
-			if err := c.Compile(node.Left); err != nil {
-				return err
-			}
-
-			c.emit(code.OpGreaterThan)
-			return nil
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogicalExpression(node)
 		}
 
 		if err := c.Compile(node.Left); err != nil {
@@ -143,8 +526,24 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
+		case "**":
+			c.emit(code.OpPow)
+		case "&":
+			c.emit(code.OpBitAnd)
+		case "|":
+			c.emit(code.OpBitOr)
+		case "^":
+			c.emit(code.OpBitXor)
+		case "<<":
+			c.emit(code.OpShiftLeft)
+		case ">>":
+			c.emit(code.OpShiftRight)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case "<":
+			c.emit(code.OpLessThan)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
@@ -154,6 +553,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.PrefixExpression:
+		if c.optimizations >= OptimizeSafe {
+			if folded := foldLiteralPrefix(node); folded != nil {
+				return c.Compile(folded)
+			}
+		}
+
 		if err := c.Compile(node.Right); err != nil {
 			return err
 		}
@@ -163,6 +568,8 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpBang)
 		case "-":
 			c.emit(code.OpMinus)
+		case "~":
+			c.emit(code.OpBitNot)
 		default:
 			return fmt.Errorf("unknown operator %s",
 				node.Operator)
@@ -175,14 +582,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		// Emit an `OpJumpNotTruthy` with a bogus value
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
-		if err := c.Compile(node.Consequence); err != nil {
+		if err := c.compileBlockValue(node.Consequence); err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
-
 		// Emit an `OpJump` with a bogus value
 		jumpPos := c.emit(code.OpJump, 9999)
 
@@ -191,14 +594,8 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
-		} else {
-			if err := c.Compile(node.Alternative); err != nil {
-				return err
-			}
-
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastPop()
-			}
+		} else if err := c.compileBlockValue(node.Alternative); err != nil {
+			return err
 		}
 
 		afterAlternativePos := len(c.currentInstructions())
@@ -215,7 +612,38 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpIndex)
 
+	case *ast.SliceExpression:
+		if err := c.Compile(node.Left); err != nil {
+			return err
+		}
+
+		// Omitted bounds are pushed as null so OpSlice always finds three
+		// operands.
+		for _, bound := range []ast.Expression{node.Low, node.High} {
+			if bound == nil {
+				c.emit(code.OpNull)
+				continue
+			}
+
+			if err := c.Compile(bound); err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpSlice)
+
 	case *ast.CallExpression:
+		// quote is a special form unless the program defines a quote of its
+		// own: its argument is not compiled but kept as code.
+		if c.isQuoteCall(node) {
+			quoted, err := unquoteConstants(node.Arguments[0])
+			if err != nil {
+				return err
+			}
+			c.emitConstant(&object.Quote{Node: quoted})
+			return nil
+		}
+
 		if err := c.Compile(node.Function); err != nil {
 			return err
 		}
@@ -228,13 +656,50 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpCall, len(node.Arguments))
 
+	case *ast.MacroLiteral:
+		return fmt.Errorf("macros must be defined with a top-level let and expanded before compiling")
+
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(integer))
+		c.emitConstant(integer)
+
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emitConstant(float)
 
 	case *ast.StringLiteral:
 		str := &object.String{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(str))
+		c.emitConstant(str)
+
+	case *ast.TemplateLiteral:
+		// Interpolated values are converted with the str builtin and the
+		// parts concatenated left to right. Empty text is skipped.
+		concatenated := 0
+		for _, part := range node.Parts {
+			if text, ok := part.(*ast.StringLiteral); ok {
+				if text.Value == "" {
+					continue
+				}
+				if err := c.Compile(text); err != nil {
+					return err
+				}
+			} else {
+				c.emit(code.OpGetBuiltin, builtinIndex("str"))
+				if err := c.Compile(part); err != nil {
+					return err
+				}
+				c.emit(code.OpCall, 1)
+			}
+
+			if concatenated > 0 {
+				c.emit(code.OpAdd)
+			}
+			concatenated++
+		}
+
+		if concatenated == 0 {
+			c.emitConstant(&object.String{Value: ""})
+		}
 
 	case *ast.Boolean:
 		if node.Value {
@@ -252,15 +717,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpArray, len(node.Elements))
 
 	case *ast.HashLiteral:
-		keys := []ast.Expression{}
-		for k := range node.Pairs {
-			keys = append(keys, k)
-		}
-		sort.Slice(keys, func(i, j int) bool {
-			return keys[i].String() < keys[j].String()
-		})
-
-		for _, k := range keys {
+		for _, k := range node.OrderedKeys() {
 			if err := c.Compile(k); err != nil {
 				return err
 			}
@@ -275,6 +732,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 	case *ast.FunctionLiteral:
 		c.enterScope()
 
+		if node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name)
+		}
+
 		for _, p := range node.Parameters {
 			c.symbolTable.Define(p.Value)
 		}
@@ -289,22 +750,35 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if !c.lastInstructionIs(code.OpReturnValue) {
 			c.emit(code.OpReturn)
 		}
+		c.markTailCalls()
 
 		freeSymbols := c.symbolTable.FreeSymbols
-		numLocals := c.symbolTable.numDefinitions
+		numLocals := c.symbolTable.NumDefinitions()
+		lines := c.scopes[c.scopeIndex].lines
+		sourceMap := c.scopes[c.scopeIndex].sourceMap
 		instructions := c.leaveScope()
+		if c.optimizations >= OptimizeSafe {
+			instructions, lines, sourceMap = peephole(instructions, lines, sourceMap)
+		}
 
 		for _, s := range freeSymbols {
 			c.loadSymbol(s)
 		}
 
 		compiledFn := &object.CompiledFunction{
+			Name:          node.Name,
 			Instructions:  instructions,
+			Lines:         lines,
+			SourceMap:     sourceMap,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
 		}
 
 		fnIndex := c.addConstant(compiledFn)
+		if fnIndex > math.MaxUint16 {
+			return fmt.Errorf("too many constants: cannot reference function %d",
+				fnIndex)
+		}
 		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
 
 	}
@@ -312,15 +786,156 @@ func (c *Compiler) Compile(node ast.Node) error {
 	return nil
 }
 
+// markTailCalls turns every OpCall in the current scope whose result is
+// returned straight away into an OpTailCall. Both opcodes have the same
+// width, so the rewrite happens in place and no jump needs patching. The
+// OpReturnValue after the call is kept: the VM only reuses the frame for
+// closures, and a builtin called in tail position still returns normally.
+func (c *Compiler) markTailCalls() {
+	ins := c.currentInstructions()
+
+	it := code.NewInstructionIterator(ins)
+	for {
+		pos := it.Offset()
+		op, _, width, ok := it.Next()
+		if !ok {
+			break
+		}
+
+		if op == code.OpCall && returnsAt(ins, pos+width) {
+			ins[pos] = byte(code.OpTailCall)
+		}
+	}
+}
+
+// returnsAt reports whether execution starting at pos reaches an
+// OpReturnValue through nothing but unconditional jumps, as it does at the
+// end of each branch of an if expression in tail position.
+func returnsAt(ins code.Instructions, pos int) bool {
+	// Every hop visits a different jump, so more hops than instructions
+	// means the jumps form a cycle.
+	for hops := 0; pos < len(ins) && hops <= len(ins); hops++ {
+		switch code.Opcode(ins[pos]) {
+		case code.OpReturnValue:
+			return true
+		case code.OpJump:
+			pos = int(code.ReadUint32(ins[pos+1:]))
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
 // Bytecode contains the Instructions the compiler generated and the Constants
-// the compiler evaluated.
+// the compiler evaluated. From OptimizeSafe on, the main program is passed
+// through the peephole pass.
 func (c *Compiler) Bytecode() *Bytecode {
+	instructions := c.currentInstructions()
+	lines := c.scopes[c.scopeIndex].lines
+	sourceMap := c.scopes[c.scopeIndex].sourceMap
+	if c.optimizations >= OptimizeSafe {
+		instructions, lines, sourceMap = peephole(instructions, lines, sourceMap)
+	}
+
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: instructions,
+		Lines:        lines,
+		SourceMap:    sourceMap,
 		Constants:    c.constants,
+		Globals:      c.globalIndexes(),
+		Builtins:     c.builtins,
 	}
 }
 
+// globalSymbolTable returns the outermost symbol table, whatever scope c is
+// in.
+func (c *Compiler) globalSymbolTable() *SymbolTable {
+	global := c.symbolTable
+	for global.Outer != nil {
+		global = global.Outer
+	}
+
+	return global
+}
+
+// compileBlockValue compiles a branch of an if expression or the body of a
+// switch clause so that it leaves its value on the stack. A block that
+// doesn't end in an expression, like one ending in a loop or a let
+// statement, leaves null. One that returns, breaks or continues leaves
+// nothing, as it never reaches the end.
+func (c *Compiler) compileBlockValue(body *ast.BlockStatement) error {
+	if err := c.Compile(body); err != nil {
+		return err
+	}
+
+	for _, s := range body.Statements {
+		if isControlTransfer(s) {
+			// Execution never reaches the end, so there's nothing to leave.
+			return nil
+		}
+	}
+
+	if len(body.Statements) > 0 && c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+
+	return nil
+}
+
+// isQuoteCall reports whether call is the quote special form, a call with
+// one argument to quote where quote isn't a name the program defined.
+func (c *Compiler) isQuoteCall(call *ast.CallExpression) bool {
+	ident, ok := call.Function.(*ast.Identifier)
+	if !ok || ident.Value != "quote" || len(call.Arguments) != 1 {
+		return false
+	}
+
+	_, defined := c.symbolTable.Resolve(ident.Value)
+	return !defined
+}
+
+// unquoteConstants replaces every unquote call in quoted with the literal
+// its argument folds to. Nothing is evaluated while compiling, so anything
+// else, like a variable, can only be unquoted in a macro, which is expanded
+// before the program is compiled.
+func unquoteConstants(quoted ast.Node) (ast.Node, error) {
+	var err error
+	quoted = ast.Modify(quoted, func(node ast.Node) ast.Node {
+		call, ok := node.(*ast.CallExpression)
+		if !ok || err != nil || len(call.Arguments) != 1 {
+			return node
+		}
+		if ident, ok := call.Function.(*ast.Identifier); !ok || ident.Value != "unquote" {
+			return node
+		}
+
+		switch arg := foldExpression(call.Arguments[0]).(type) {
+		case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral,
+			*ast.Boolean:
+			return arg
+		default:
+			err = fmt.Errorf("unquote outside a macro needs a constant, got %s",
+				arg.String())
+			return node
+		}
+	})
+
+	return quoted, err
+}
+
+func (c *Compiler) globalIndexes() map[string]int {
+	indexes := make(map[string]int)
+	for _, symbol := range c.globalSymbolTable().Symbols(GlobalScope) {
+		indexes[symbol.Name] = symbol.Index
+	}
+
+	return indexes
+}
+
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	ins := code.Make(op, operands...)
 	pos := c.addInstructions(ins)
@@ -330,11 +945,64 @@ func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	return pos
 }
 
+// compileIndexAssignment compiles `left[index] = value`. OpSetIndex pops the
+// container, the index and the value, stores the value and pushes it back,
+// as assignment is an expression.
+func (c *Compiler) compileIndexAssignment(
+	target *ast.IndexExpression,
+	value ast.Expression,
+) error {
+	if err := c.Compile(target.Left); err != nil {
+		return err
+	}
+
+	if err := c.Compile(target.Index); err != nil {
+		return err
+	}
+
+	if err := c.Compile(value); err != nil {
+		return err
+	}
+
+	c.emit(code.OpSetIndex)
+
+	return nil
+}
+
+// emitConstant adds obj to the constant pool and emits the instruction
+// pushing it, switching to OpConstantWide once the index no longer fits in
+// the two byte operand of OpConstant.
+func (c *Compiler) emitConstant(obj object.Object) int {
+	index := c.addConstant(obj)
+	if index > math.MaxUint16 {
+		return c.emit(code.OpConstantWide, index)
+	}
+
+	return c.emit(code.OpConstant, index)
+}
+
 // addConstant append the obj to the end of the compilers constants slice and
 // give it its very own identifier by returning its index in the constants slice.
+// Hashable constants are immutable, so an equal one already in the pool is
+// reused instead unless optimizations are off.
 func (c *Compiler) addConstant(obj object.Object) int {
+	hashable, ok := obj.(object.Hashable)
+	ok = ok && c.optimizations >= OptimizeSafe
+	if ok {
+		if index, ok := c.constantIndexes[hashable.HashKey()]; ok &&
+			object.Equals(c.constants[index], obj) {
+			return index
+		}
+	}
+
 	c.constants = append(c.constants, obj)
-	return len(c.constants) - 1
+	index := len(c.constants) - 1
+
+	if ok {
+		c.constantIndexes[hashable.HashKey()] = index
+	}
+
+	return index
 }
 
 func (c *Compiler) currentInstructions() code.Instructions {
@@ -346,6 +1014,12 @@ func (c *Compiler) addInstructions(ins []byte) int {
 	updatedInstructoins := append(c.currentInstructions(), ins...)
 
 	c.scopes[c.scopeIndex].instructions = updatedInstructoins
+	for range ins {
+		c.scopes[c.scopeIndex].lines = append(c.scopes[c.scopeIndex].lines, c.line)
+	}
+	if sourceMap := c.scopes[c.scopeIndex].sourceMap; sourceMap != nil {
+		sourceMap.Add(posNewInstruction, c.span)
+	}
 
 	return posNewInstruction
 }
@@ -384,6 +1058,10 @@ func (c *Compiler) removeLastPop() {
 	new := old[:last.Position]
 
 	c.scopes[c.scopeIndex].instructions = new
+	c.scopes[c.scopeIndex].lines = c.scopes[c.scopeIndex].lines[:last.Position]
+	if sourceMap := c.scopes[c.scopeIndex].sourceMap; sourceMap != nil {
+		sourceMap.Truncate(last.Position)
+	}
 	c.scopes[c.scopeIndex].lastInstruction = previous
 }
 
@@ -400,6 +1078,9 @@ func (c *Compiler) enterScope() {
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
 	}
+	if c.sourceMaps {
+		scope.sourceMap = &code.SourceMap{}
+	}
 	c.scopes = append(c.scopes, scope)
 	c.scopeIndex++
 
@@ -417,6 +1098,67 @@ func (c *Compiler) leaveScope() code.Instructions {
 	return instructions
 }
 
+// compileLogicalExpression compiles `&&` and `||` so the right operand is
+// only evaluated when the left one doesn't already decide the result. The
+// result is always a boolean, not the deciding operand:
+//
+//	left; OpJumpNotTruthy short; right; OpJumpNotTruthy short;
+//	OpTrue; OpJump end; short: OpFalse; end:
+//
+// `||` is the mirror image using OpJumpTruthy.
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	jumpOp, result, shortResult := code.OpJumpNotTruthy, code.OpTrue, code.OpFalse
+	if node.Operator == "||" {
+		jumpOp, result, shortResult = code.OpJumpTruthy, code.OpFalse, code.OpTrue
+	}
+
+	if err := c.Compile(node.Left); err != nil {
+		return err
+	}
+	// Emit jumps with a bogus value, patched once the short path is known
+	leftJumpPos := c.emit(jumpOp, 9999)
+
+	if err := c.Compile(node.Right); err != nil {
+		return err
+	}
+	rightJumpPos := c.emit(jumpOp, 9999)
+
+	c.emit(result)
+	endJumpPos := c.emit(code.OpJump, 9999)
+
+	shortPos := len(c.currentInstructions())
+	c.changeOperand(leftJumpPos, shortPos)
+	c.changeOperand(rightJumpPos, shortPos)
+
+	c.emit(shortResult)
+	c.changeOperand(endJumpPos, len(c.currentInstructions()))
+
+	return nil
+}
+
+func (c *Compiler) enterLoop(continuePos int) *Loop {
+	loop := &Loop{continuePos: continuePos}
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = append(scope.loops, loop)
+
+	return loop
+}
+
+func (c *Compiler) leaveLoop() {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+}
+
+// currentLoop returns the innermost loop of the current function, or nil.
+func (c *Compiler) currentLoop() *Loop {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+
+	return loops[len(loops)-1]
+}
+
 func (c *Compiler) replaceLastPopWithReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
 	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
@@ -427,17 +1169,186 @@ func (c *Compiler) replaceLastPopWithReturn() {
 func (c *Compiler) loadSymbol(s Symbol) {
 	switch s.Scope {
 	case GlobalScope:
-		c.emit(code.OpGetGlobal, s.Index)
+		if s.Index > math.MaxUint16 {
+			c.emit(code.OpGetGlobalWide, s.Index)
+		} else {
+			c.emit(code.OpGetGlobal, s.Index)
+		}
 	case LocalScope:
 		c.emit(code.OpGetLocal, s.Index)
 	case BuiltinScope:
 		c.emit(code.OpGetBuiltin, s.Index)
 	case FreeScope:
 		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	}
+}
+
+// storeSymbol emits the instruction setting the global or local s to the
+// value on top of the stack. Globals past the two byte operand of
+// OpSetGlobal use OpSetGlobalWide.
+func (c *Compiler) storeSymbol(s Symbol) {
+	if s.Scope == GlobalScope && s.Index > math.MaxUint16 {
+		c.emit(code.OpSetGlobalWide, s.Index)
+	} else if s.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, s.Index)
+	} else {
+		c.emit(code.OpSetLocal, s.Index)
 	}
 }
 
+// builtinIndex returns the index of the builtin called name in
+// object.Builtins. Compiled code refers to the builtin by index, so it can't
+// be shadowed by a variable of the same name.
+func builtinIndex(name string) int {
+	for i, def := range object.Builtins {
+		if def.Name == name {
+			return i
+		}
+	}
+
+	panic(fmt.Sprintf("no builtin %s", name))
+}
+
 type Bytecode struct {
 	Instructions code.Instructions
-	Constants    []object.Object
+	// Lines holds the source line of every byte in Instructions. It is
+	// debug information only and may be nil.
+	Lines []int
+	// SourceMap links instruction offsets to source spans. It is nil unless
+	// the compiler was asked to emit source maps.
+	SourceMap *code.SourceMap
+	Constants []object.Object
+	// Globals maps the name of every global defined so far to its index in
+	// the VM's globals, so embedders can find values by name. It is not
+	// serialized.
+	Globals map[string]int
+	// Builtins names the builtins registered with Compiler.RegisterBuiltin,
+	// the one at position i having index len(object.Builtins)+i.
+	Builtins []string
+}
+
+// SpanForOffset returns the source span of the instruction containing the
+// byte at offset in b.Instructions. It reports false when b was compiled
+// without source maps or offset is out of range.
+func (b *Bytecode) SpanForOffset(offset int) (code.Span, bool) {
+	if offset < 0 || offset >= len(b.Instructions) {
+		return code.Span{}, false
+	}
+
+	return b.SourceMap.SpanForOffset(offset)
+}
+
+// lineOf returns the source line a statement starts on, or 0 for nodes that
+// don't carry one. Expressions inherit the line of their statement.
+func lineOf(node ast.Node) int {
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		return node.Token.Line
+	case *ast.ReturnStatenment:
+		return node.Token.Line
+	case *ast.ExpressionStatement:
+		return node.Token.Line
+	case *ast.WhileStatement:
+		return node.Token.Line
+	case *ast.DoWhileStatement:
+		return node.Token.Line
+	case *ast.ForEachStatement:
+		return node.Token.Line
+	case *ast.SwitchStatement:
+		return node.Token.Line
+	case *ast.BreakStatement:
+		return node.Token.Line
+	case *ast.ContinueStatement:
+		return node.Token.Line
+	}
+
+	return 0
+}
+
+// spanOf returns the source span of the token a node starts with. Nodes
+// without position information, like literals produced by FoldConstants,
+// report false and inherit the span of their parent.
+func spanOf(node ast.Node) (code.Span, bool) {
+	var tok token.Token
+
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		tok = node.Token
+	case *ast.ReturnStatenment:
+		tok = node.Token
+	case *ast.ExpressionStatement:
+		tok = node.Token
+	case *ast.WhileStatement:
+		tok = node.Token
+	case *ast.DoWhileStatement:
+		tok = node.Token
+	case *ast.ForEachStatement:
+		tok = node.Token
+	case *ast.SwitchStatement:
+		tok = node.Token
+	case *ast.BreakStatement:
+		tok = node.Token
+	case *ast.ContinueStatement:
+		tok = node.Token
+	case *ast.Identifier:
+		tok = node.Token
+	case *ast.IntegerLiteral:
+		tok = node.Token
+	case *ast.FloatLiteral:
+		tok = node.Token
+	case *ast.StringLiteral:
+		tok = node.Token
+	case *ast.TemplateLiteral:
+		tok = node.Token
+	case *ast.Boolean:
+		tok = node.Token
+	case *ast.PrefixExpression:
+		tok = node.Token
+	case *ast.InfixExpression:
+		tok = node.Token
+	case *ast.AssignExpression:
+		tok = node.Token
+	case *ast.IfExpression:
+		tok = node.Token
+	case *ast.FunctionLiteral:
+		tok = node.Token
+	case *ast.CallExpression:
+		tok = node.Token
+	case *ast.ArrayLiteral:
+		tok = node.Token
+	case *ast.IndexExpression:
+		tok = node.Token
+	case *ast.SliceExpression:
+		tok = node.Token
+	case *ast.HashLiteral:
+		tok = node.Token
+	}
+
+	if tok.Line == 0 || tok.Column == 0 {
+		return code.Span{}, false
+	}
+
+	width := len(tok.Literal)
+	if tok.Type == token.STRING {
+		width += 2 // the surrounding quotes
+	}
+
+	return code.Span{
+		Line:     tok.Line,
+		StartCol: tok.Column,
+		EndCol:   tok.Column + width,
+	}, true
+}
+
+// isControlTransfer reports whether s unconditionally leaves the block it is
+// in.
+func isControlTransfer(s ast.Statement) bool {
+	switch s.(type) {
+	case *ast.ReturnStatenment, *ast.BreakStatement, *ast.ContinueStatement:
+		return true
+	default:
+		return false
+	}
 }
@@ -2,6 +2,8 @@ package compiler
 
 import (
 	"fmt"
+	"math"
+	"strings"
 	"testing"
 
 	"github.com/ZeroBl21/go-interpreter/ast"
@@ -30,11 +32,10 @@ func TestIntegerArithmetic(t *testing.T) {
 			},
 		},
 		{
+			// The peephole pass drops the unused 1, see TestOptimizationLevels.
 			input:             "1; 2",
 			expectedConstants: []any{1, 2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpPop),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpPop),
 			},
@@ -69,11 +70,95 @@ func TestIntegerArithmetic(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             "1 % 2",
+			expectedConstants: []any{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 ** 2",
+			expectedConstants: []any{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPow),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 & 2 | 3 ^ 4",
+			expectedConstants: []any{1, 2, 3, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpBitAnd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpBitOr),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpBitXor),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 << 2 >> 3",
+			expectedConstants: []any{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpShiftLeft),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpShiftRight),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "~1",
+			expectedConstants: []any{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpBitNot),
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input:             "-1",
+			expectedConstants: []any{-1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-1.5",
+			expectedConstants: []any{-1.5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let a = 1; -a",
 			expectedConstants: []any{1},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-(1 + 2)",
+			expectedConstants: []any{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
 				code.Make(code.OpMinus),
 				code.Make(code.OpPop),
 			},
@@ -83,6 +168,179 @@ func TestIntegerArithmetic(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestConstantDeduplication(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "[1, 1, 1]",
+			expectedConstants: []any{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `1 + 1 + 1; ["1", "1"]`,
+			expectedConstants: []any{1, "1"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConstantDeduplicationWithState(t *testing.T) {
+	first := New()
+	if err := first.Compile(parse("[1, 2]")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	second := NewWithState(first.symbolTable, first.Bytecode().Constants)
+	if err := second.Compile(parse("[2, 3]")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := second.Bytecode()
+	err := testInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpConstant, 2),
+		code.Make(code.OpArray, 2),
+		code.Make(code.OpPop),
+	}, bytecode.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	if err := testConstants(t, []any{1, 2, 3}, bytecode.Constants); err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	compiler := New()
+	if err := compiler.Compile(parse("let a = 1; a")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	first := compiler.Bytecode()
+	firstInstructions := concatInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpPop),
+	})
+	err := testInstructions(
+		[]code.Instructions{firstInstructions}, first.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	// A failed compilation leaves a function scope open.
+	if err := compiler.Compile(parse("fn() { b }")); err == nil {
+		t.Fatalf("expected compiler error, got none")
+	}
+
+	compiler.Reset()
+
+	if compiler.scopeIndex != 0 || len(compiler.scopes) != 1 {
+		t.Fatalf("scopes not reset. scopeIndex=%d, len(scopes)=%d",
+			compiler.scopeIndex, len(compiler.scopes))
+	}
+	if compiler.symbolTable.Outer != nil {
+		t.Fatalf("symbol table not reset to the global table")
+	}
+
+	if err := compiler.Compile(parse("a + 2; 1")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	second := compiler.Bytecode()
+	err = testInstructions([]code.Instructions{
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpAdd),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpPop),
+	}, second.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	if err := testConstants(t, []any{1, 2}, second.Constants); err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+
+	if len(second.Lines) != len(second.Instructions) {
+		t.Fatalf("wrong line table length. want=%d, got=%d",
+			len(second.Instructions), len(second.Lines))
+	}
+
+	// Bytecode handed out before the reset must not change.
+	err = testInstructions(
+		[]code.Instructions{firstInstructions}, first.Instructions)
+	if err != nil {
+		t.Fatalf("first bytecode modified by reset: %s", err)
+	}
+}
+
+func TestResetState(t *testing.T) {
+	compiler := New()
+	if err := compiler.RegisterBuiltin("double"); err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+	if err := compiler.Compile(parse("let a = 5; a")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	first := compiler.Bytecode()
+
+	compiler.ResetState()
+
+	if err := compiler.Compile(parse("a")); err == nil {
+		t.Fatalf("expected a to be undefined after ResetState")
+	}
+	compiler.ResetState()
+
+	if err := compiler.Compile(parse(`let b = "b"; double(b)`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	second := compiler.Bytecode()
+	err := testInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpGetBuiltin, len(object.Builtins)),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpPop),
+	}, second.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	if err := testConstants(t, []any{"b"}, second.Constants); err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+
+	// Bytecode handed out before the reset must not change.
+	if err := testConstants(t, []any{5}, first.Constants); err != nil {
+		t.Fatalf("first bytecode modified by reset: %s", err)
+	}
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -113,11 +371,11 @@ func TestBooleanExpressions(t *testing.T) {
 		},
 		{
 			input:             "1 < 2",
-			expectedConstants: []any{2, 1},
+			expectedConstants: []any{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
+				code.Make(code.OpLessThan),
 				code.Make(code.OpPop),
 			},
 		},
@@ -165,7 +423,16 @@ func TestBooleanExpressions(t *testing.T) {
 			input:             "!true",
 			expectedConstants: []any{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Whether 0 is truthy is up to the VM, so only booleans fold.
+			input:             "!0",
+			expectedConstants: []any{0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpBang),
 				code.Make(code.OpPop),
 			},
@@ -175,6 +442,57 @@ func TestBooleanExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestLogicalExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "true && false",
+			expectedConstants: []any{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 18),
+				// 0006
+				code.Make(code.OpFalse),
+				// 0007
+				code.Make(code.OpJumpNotTruthy, 18),
+				// 0012
+				code.Make(code.OpTrue),
+				// 0013
+				code.Make(code.OpJump, 19),
+				// 0018
+				code.Make(code.OpFalse),
+				// 0019
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "false || true",
+			expectedConstants: []any{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpFalse),
+				// 0001
+				code.Make(code.OpJumpTruthy, 18),
+				// 0006
+				code.Make(code.OpTrue),
+				// 0007
+				code.Make(code.OpJumpTruthy, 18),
+				// 0012
+				code.Make(code.OpFalse),
+				// 0013
+				code.Make(code.OpJump, 19),
+				// 0018
+				code.Make(code.OpTrue),
+				// 0019
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -186,18 +504,18 @@ func TestConditionals(t *testing.T) {
 				// 0000
 				code.Make(code.OpTrue),
 				// 0001
-				code.Make(code.OpJumpNotTruthy, 10),
-				// 0004
+				code.Make(code.OpJumpNotTruthy, 14),
+				// 0006
 				code.Make(code.OpConstant, 0),
-				// 0007
-				code.Make(code.OpJump, 11),
-				// 0010
+				// 0009
+				code.Make(code.OpJump, 15),
+				// 0014
 				code.Make(code.OpNull),
-				// 0011
+				// 0015
 				code.Make(code.OpPop),
-				// 0012
+				// 0016
 				code.Make(code.OpConstant, 1),
-				// 0015
+				// 0019
 				code.Make(code.OpPop),
 			},
 		},
@@ -210,18 +528,426 @@ func TestConditionals(t *testing.T) {
 				// 0000
 				code.Make(code.OpTrue),
 				// 0001
-				code.Make(code.OpJumpNotTruthy, 10),
+				code.Make(code.OpJumpNotTruthy, 14),
+				// 0006
+				code.Make(code.OpConstant, 0),
+				// 0009
+				code.Make(code.OpJump, 17),
+				// 0014
+				code.Make(code.OpConstant, 1),
+				// 0017
+				code.Make(code.OpPop),
+				// 0018
+				code.Make(code.OpConstant, 2),
+				// 0021
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "if (true) { while (false) {} }",
+			expectedConstants: []any{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 23),
+				// 0006
+				code.Make(code.OpFalse),
+				// 0007
+				code.Make(code.OpJumpNotTruthy, 17),
+				// 0012
+				code.Make(code.OpJump, 6),
+				// 0017
+				code.Make(code.OpNull),
+				// 0018
+				code.Make(code.OpJump, 24),
+				// 0023
+				code.Make(code.OpNull),
+				// 0024
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let i = 0; while (i < 3) { i = i + 1 }",
+			expectedConstants: []any{0, 3, 1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpConstant, 1),
+				// 0012
+				code.Make(code.OpLessThan),
+				// 0013
+				code.Make(code.OpJumpNotTruthy, 33),
+				// 0018
+				code.Make(code.OpGetGlobal, 0),
+				// 0021
+				code.Make(code.OpConstant, 2),
+				// 0024
+				code.Make(code.OpAdd),
+				// 0025
+				code.Make(code.OpSetGlobal, 0),
+				// 0028
+				code.Make(code.OpJump, 6),
+			},
+		},
+		{
+			input:             "while (false) { }",
+			expectedConstants: []any{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpFalse),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 11),
+				// 0006
+				code.Make(code.OpJump, 0),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestDoWhileLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let i = 0; do { continue } while (i < 3)",
+			expectedConstants: []any{0, 3},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpConstant, 1),
+				// 0012
+				code.Make(code.OpLessThan),
+				// 0013
+				code.Make(code.OpJumpTruthy, 6),
+			},
+		},
+		{
+			input:             "do { break } while (true)",
+			expectedConstants: []any{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpJump, 11),
+				// 0005
+				code.Make(code.OpTrue),
+				// 0006
+				code.Make(code.OpJumpTruthy, 0),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestForEachLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "for (x in [1]) { x }",
+			expectedConstants: []any{1, 0},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpArray, 1),
+				// 0006
+				code.Make(code.OpSetGlobal, 0),
+				// 0009
+				code.Make(code.OpGetGlobal, 0),
+				// 0012
+				code.Make(code.OpIterItems, 1),
+				// 0014
+				code.Make(code.OpSetGlobal, 1),
+				// 0017
+				code.Make(code.OpConstant, 1),
+				// 0020
+				code.Make(code.OpSetGlobal, 2),
+				// 0023
+				code.Make(code.OpGetBuiltin, builtinIndex("len")),
+				// 0025
+				code.Make(code.OpGetGlobal, 1),
+				// 0028
+				code.Make(code.OpCall, 1),
+				// 0030
+				code.Make(code.OpGetGlobal, 2),
+				// 0033
+				code.Make(code.OpGreaterThan),
+				// 0034
+				code.Make(code.OpJumpNotTruthy, 64),
+				// 0039
+				code.Make(code.OpGetGlobal, 1),
+				// 0042
+				code.Make(code.OpGetGlobal, 2),
+				// 0045
+				code.Make(code.OpIndex),
+				// 0046
+				code.Make(code.OpSetGlobal, 3),
+				// 0049
+				code.Make(code.OpGetGlobal, 2),
+				// 0052
+				code.Make(code.OpConstant, 0),
+				// 0055
+				code.Make(code.OpAdd),
+				// 0056
+				code.Make(code.OpSetGlobal, 2),
+				// 0059
+				code.Make(code.OpJump, 23),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestSwitchStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "switch (1) { case 1: 10 default: 20 }",
+			expectedConstants: []any{1, 10, 20},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpDup),
 				// 0004
 				code.Make(code.OpConstant, 0),
 				// 0007
-				code.Make(code.OpJump, 13),
-				// 0010
+				code.Make(code.OpMatch),
+				// 0008
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0013
+				code.Make(code.OpPop),
+				// 0014
+				code.Make(code.OpConstant, 1),
+				// 0017
+				code.Make(code.OpJump, 26),
+				// 0022
+				code.Make(code.OpPop),
+				// 0023
+				code.Make(code.OpConstant, 2),
+				// 0026
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "switch (1) { case 2: 10 }",
+			expectedConstants: []any{1, 2, 10},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpDup),
+				// 0004
 				code.Make(code.OpConstant, 1),
+				// 0007
+				code.Make(code.OpMatch),
+				// 0008
+				code.Make(code.OpJumpNotTruthy, 22),
 				// 0013
 				code.Make(code.OpPop),
 				// 0014
 				code.Make(code.OpConstant, 2),
 				// 0017
+				code.Make(code.OpJump, 24),
+				// 0022
+				code.Make(code.OpPop),
+				// 0023
+				code.Make(code.OpNull),
+				// 0024
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestBreakAndContinue(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "while (true) { break; 1 }",
+			expectedConstants: []any{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 16),
+				// 0006
+				code.Make(code.OpJump, 16),
+				// 0011
+				code.Make(code.OpJump, 0),
+			},
+		},
+		{
+			input:             "while (true) { continue }",
+			expectedConstants: []any{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 16),
+				// 0006
+				code.Make(code.OpJump, 0),
+				// 0011
+				code.Make(code.OpJump, 0),
+			},
+		},
+		{
+			input:             "while (true) { while (false) { break }; break }",
+			expectedConstants: []any{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 32),
+				// 0006
+				code.Make(code.OpFalse),
+				// 0007
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0012
+				code.Make(code.OpJump, 22),
+				// 0017
+				code.Make(code.OpJump, 6),
+				// 0022
+				code.Make(code.OpJump, 32),
+				// 0027
+				code.Make(code.OpJump, 0),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestBreakAndContinueOutsideLoop(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"break", "break outside of a loop"},
+		{"continue", "continue outside of a loop"},
+		{"while (true) { fn() { break } }", "break outside of a loop"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q",
+				tt.expected, err.Error())
+		}
+	}
+}
+
+func TestQuoteAndMacroErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		// Outside a macro only constants can be unquoted.
+		{"let a = 1; quote(unquote(a))", "unquote outside a macro needs a constant, got a"},
+		{"quote(unquote(1 + true))", "unquote outside a macro needs a constant, got (1 + true)"},
+		{`quote(unquote(len("four")))`, "unquote outside a macro needs a constant, got len(four)"},
+		{"let m = macro() { quote(1) }; m()",
+			"macros must be defined with a top-level let and expanded before compiling"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q",
+				tt.expected, err.Error())
+		}
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let a = 1; a = 2;",
+			expectedConstants: []any{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { let a = 1; a = 2 }",
+			expectedConstants: []any{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let a = [1]; a[0] = 2;",
+			expectedConstants: []any{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(h) { h["k"] = 1 }`,
+			expectedConstants: []any{
+				"k",
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetIndex),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -230,6 +956,31 @@ func TestConditionals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestAssignmentErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a = 1", "undefined variable a"},
+		{"len = 1", "cannot assign to builtin variable len"},
+		{"fn(a) { fn() { a = 1 } }", "cannot assign to free variable a"},
+		{"b[0] = 1", "undefined variable b"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q",
+				tt.expected, err.Error())
+		}
+	}
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -287,12 +1038,24 @@ func TestStringExpressions(t *testing.T) {
 			},
 		},
 		{
-			input:             `"mon" + "key"`,
-			expectedConstants: []any{"mon", "key"},
+			input:             `"mon" + "key"`,
+			expectedConstants: []any{"mon", "key"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"foo" + "bar" + "baz"`,
+			expectedConstants: []any{"foo", "bar", "baz"},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
 				code.Make(code.OpPop),
 			},
 		},
@@ -393,14 +1156,14 @@ func TestIndexExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input:             "[1, 2, 3][1 + 1]",
-			expectedConstants: []any{1, 2, 3, 1, 1},
+			expectedConstants: []any{1, 2, 3},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpAdd),
 				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
@@ -408,13 +1171,13 @@ func TestIndexExpressions(t *testing.T) {
 		},
 		{
 			input:             "{1: 2}[2 - 1]",
-			expectedConstants: []any{1, 2, 2, 1},
+			expectedConstants: []any{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpHash, 2),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSub),
 				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
@@ -425,6 +1188,48 @@ func TestIndexExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestSliceExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "[1, 2][0:1]",
+			expectedConstants: []any{1, 2, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"abc"[:2]`,
+			expectedConstants: []any{"abc", 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"abc"[1:]`,
+			expectedConstants: []any{"abc", 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpNull),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestFunctions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -462,14 +1267,65 @@ func TestFunctions(t *testing.T) {
 			},
 		},
 		{
+			// The peephole pass drops the unused 1 from the function too.
 			input: `fn() { 1; 2 }`,
 			expectedConstants: []any{
 				1,
 				2,
 				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestDeadCodeAfterReturn(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn() { return 1; foo(); 2 }`,
+			expectedConstants: []any{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { if (true) { return 1; 2 }; 3 }`,
+			expectedConstants: []any{
+				1,
+				3,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpTrue),
+					// 0001
+					code.Make(code.OpJumpNotTruthy, 15),
+					// 0006
 					code.Make(code.OpConstant, 0),
+					// 0009
+					code.Make(code.OpReturnValue),
+					// 0010
+					code.Make(code.OpJump, 16),
+					// 0015
+					code.Make(code.OpNull),
+					// 0016
 					code.Make(code.OpPop),
+					// 0017
 					code.Make(code.OpConstant, 1),
+					// 0020
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -497,6 +1353,43 @@ func TestFunctionsWithoutReturnValue(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input: `fn() { let a = 1; }`,
+			expectedConstants: []any{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(a) { if (a) { return 1; } 2 }`,
+			expectedConstants: []any{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 16),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpJump, 17),
+					code.Make(code.OpNull),
+					code.Make(code.OpPop),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
 	runCompilerTests(t, tests)
@@ -560,15 +1453,15 @@ func TestFunctionCalls(t *testing.T) {
 		},
 		{
 			input: `
-      let manyArgs = fn(a, b, c) { a; b; c; };
+      let manyArgs = fn(a, b, c) { a + b + c };
       manyArgs(24, 25, 26);`,
 			expectedConstants: []any{
 				[]code.Instructions{
 					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpPop),
 					code.Make(code.OpGetLocal, 1),
-					code.Make(code.OpPop),
+					code.Make(code.OpAdd),
 					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpAdd),
 					code.Make(code.OpReturnValue),
 				},
 				24,
@@ -644,7 +1537,180 @@ func TestClosures(t *testing.T) {
 				},
 				[]code.Instructions{
 					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+      let global = 55;
+
+      fn() {
+        let a = 66;
+        fn() {
+          let b = 77;
+          fn() {
+            let c = 88;
+            global + a + b + c;
+          }
+        }
+      }
+      `,
+			expectedConstants: []any{
+				55,
+				66,
+				77,
+				88,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 3),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetFree, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 4, 2),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 5, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 6, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let countDown = fn(x) { countDown(x - 1); };
+			countDown(1);
+			`,
+			expectedConstants: []any{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) { countDown(x - 1); };
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expectedConstants: []any{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpClosure, 1, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(a, f) { if (a) { f(1) } else { f(2) } }`,
+			expectedConstants: []any{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 19),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpJump, 26),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(f) { f(1); return f(2); }`,
+			expectedConstants: []any{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -654,57 +1720,21 @@ func TestClosures(t *testing.T) {
 			},
 		},
 		{
-			input: `
-      let global = 55;
-
-      fn() {
-        let a = 66;
-        fn() {
-          let b = 77;
-          fn() {
-            let c = 88;
-            global + a + b + c;
-          }
-        }
-      }
-      `,
+			input: `fn(f) { f(1) + 2 }`,
 			expectedConstants: []any{
-				55,
-				66,
-				77,
-				88,
-				[]code.Instructions{
-					code.Make(code.OpConstant, 3),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetGlobal, 0),
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpAdd),
-					code.Make(code.OpGetFree, 1),
-					code.Make(code.OpAdd),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
-				},
+				1,
+				2,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 2),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetFree, 0),
 					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 4, 2),
-					code.Make(code.OpReturnValue),
-				},
-				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCall, 1),
 					code.Make(code.OpConstant, 1),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 5, 1),
+					code.Make(code.OpAdd),
 					code.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpClosure, 6, 0),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -713,6 +1743,130 @@ func TestClosures(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestWideOperands(t *testing.T) {
+	// Negating each constant keeps the peephole pass from dropping it.
+	var input strings.Builder
+	for i := 0; i <= math.MaxUint16+1; i++ {
+		fmt.Fprintf(&input, "!%d;\n", i)
+	}
+	input.WriteString("if (true) { 1 }")
+
+	compiler := New()
+	if err := compiler.Compile(parse(input.String())); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	if len(bytecode.Constants) != math.MaxUint16+2 {
+		t.Fatalf("wrong number of constants. want=%d, got=%d",
+			math.MaxUint16+2, len(bytecode.Constants))
+	}
+
+	// Every statement but the last takes five bytes, so the if expression
+	// starts at 65536*5 + 7 and its jumps land past 65535.
+	expected := concatInstructions([]code.Instructions{
+		// 327675
+		code.Make(code.OpConstant, math.MaxUint16),
+		// 327678
+		code.Make(code.OpBang),
+		// 327679
+		code.Make(code.OpPop),
+		// 327680
+		code.Make(code.OpConstantWide, math.MaxUint16+1),
+		// 327685
+		code.Make(code.OpBang),
+		// 327686
+		code.Make(code.OpPop),
+		// 327687
+		code.Make(code.OpTrue),
+		// 327688
+		code.Make(code.OpJumpNotTruthy, 327701),
+		// 327693
+		code.Make(code.OpConstant, 1),
+		// 327696
+		code.Make(code.OpJump, 327702),
+		// 327701
+		code.Make(code.OpNull),
+		// 327702
+		code.Make(code.OpPop),
+	})
+
+	tail := bytecode.Instructions[len(bytecode.Instructions)-len(expected):]
+	if err := testInstructions([]code.Instructions{expected}, tail); err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+}
+
+func TestWideGlobals(t *testing.T) {
+	symbolTable := NewSymbolTable()
+	for i := 0; i <= math.MaxUint16; i++ {
+		symbolTable.DefineHidden()
+	}
+
+	compiler := NewWithState(symbolTable, []object.Object{})
+	if err := compiler.Compile(parse("let a = 1; a = a + 1")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := testInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpSetGlobalWide, math.MaxUint16+1),
+		code.Make(code.OpGetGlobalWide, math.MaxUint16+1),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpAdd),
+		code.Make(code.OpSetGlobalWide, math.MaxUint16+1),
+		code.Make(code.OpGetGlobalWide, math.MaxUint16+1),
+		code.Make(code.OpPop),
+	}, compiler.Bytecode().Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+}
+
+func TestRegisterBuiltin(t *testing.T) {
+	compiler := New()
+	if err := compiler.RegisterBuiltin("double"); err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+
+	program := parse("fn() { double }")
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := []code.Instructions{
+		code.Make(code.OpGetBuiltin, len(object.Builtins)),
+		code.Make(code.OpReturnValue),
+	}
+
+	fn, ok := compiler.Bytecode().Constants[0].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant is not a function. got=%T",
+			compiler.Bytecode().Constants[0])
+	}
+
+	if err := testInstructions(expected, fn.Instructions); err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	if builtins := compiler.Bytecode().Builtins; fmt.Sprint(builtins) != "[double]" {
+		t.Errorf("wrong registered builtins. want=[double], got=%v", builtins)
+	}
+}
+
+func TestRegisterTooManyBuiltins(t *testing.T) {
+	compiler := New()
+
+	var err error
+	for i := len(object.Builtins); i <= 256 && err == nil; i++ {
+		err = compiler.RegisterBuiltin(fmt.Sprintf("builtin%d", i))
+	}
+
+	if err == nil {
+		t.Fatalf("expected an error registering more than 256 builtins")
+	}
+}
+
 func TestCompilerScopes(t *testing.T) {
 	compiler := New()
 	if compiler.scopeIndex != 0 {
@@ -770,6 +1924,46 @@ func TestCompilerScopes(t *testing.T) {
 	}
 }
 
+func TestLastInstructionHelpers(t *testing.T) {
+	compiler := New()
+	if compiler.lastInstructionIs(code.OpPop) {
+		t.Errorf("lastInstructionIs true for empty instructions")
+	}
+
+	compiler.emit(code.OpTrue)
+	compiler.emit(code.OpPop)
+	if !compiler.lastInstructionIs(code.OpPop) {
+		t.Fatalf("lastInstructionIs(OpPop) false after emitting OpPop")
+	}
+
+	compiler.removeLastPop()
+	if err := testInstructions(
+		[]code.Instructions{code.Make(code.OpTrue)},
+		compiler.currentInstructions(),
+	); err != nil {
+		t.Errorf("removeLastPop: %s", err)
+	}
+	if !compiler.lastInstructionIs(code.OpTrue) {
+		t.Errorf("removeLastPop did not restore the previous instruction")
+	}
+
+	compiler.enterScope()
+	compiler.emit(code.OpConstant, 0)
+	compiler.emit(code.OpPop)
+	compiler.replaceLastPopWithReturn()
+	if !compiler.lastInstructionIs(code.OpReturnValue) {
+		t.Errorf("lastInstructionIs(OpReturnValue) false after replacing OpPop")
+	}
+
+	instructions := compiler.leaveScope()
+	if err := testInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpReturnValue),
+	}, instructions); err != nil {
+		t.Errorf("replaceLastPopWithReturn: %s", err)
+	}
+}
+
 func TestLetStatementScopes(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -836,6 +2030,30 @@ func TestLetStatementScopes(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input: `
+      let num = 1;
+      fn() {
+        let num = 2;
+        num
+      }`,
+			expectedConstants: []any{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
 	runCompilerTests(t, tests)
@@ -866,7 +2084,7 @@ func TestBuildins(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpGetBuiltin, 0),
 					code.Make(code.OpArray, 0),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -880,13 +2098,334 @@ func TestBuildins(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func runCompilerTests(t *testing.T, tests []compilerTestCase) {
+func TestLineInformation(t *testing.T) {
+	input := `let a = 1;
+let f = fn() {
+  a;
+  return 2;
+};
+f()`
+
+	// The peephole pass would drop `a;` along with its lines.
+	compiler := New(WithOptimizations(OptimizeNone))
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	if len(bytecode.Lines) != len(bytecode.Instructions) {
+		t.Fatalf("wrong number of lines. want=%d, got=%d",
+			len(bytecode.Instructions), len(bytecode.Lines))
+	}
+
+	expectedMain := []int{
+		1, 1, 1, // OpConstant 1
+		1, 1, 1, // OpSetGlobal 0
+		2, 2, 2, 2, // OpClosure 2 0
+		2, 2, 2, // OpSetGlobal 1
+		6, 6, 6, // OpGetGlobal 1
+		6, 6, // OpCall 0
+		6, // OpPop
+	}
+	for i, line := range expectedMain {
+		if bytecode.Lines[i] != line {
+			t.Fatalf("wrong line at offset %d. want=%d, got=%d\n%s",
+				i, line, bytecode.Lines[i], bytecode.Instructions)
+		}
+	}
+
+	fn, ok := bytecode.Constants[2].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 2 is not a function: %T", bytecode.Constants[2])
+	}
+
+	expectedFn := []int{
+		3, 3, 3, // OpGetGlobal 0
+		3,       // OpPop
+		4, 4, 4, // OpConstant 1
+		4, // OpReturnValue
+	}
+	if len(fn.Lines) != len(expectedFn) {
+		t.Fatalf("wrong number of function lines. want=%d, got=%d",
+			len(expectedFn), len(fn.Lines))
+	}
+	for i, line := range expectedFn {
+		if fn.Lines[i] != line {
+			t.Fatalf("wrong function line at offset %d. want=%d, got=%d",
+				i, line, fn.Lines[i])
+		}
+	}
+}
+
+func TestSourceMaps(t *testing.T) {
+	input := `let a = 1;
+a + "xy";
+let f = fn(x) { x };`
+
+	compiler := New()
+	compiler.EnableSourceMaps()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	tests := []struct {
+		offset   int
+		expected code.Span
+	}{
+		{0, code.Span{Line: 1, StartCol: 9, EndCol: 10}},  // OpConstant 0
+		{4, code.Span{Line: 1, StartCol: 1, EndCol: 4}},   // OpSetGlobal 0
+		{6, code.Span{Line: 2, StartCol: 1, EndCol: 2}},   // OpGetGlobal 0
+		{10, code.Span{Line: 2, StartCol: 5, EndCol: 9}},  // OpConstant 1
+		{12, code.Span{Line: 2, StartCol: 3, EndCol: 4}},  // OpAdd
+		{13, code.Span{Line: 2, StartCol: 1, EndCol: 2}},  // OpPop
+		{14, code.Span{Line: 3, StartCol: 9, EndCol: 11}}, // OpClosure 2 0
+	}
+
+	for _, tt := range tests {
+		span, ok := bytecode.SpanForOffset(tt.offset)
+		if !ok {
+			t.Fatalf("no span for offset %d", tt.offset)
+		}
+		if span != tt.expected {
+			t.Errorf("wrong span for offset %d. want=%s, got=%s",
+				tt.offset, tt.expected, span)
+		}
+	}
+
+	if _, ok := bytecode.SpanForOffset(len(bytecode.Instructions)); ok {
+		t.Errorf("expected no span past the last instruction")
+	}
+
+	fn, ok := bytecode.Constants[2].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 2 is not a function: %T", bytecode.Constants[2])
+	}
+
+	expected := code.Span{Line: 3, StartCol: 17, EndCol: 18}
+	for offset := range fn.Instructions {
+		span, ok := fn.SourceMap.SpanForOffset(offset)
+		if !ok || span != expected {
+			t.Errorf("wrong function span for offset %d. want=%s, got=%s",
+				offset, expected, span)
+		}
+	}
+}
+
+func TestSourceMapsDisabledByDefault(t *testing.T) {
+	compiler := New()
+	if err := compiler.Compile(parse("fn() { 1 }")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	if bytecode.SourceMap != nil {
+		t.Errorf("expected no source map, got=%+v", bytecode.SourceMap)
+	}
+	if _, ok := bytecode.SpanForOffset(0); ok {
+		t.Errorf("expected no span without a source map")
+	}
+
+	fn := bytecode.Constants[1].(*object.CompiledFunction)
+	if fn.SourceMap != nil {
+		t.Errorf("expected no function source map, got=%+v", fn.SourceMap)
+	}
+}
+
+// benchmarkProgram exercises most of the compiler: functions, closures,
+// loops, conditionals and every kind of literal.
+const benchmarkProgram = `
+let fibonacci = fn(x) {
+	if (x < 2) { return x; }
+	fibonacci(x - 1) + fibonacci(x - 2)
+};
+let makeAdder = fn(a) { fn(b) { a + b } };
+let addTwo = makeAdder(2);
+let i = 0;
+let total = 0;
+while (i < 100) {
+	if (i % 2 == 0) { total = total + addTwo(i); } else { total = total - 1; }
+	i = i + 1;
+}
+let data = {"name": "monkey", "values": [1, 2.5, true, "x"], 3: [i, total]};
+let text = "a" + "b" + data["name"];
+puts(fibonacci(10), text[1:], data["values"][-1], ~i & 255 | 1 << 3);
+`
+
+func BenchmarkCompile(b *testing.B) {
+	program := parse(benchmarkProgram)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := New().Compile(program); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+	}
+}
+
+func BenchmarkCompileWithSourceMaps(b *testing.B) {
+	program := parse(benchmarkProgram)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compiler := New()
+		compiler.EnableSourceMaps()
+		if err := compiler.Compile(program); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+	}
+}
+
+func TestOptimizationLevels(t *testing.T) {
+	input := "-1; 2 * 3; 2; fn() { return 1; 2 }"
+
+	none := compilerTestCase{
+		input: input,
+		expectedConstants: []any{
+			1, 2, 3, 2, 1, 2,
+			[]code.Instructions{
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpReturnValue),
+			},
+		},
+		expectedInstructions: []code.Instructions{
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpMinus),
+			code.Make(code.OpPop),
+			code.Make(code.OpConstant, 1),
+			code.Make(code.OpConstant, 2),
+			code.Make(code.OpMul),
+			code.Make(code.OpPop),
+			code.Make(code.OpConstant, 3),
+			code.Make(code.OpPop),
+			code.Make(code.OpClosure, 6, 0),
+			code.Make(code.OpPop),
+		},
+	}
+
+	safe := compilerTestCase{
+		input: input,
+		expectedConstants: []any{
+			-1, 2, 3, 1,
+			[]code.Instructions{
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpReturnValue),
+			},
+		},
+		// The peephole pass drops the unused -1 and 2.
+		expectedInstructions: []code.Instructions{
+			code.Make(code.OpConstant, 1),
+			code.Make(code.OpConstant, 2),
+			code.Make(code.OpMul),
+			code.Make(code.OpPop),
+			code.Make(code.OpClosure, 4, 0),
+			code.Make(code.OpPop),
+		},
+	}
+
+	aggressive := compilerTestCase{
+		input: input,
+		expectedConstants: []any{
+			-1, 6, 2, 1,
+			[]code.Instructions{
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpReturnValue),
+			},
+		},
+		// Once folded, every statement but the last is dropped.
+		expectedInstructions: []code.Instructions{
+			code.Make(code.OpClosure, 4, 0),
+			code.Make(code.OpPop),
+		},
+	}
+
+	tests := []struct {
+		level    int
+		expected compilerTestCase
+	}{
+		{OptimizeNone, none},
+		{OptimizeSafe, safe},
+		{OptimizeAggressive, aggressive},
+		// Out of range levels are clamped.
+		{-1, none},
+		{7, aggressive},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("level %d", tt.level), func(t *testing.T) {
+			runCompilerTests(t, []compilerTestCase{tt.expected},
+				WithOptimizations(tt.level))
+		})
+	}
+}
+
+func TestOptimizeNoneSkipsPeephole(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let i = 0; do { continue } while (i < 3); 1; 2",
+			expectedConstants: []any{0, 3, 1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpJump, 11),
+				// 0011
+				code.Make(code.OpGetGlobal, 0),
+				// 0014
+				code.Make(code.OpConstant, 1),
+				// 0017
+				code.Make(code.OpLessThan),
+				// 0018
+				code.Make(code.OpJumpTruthy, 6),
+				// 0023
+				code.Make(code.OpConstant, 2),
+				// 0026
+				code.Make(code.OpPop),
+				// 0027
+				code.Make(code.OpConstant, 3),
+				// 0030
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(a) { a; 1 }",
+			expectedConstants: []any{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpPop),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests, WithOptimizations(OptimizeNone))
+}
+
+func runCompilerTests(
+	t *testing.T,
+	tests []compilerTestCase,
+	opts ...Option,
+) {
 	t.Helper()
 
 	for _, tt := range tests {
 		program := parse(tt.input)
 
-		compiler := New()
+		compiler := New(opts...)
 		if err := compiler.Compile(program); err != nil {
 			t.Fatalf("compiler error: %s", err)
 		}
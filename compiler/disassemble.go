@@ -0,0 +1,49 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ZeroBl21/go-interpreter/code"
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+// Disassemble formats ins like code.Instructions.String, annotating
+// instructions that refer to the constant pool with the constant's value and
+// jumps with the offset they land on. It lives here rather than in the code
+// package because code cannot import object.
+func Disassemble(ins code.Instructions, constants []object.Object) string {
+	return ins.Annotate(func(op code.Opcode, operands []int) string {
+		switch {
+		case op == code.OpConstant || op == code.OpConstantWide ||
+			op == code.OpClosure:
+			return describeConstant(constants, operands[0])
+		case isJump(op):
+			return fmt.Sprintf("-> %04d", operands[0])
+		default:
+			return ""
+		}
+	})
+}
+
+// Disassemble formats the main program of b, see Disassemble.
+func (b *Bytecode) Disassemble() string {
+	return Disassemble(b.Instructions, b.Constants)
+}
+
+func describeConstant(constants []object.Object, index int) string {
+	if index < 0 || index >= len(constants) {
+		return fmt.Sprintf("constant %d out of range", index)
+	}
+
+	switch constant := constants[index].(type) {
+	case *object.String:
+		return strconv.Quote(constant.Value)
+	case *object.CompiledFunction:
+		// The default Inspect prints a pointer, which is useless to read.
+		return fmt.Sprintf("fn(%d params, %d locals)",
+			constant.NumParameters, constant.NumLocals)
+	default:
+		return constant.Inspect()
+	}
+}
@@ -0,0 +1,33 @@
+package compiler
+
+import (
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	input := `let x = "a"; if (x == "a") { 1 } else { 2.5 }; fn(y) { y }`
+
+	expected := `0000 OpConstant 0 // "a"
+0003 OpSetGlobal 0
+0006 OpGetGlobal 0
+0009 OpConstant 0 // "a"
+0012 OpEqual
+0013 OpJumpNotTruthy 26 // -> 0026
+0018 OpConstant 1 // 1
+0021 OpJump 29 // -> 0029
+0026 OpConstant 2 // 2.5
+0029 OpPop
+0030 OpClosure 3 0 // fn(1 params, 1 locals)
+0034 OpPop
+`
+
+	compiler := New()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	actual := compiler.Bytecode().Disassemble()
+	if actual != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, actual)
+	}
+}
@@ -0,0 +1,342 @@
+package compiler
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/ZeroBl21/go-interpreter/ast"
+	"github.com/ZeroBl21/go-interpreter/token"
+)
+
+// FoldConstants rewrites node in place, replacing every prefix and infix
+// expression whose operands are integer, float, boolean or string literals
+// with the literal it evaluates to. Expressions whose evaluation would fail
+// or overflow at runtime, like division by zero, are left untouched so the
+// VM still reports them.
+func FoldConstants(node ast.Node) ast.Node {
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			FoldConstants(s)
+		}
+
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			FoldConstants(s)
+		}
+
+	case *ast.ExpressionStatement:
+		node.Expression = foldExpression(node.Expression)
+
+	case *ast.LetStatement:
+		node.Value = foldExpression(node.Value)
+
+	case *ast.ReturnStatenment:
+		node.ReturnValue = foldExpression(node.ReturnValue)
+
+	case *ast.WhileStatement:
+		node.Condition = foldExpression(node.Condition)
+		FoldConstants(node.Body)
+
+	case *ast.DoWhileStatement:
+		FoldConstants(node.Body)
+		node.Condition = foldExpression(node.Condition)
+
+	case *ast.ForEachStatement:
+		node.Iterable = foldExpression(node.Iterable)
+		FoldConstants(node.Body)
+
+	case *ast.SwitchStatement:
+		node.Subject = foldExpression(node.Subject)
+		for _, c := range node.Cases {
+			c.Value = foldExpression(c.Value)
+			FoldConstants(c.Body)
+		}
+		if node.Default != nil {
+			FoldConstants(node.Default)
+		}
+
+	case ast.Expression:
+		return foldExpression(node)
+	}
+
+	return node
+}
+
+func foldExpression(exp ast.Expression) ast.Expression {
+	switch exp := exp.(type) {
+	case *ast.PrefixExpression:
+		exp.Right = foldExpression(exp.Right)
+		if folded := foldPrefix(exp); folded != nil {
+			return folded
+		}
+
+	case *ast.InfixExpression:
+		exp.Left = foldExpression(exp.Left)
+		exp.Right = foldExpression(exp.Right)
+		if folded := foldInfix(exp); folded != nil {
+			return folded
+		}
+
+	case *ast.AssignExpression:
+		exp.Target = foldExpression(exp.Target)
+		exp.Value = foldExpression(exp.Value)
+
+	case *ast.IfExpression:
+		exp.Condition = foldExpression(exp.Condition)
+		FoldConstants(exp.Consequence)
+		if exp.Alternative != nil {
+			FoldConstants(exp.Alternative)
+		}
+
+	case *ast.FunctionLiteral:
+		FoldConstants(exp.Body)
+
+	case *ast.TemplateLiteral:
+		for i, part := range exp.Parts {
+			exp.Parts[i] = foldExpression(part)
+		}
+
+	case *ast.CallExpression:
+		// Quoted code is data and must come out as it was written.
+		if exp.Function.TokenLiteral() == "quote" {
+			break
+		}
+		exp.Function = foldExpression(exp.Function)
+		for i, a := range exp.Arguments {
+			exp.Arguments[i] = foldExpression(a)
+		}
+
+	case *ast.ArrayLiteral:
+		for i, el := range exp.Elements {
+			exp.Elements[i] = foldExpression(el)
+		}
+
+	case *ast.HashLiteral:
+		pairs := make(map[ast.Expression]ast.Expression, len(exp.Pairs))
+		keys := make([]ast.Expression, 0, len(exp.Pairs))
+		for _, k := range exp.OrderedKeys() {
+			folded := foldExpression(k)
+			pairs[folded] = foldExpression(exp.Pairs[k])
+			keys = append(keys, folded)
+		}
+		exp.Pairs = pairs
+		exp.Keys = keys
+
+	case *ast.IndexExpression:
+		exp.Left = foldExpression(exp.Left)
+		exp.Index = foldExpression(exp.Index)
+
+	case *ast.SliceExpression:
+		exp.Left = foldExpression(exp.Left)
+		if exp.Low != nil {
+			exp.Low = foldExpression(exp.Low)
+		}
+		if exp.High != nil {
+			exp.High = foldExpression(exp.High)
+		}
+	}
+
+	return exp
+}
+
+func foldPrefix(exp *ast.PrefixExpression) ast.Expression {
+	switch exp.Operator {
+	case "-":
+		switch right := exp.Right.(type) {
+		case *ast.IntegerLiteral:
+			if right.Value == math.MinInt64 {
+				return nil
+			}
+			return newIntegerLiteral(-right.Value)
+		case *ast.FloatLiteral:
+			return newFloatLiteral(-right.Value)
+		}
+
+	case "!":
+		switch right := exp.Right.(type) {
+		case *ast.Boolean:
+			return newBooleanLiteral(!right.Value)
+		case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral:
+			return newBooleanLiteral(false)
+		}
+	}
+
+	return nil
+}
+
+// foldLiteralPrefix folds `-` on a number literal and `!` on a boolean
+// literal, which the compiler does even without FoldConstants, so -5 is a
+// single constant. `!` on other literals is left to the VM, where what is
+// truthy depends on its options.
+func foldLiteralPrefix(exp *ast.PrefixExpression) ast.Expression {
+	switch exp.Right.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral:
+		if exp.Operator == "-" {
+			return foldPrefix(exp)
+		}
+	case *ast.Boolean:
+		if exp.Operator == "!" {
+			return foldPrefix(exp)
+		}
+	}
+
+	return nil
+}
+
+func foldInfix(exp *ast.InfixExpression) ast.Expression {
+	switch left := exp.Left.(type) {
+	case *ast.IntegerLiteral:
+		switch right := exp.Right.(type) {
+		case *ast.IntegerLiteral:
+			return foldIntegerInfix(exp.Operator, left.Value, right.Value)
+		case *ast.FloatLiteral:
+			return foldFloatInfix(exp.Operator, float64(left.Value), right.Value)
+		}
+
+	case *ast.FloatLiteral:
+		switch right := exp.Right.(type) {
+		case *ast.IntegerLiteral:
+			return foldFloatInfix(exp.Operator, left.Value, float64(right.Value))
+		case *ast.FloatLiteral:
+			return foldFloatInfix(exp.Operator, left.Value, right.Value)
+		}
+
+	case *ast.StringLiteral:
+		if right, ok := exp.Right.(*ast.StringLiteral); ok {
+			return foldStringInfix(exp.Operator, left.Value, right.Value)
+		}
+
+	case *ast.Boolean:
+		if right, ok := exp.Right.(*ast.Boolean); ok {
+			return foldBooleanInfix(exp.Operator, left.Value, right.Value)
+		}
+	}
+
+	return nil
+}
+
+func foldIntegerInfix(operator string, left, right int64) ast.Expression {
+	switch operator {
+	case "+":
+		if result := left + right; (result > left) == (right > 0) {
+			return newIntegerLiteral(result)
+		}
+	case "-":
+		if result := left - right; (result < left) == (right > 0) {
+			return newIntegerLiteral(result)
+		}
+	case "*":
+		if left == 0 || right == 0 {
+			return newIntegerLiteral(0)
+		}
+		if left == -1 || right == -1 {
+			// Leave MinInt64 negation to the VM's BigInt promotion.
+			if left == math.MinInt64 || right == math.MinInt64 {
+				return nil
+			}
+		}
+		if result := left * right; result/right == left {
+			return newIntegerLiteral(result)
+		}
+	case "/":
+		if right == 0 || (left == math.MinInt64 && right == -1) {
+			return nil
+		}
+		return newIntegerLiteral(left / right)
+	case "%":
+		if right == 0 {
+			return nil
+		}
+		return newIntegerLiteral(left % right)
+	case "<":
+		return newBooleanLiteral(left < right)
+	case ">":
+		return newBooleanLiteral(left > right)
+	case "==":
+		return newBooleanLiteral(left == right)
+	case "!=":
+		return newBooleanLiteral(left != right)
+	}
+
+	return nil
+}
+
+func foldFloatInfix(operator string, left, right float64) ast.Expression {
+	switch operator {
+	case "+":
+		return newFloatLiteral(left + right)
+	case "-":
+		return newFloatLiteral(left - right)
+	case "*":
+		return newFloatLiteral(left * right)
+	case "/":
+		if right == 0 {
+			return nil
+		}
+		return newFloatLiteral(left / right)
+	case "<":
+		return newBooleanLiteral(left < right)
+	case ">":
+		return newBooleanLiteral(left > right)
+	case "==":
+		return newBooleanLiteral(left == right)
+	case "!=":
+		return newBooleanLiteral(left != right)
+	}
+
+	return nil
+}
+
+func foldStringInfix(operator string, left, right string) ast.Expression {
+	switch operator {
+	case "+":
+		return newStringLiteral(left + right)
+	case "==":
+		return newBooleanLiteral(left == right)
+	case "!=":
+		return newBooleanLiteral(left != right)
+	}
+
+	return nil
+}
+
+func foldBooleanInfix(operator string, left, right bool) ast.Expression {
+	switch operator {
+	case "&&":
+		return newBooleanLiteral(left && right)
+	case "||":
+		return newBooleanLiteral(left || right)
+	case "==":
+		return newBooleanLiteral(left == right)
+	case "!=":
+		return newBooleanLiteral(left != right)
+	}
+
+	return nil
+}
+
+func newIntegerLiteral(value int64) *ast.IntegerLiteral {
+	tok := token.Token{Type: token.INT, Literal: strconv.FormatInt(value, 10)}
+	return &ast.IntegerLiteral{Token: tok, Value: value}
+}
+
+func newFloatLiteral(value float64) *ast.FloatLiteral {
+	literal := strconv.FormatFloat(value, 'f', -1, 64)
+	tok := token.Token{Type: token.FLOAT, Literal: literal}
+	return &ast.FloatLiteral{Token: tok, Value: value}
+}
+
+func newStringLiteral(value string) *ast.StringLiteral {
+	tok := token.Token{Type: token.STRING, Literal: value}
+	return &ast.StringLiteral{Token: tok, Value: value}
+}
+
+func newBooleanLiteral(value bool) *ast.Boolean {
+	tok := token.Token{Type: token.FALSE, Literal: "false"}
+	if value {
+		tok = token.Token{Type: token.TRUE, Literal: "true"}
+	}
+
+	return &ast.Boolean{Token: tok, Value: value}
+}
@@ -0,0 +1,168 @@
+package compiler
+
+import (
+	"testing"
+
+	"github.com/ZeroBl21/go-interpreter/code"
+)
+
+func TestFoldConstants(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "2 + 3 * 4",
+			expectedConstants: []any{14},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-(10 / 2) + 1",
+			expectedConstants: []any{-4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 < 2; !true",
+			expectedConstants: []any{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"mon" + "key"`,
+			expectedConstants: []any{"monkey"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1.5 * 2 == 3",
+			expectedConstants: []any{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 1; x + 2 * 3",
+			expectedConstants: []any{1, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { return 60 * 60 }",
+			expectedConstants: []any{
+				3600,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "17 % 5 * 2",
+			expectedConstants: []any{4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 % 0",
+			expectedConstants: []any{1, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 / 0",
+			expectedConstants: []any{1, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "9223372036854775807 + 1",
+			expectedConstants: []any{9223372036854775807, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		program := FoldConstants(parse(tt.input))
+
+		compiler := New(WithOptimizations(OptimizeNone))
+		if err := compiler.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+		err := testInstructions(tt.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Fatalf("testInstructions failed: %s", err)
+		}
+
+		err = testConstants(t, tt.expectedConstants, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("testConstants failed: %s", err)
+		}
+	}
+}
+
+func TestFoldConstantsShrinksConstantPool(t *testing.T) {
+	input := "let a = [1 + 2, 3 * 4, 5 - 6]; a[0 + 1] * (10 / 5)"
+
+	plain := New()
+	if err := plain.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	folded := New()
+	if err := folded.Compile(FoldConstants(parse(input))); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	before := len(plain.Bytecode().Constants)
+	after := len(folded.Bytecode().Constants)
+	if after != 5 || before != 8 {
+		t.Errorf("wrong constant pool sizes. want=8 -> 5, got=%d -> %d",
+			before, after)
+	}
+}
+
+func TestFoldConstantsLeavesQuotedCode(t *testing.T) {
+	program := FoldConstants(parse("quote(1 + 2); 1 + 2"))
+
+	expected := "quote((1 + 2))3"
+	if program.String() != expected {
+		t.Errorf("wrong program. want=%q, got=%q", expected, program.String())
+	}
+}
@@ -0,0 +1,267 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+// Serialized globals use the encoding of marshal.go with their own magic and
+// version:
+//
+//	magic    [4]byte "MNKG"
+//	version  uint16
+//	count    uint32, then count values
+//
+// A value is a constant as in the bytecode format or one of the tags below,
+// which only appear at run time:
+//
+//	tagArray    uint32 count, values
+//	tagHash     uint32 count, key and value of each pair in insertion order
+//	tagClosure  function as a constant, uint32 count, free values
+//	tagBuiltin  uint32 length, name in object.Builtins
+//	tagUnset    nothing, a global no program has set
+var globalsMagic = [4]byte{'M', 'N', 'K', 'G'}
+
+// GlobalsFormatVersion is the version of the serialized globals layout
+// written by MarshalGlobals.
+const GlobalsFormatVersion uint16 = 1
+
+const (
+	tagArray byte = tagCompiledFunction + 1 + iota
+	tagHash
+	tagClosure
+	tagBuiltin
+	tagUnset
+)
+
+// MarshalGlobals writes the values of a VM's globals to w, so they can be
+// restored with LoadGlobals alongside the symbol table and constants that
+// refer to them. Builtins are written by name, so ones registered by an
+// embedder can't be written, and neither can arrays or hashes that contain
+// themselves.
+func MarshalGlobals(w io.Writer, globals []object.Object) error {
+	e := &valueEncoder{
+		encoder:  &encoder{w: w},
+		visiting: make(map[object.Object]bool),
+	}
+
+	e.write(globalsMagic)
+	e.write(GlobalsFormatVersion)
+
+	e.writeLength(len(globals))
+	for _, value := range globals {
+		e.writeValue(value)
+	}
+
+	return e.err
+}
+
+// valueEncoder extends encoder with the values a program builds at run time.
+type valueEncoder struct {
+	*encoder
+	// visiting holds the arrays and hashes being written, to refuse cycles.
+	visiting map[object.Object]bool
+}
+
+func (e *valueEncoder) writeValue(obj object.Object) {
+	if e.err != nil {
+		return
+	}
+
+	switch obj := obj.(type) {
+	case nil:
+		e.write(tagUnset)
+
+	case *object.Array:
+		if !e.enter(obj) {
+			return
+		}
+		e.write(tagArray)
+		e.writeValues(obj.Elements)
+		delete(e.visiting, obj)
+
+	case *object.Hash:
+		if !e.enter(obj) {
+			return
+		}
+		pairs := obj.OrderedPairs()
+		e.write(tagHash)
+		e.writeLength(len(pairs))
+		for _, pair := range pairs {
+			e.writeValue(pair.Key)
+			e.writeValue(pair.Value)
+		}
+		delete(e.visiting, obj)
+
+	case *object.Closure:
+		e.write(tagClosure)
+		e.writeConstant(obj.Fn)
+		e.writeValues(obj.Free)
+
+	case *object.Builtin:
+		name, ok := builtinName(obj)
+		if !ok {
+			e.err = errors.New("cannot serialize a registered builtin")
+			return
+		}
+		e.write(tagBuiltin)
+		e.writeBytes([]byte(name))
+
+	default:
+		e.writeConstant(obj)
+	}
+}
+
+func (e *valueEncoder) writeValues(values []object.Object) {
+	e.writeLength(len(values))
+	for _, value := range values {
+		e.writeValue(value)
+	}
+}
+
+// enter marks obj as being written, failing if it already is.
+func (e *valueEncoder) enter(obj object.Object) bool {
+	if e.visiting[obj] {
+		e.err = fmt.Errorf("cannot serialize %s containing itself", obj.Type())
+		return false
+	}
+
+	e.visiting[obj] = true
+	return true
+}
+
+func builtinName(builtin *object.Builtin) (string, bool) {
+	for _, def := range object.Builtins {
+		if def.Builtin == builtin {
+			return def.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// LoadGlobals reads globals written by MarshalGlobals, to be handed to
+// vm.NewWithGlobalsStore.
+func LoadGlobals(r io.Reader) ([]object.Object, error) {
+	d := &decoder{r: r}
+
+	var magic [4]byte
+	d.read(&magic)
+	if d.err == nil && magic != globalsMagic {
+		return nil, fmt.Errorf("invalid globals: bad magic %q", magic[:])
+	}
+
+	var version uint16
+	d.read(&version)
+	if d.err == nil && version != GlobalsFormatVersion {
+		return nil, fmt.Errorf("unsupported globals version %d, want %d",
+			version, GlobalsFormatVersion)
+	}
+
+	count := d.readLength()
+	globals := []object.Object{}
+	for i := 0; i < count && d.err == nil; i++ {
+		var tag byte
+		d.read(&tag)
+		if tag == tagUnset {
+			globals = append(globals, nil)
+			continue
+		}
+		globals = append(globals, d.readValueBody(tag))
+	}
+
+	if d.err == nil {
+		if n, _ := r.Read(make([]byte, 1)); n > 0 {
+			d.err = errors.New("unexpected data after globals")
+		}
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid globals: %w", d.err)
+	}
+
+	return globals, nil
+}
+
+func (d *decoder) readValues() []object.Object {
+	count := d.readLength()
+
+	var values []object.Object
+	for i := 0; i < count && d.err == nil; i++ {
+		values = append(values, d.readValue())
+	}
+
+	return values
+}
+
+func (d *decoder) readValue() object.Object {
+	var tag byte
+	d.read(&tag)
+	if d.err != nil {
+		return nil
+	}
+
+	return d.readValueBody(tag)
+}
+
+// readValueBody reads the value of a global whose tag has been read. Only
+// globals themselves can be unset, not the values they contain.
+func (d *decoder) readValueBody(tag byte) object.Object {
+	if d.err != nil {
+		return nil
+	}
+
+	switch tag {
+	case tagArray:
+		elements := d.readValues()
+		if elements == nil {
+			elements = []object.Object{}
+		}
+		return &object.Array{Elements: elements}
+
+	case tagHash:
+		hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+		count := d.readLength()
+		for i := 0; i < count && d.err == nil; i++ {
+			key, value := d.readValue(), d.readValue()
+			if d.err != nil {
+				break
+			}
+
+			hashable, ok := key.(object.Hashable)
+			if !ok {
+				d.err = fmt.Errorf("unusable as hash key: %s", key.Type())
+				break
+			}
+			hash.Set(hashable.HashKey(), object.HashPair{Key: key, Value: value})
+		}
+		return hash
+
+	case tagClosure:
+		// The function is written like a constant, tag included.
+		fn, ok := d.readConstant().(*object.CompiledFunction)
+		if d.err == nil && !ok {
+			d.err = errors.New("closure without a compiled function")
+		}
+		return &object.Closure{Fn: fn, Free: d.readValues()}
+
+	case tagBuiltin:
+		name := string(d.readBytes())
+		if d.err != nil {
+			return nil
+		}
+
+		builtin := object.GetBuiltinByName(name)
+		if builtin == nil {
+			d.err = fmt.Errorf("unknown builtin %q", name)
+			return nil
+		}
+		return builtin
+
+	default:
+		return d.readConstantBody(tag)
+	}
+}
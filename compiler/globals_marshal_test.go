@@ -0,0 +1,172 @@
+package compiler
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ZeroBl21/go-interpreter/code"
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+func TestLoadGlobals(t *testing.T) {
+	hash := &object.Hash{}
+	for _, key := range []string{"b", "a"} {
+		k := &object.String{Value: key}
+		hash.Set(k.HashKey(), object.HashPair{Key: k, Value: object.TRUE})
+	}
+
+	fn := &object.CompiledFunction{
+		Instructions:  code.Make(code.OpGetFree, 0),
+		NumParameters: 1,
+		Name:          "f",
+	}
+
+	globals := []object.Object{
+		&object.Integer{Value: 1},
+		nil,
+		&object.Array{Elements: []object.Object{
+			&object.String{Value: "x"}, object.NULL, &object.Array{},
+		}},
+		hash,
+		&object.Closure{Fn: fn, Free: []object.Object{&object.Float{Value: 0.5}}},
+		object.GetBuiltinByName("len"),
+	}
+
+	var buf bytes.Buffer
+	if err := MarshalGlobals(&buf, globals); err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	loaded, err := LoadGlobals(&buf)
+	if err != nil {
+		t.Fatalf("load error: %s", err)
+	}
+
+	if len(loaded) != len(globals) {
+		t.Fatalf("wrong number of globals. want=%d, got=%d",
+			len(globals), len(loaded))
+	}
+
+	if loaded[1] != nil {
+		t.Errorf("unset global was set to %s", loaded[1].Inspect())
+	}
+
+	for _, i := range []int{0, 2, 3} {
+		if loaded[i].Inspect() != globals[i].Inspect() {
+			t.Errorf("wrong global %d. want=%s, got=%s",
+				i, globals[i].Inspect(), loaded[i].Inspect())
+		}
+	}
+
+	closure, ok := loaded[4].(*object.Closure)
+	if !ok {
+		t.Fatalf("global 4 is not a closure. got=%T", loaded[4])
+	}
+	if !bytes.Equal(closure.Fn.Instructions, fn.Instructions) ||
+		closure.Fn.NumParameters != 1 || closure.Fn.Name != "f" {
+		t.Errorf("wrong closure function. got=%+v", closure.Fn)
+	}
+	if len(closure.Free) != 1 || closure.Free[0].Inspect() != "0.5" {
+		t.Errorf("wrong free variables. got=%v", closure.Free)
+	}
+
+	if loaded[5] != globals[5] {
+		t.Errorf("builtin not re-linked. got=%v", loaded[5])
+	}
+}
+
+func TestMarshalGlobalsErrors(t *testing.T) {
+	cyclic := &object.Array{}
+	cyclic.Elements = []object.Object{cyclic}
+
+	shared := &object.Array{}
+
+	tests := []struct {
+		globals  []object.Object
+		expected string
+	}{
+		{
+			[]object.Object{cyclic},
+			"cannot serialize ARRAY containing itself",
+		},
+		{
+			[]object.Object{&object.Builtin{}},
+			"cannot serialize a registered builtin",
+		},
+		{
+			[]object.Object{&object.Error{Message: "boom"}},
+			"cannot serialize constant of type ERROR",
+		},
+		// Sharing a value isn't a cycle.
+		{
+			[]object.Object{&object.Array{Elements: []object.Object{shared, shared}}},
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		err := MarshalGlobals(&bytes.Buffer{}, tt.globals)
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			continue
+		}
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestLoadGlobalsErrors(t *testing.T) {
+	tests := []struct {
+		input    []byte
+		expected string
+	}{
+		{
+			[]byte("MNKS\x00\x01"),
+			`invalid globals: bad magic "MNKS"`,
+		},
+		{
+			[]byte("MNKG\x00\x02"),
+			"unsupported globals version 2, want 1",
+		},
+		{
+			concatBytes([]byte("MNKG\x00\x01"), []byte{0, 0, 0, 1},
+				[]byte{tagArray, 0, 0, 0, 1, tagUnset}),
+			"invalid globals: unknown constant tag 12",
+		},
+		{
+			concatBytes([]byte("MNKG\x00\x01"), []byte{0, 0, 0, 1},
+				[]byte{tagHash, 0, 0, 0, 1, tagArray, 0, 0, 0, 0, tagNull}),
+			"invalid globals: unusable as hash key: ARRAY",
+		},
+		{
+			concatBytes([]byte("MNKG\x00\x01"), []byte{0, 0, 0, 1},
+				[]byte{tagBuiltin, 0, 0, 0, 1, 'z'}),
+			`invalid globals: unknown builtin "z"`,
+		},
+		{
+			concatBytes([]byte("MNKG\x00\x01"), []byte{0, 0, 0, 1},
+				[]byte{tagClosure, tagNull, 0, 0, 0, 0}),
+			"invalid globals: closure without a compiled function",
+		},
+		{
+			concatBytes([]byte("MNKG\x00\x01"), []byte{0, 0, 0, 0, tagNull}),
+			"invalid globals: unexpected data after globals",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := LoadGlobals(bytes.NewReader(tt.input))
+		if err == nil {
+			t.Errorf("expected error %q, got none", tt.expected)
+			continue
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
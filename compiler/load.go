@@ -0,0 +1,327 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+
+	"github.com/ZeroBl21/go-interpreter/code"
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+// LoadBytecode reads bytecode written by Bytecode.Marshal. Input with a
+// different format version, truncated or otherwise malformed input is
+// reported as an error, as are operands that would make the VM index out of
+// range: constants, builtins, jump targets and locals are all checked. What
+// depends on the running program, like the number of values on the stack or
+// of a closure's free variables, is checked by the VM, which fails with an
+// error such as "stack underflow" instead.
+func LoadBytecode(r io.Reader) (*Bytecode, error) {
+	d := &decoder{r: r}
+
+	var magic [4]byte
+	d.read(&magic)
+	if d.err == nil && magic != bytecodeMagic {
+		return nil, fmt.Errorf("invalid bytecode: bad magic %q", magic[:])
+	}
+
+	var version uint16
+	d.read(&version)
+	if d.err == nil && version != BytecodeFormatVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d, want %d",
+			version, BytecodeFormatVersion)
+	}
+
+	b := &Bytecode{}
+	b.Instructions = d.readInstructions()
+	b.Lines = d.readLines()
+
+	count := d.readLength()
+	for i := 0; i < count && d.err == nil; i++ {
+		b.Builtins = append(b.Builtins, string(d.readBytes()))
+	}
+
+	count = d.readLength()
+	for i := 0; i < count && d.err == nil; i++ {
+		b.Constants = append(b.Constants, d.readConstant())
+	}
+	if b.Constants == nil {
+		b.Constants = []object.Object{}
+	}
+
+	if d.err == nil {
+		if n, _ := r.Read(make([]byte, 1)); n > 0 {
+			d.err = errors.New("unexpected data after constant pool")
+		}
+	}
+
+	if d.err == nil {
+		d.err = b.validate()
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid bytecode: %w", d.err)
+	}
+
+	return b, nil
+}
+
+// decoder is the counterpart of encoder. Lengths read from the input are not
+// trusted for allocation, so corrupt lengths fail with an unexpected EOF
+// instead of exhausting memory.
+type decoder struct {
+	r   io.Reader
+	err error
+}
+
+func (d *decoder) read(v any) {
+	if d.err != nil {
+		return
+	}
+
+	d.err = binary.Read(d.r, binary.BigEndian, v)
+	if d.err == io.EOF {
+		d.err = io.ErrUnexpectedEOF
+	}
+}
+
+func (d *decoder) readLength() int {
+	var n uint32
+	d.read(&n)
+	if d.err != nil || uint64(n) > math.MaxInt {
+		return 0
+	}
+
+	return int(n)
+}
+
+func (d *decoder) readBytes() []byte {
+	n := d.readLength()
+	if d.err != nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	return buf.Bytes()
+}
+
+func (d *decoder) readInstructions() code.Instructions {
+	ins := code.Instructions(d.readBytes())
+	if d.err != nil {
+		return nil
+	}
+
+	it := code.NewInstructionIterator(ins)
+	for {
+		if _, _, _, ok := it.Next(); !ok {
+			break
+		}
+	}
+	if err := it.Err(); err != nil {
+		d.err = err
+		return nil
+	}
+
+	return ins
+}
+
+func (d *decoder) readLines() []int {
+	n := d.readLength()
+
+	var lines []int
+	for i := 0; i < n && d.err == nil; i++ {
+		var line uint32
+		d.read(&line)
+		lines = append(lines, int(line))
+	}
+
+	return lines
+}
+
+func (d *decoder) readConstant() object.Object {
+	var tag byte
+	d.read(&tag)
+	if d.err != nil {
+		return nil
+	}
+
+	return d.readConstantBody(tag)
+}
+
+// readConstantBody reads the value of a constant whose tag has been read.
+func (d *decoder) readConstantBody(tag byte) object.Object {
+	switch tag {
+	case tagInteger:
+		var v int64
+		d.read(&v)
+		return &object.Integer{Value: v}
+
+	case tagFloat:
+		var bits uint64
+		d.read(&bits)
+		return &object.Float{Value: math.Float64frombits(bits)}
+
+	case tagBigInt:
+		text := d.readBytes()
+		if d.err != nil {
+			return nil
+		}
+
+		v, ok := new(big.Int).SetString(string(text), 10)
+		if !ok {
+			d.err = fmt.Errorf("invalid big integer %q", text)
+			return nil
+		}
+		return &object.BigInt{Value: v}
+
+	case tagBoolean:
+		var v bool
+		d.read(&v)
+		if v {
+			return object.TRUE
+		}
+		return object.FALSE
+
+	case tagString:
+		return &object.String{Value: string(d.readBytes())}
+
+	case tagNull:
+		return object.NULL
+
+	case tagCompiledFunction:
+		fn := &object.CompiledFunction{}
+		fn.NumLocals = d.readLength()
+		fn.NumParameters = d.readLength()
+		fn.Instructions = d.readInstructions()
+		fn.Lines = d.readLines()
+		fn.Name = string(d.readBytes())
+		return fn
+
+	default:
+		d.err = fmt.Errorf("unknown constant tag %d", tag)
+		return nil
+	}
+}
+
+// maxLocals is the number of locals OpGetLocal and OpSetLocal can address.
+const maxLocals = math.MaxUint8 + 1
+
+// maxGlobals bounds the operands of OpGetGlobalWide and OpSetGlobalWide in
+// loaded bytecode, since the VM allocates globals up to the index it is
+// given. It is far more than a program has room for in practice.
+const maxGlobals = 1 << 24
+
+// validate checks the operands of b's instructions and of its functions'
+// against the constant pool, the builtins and the instructions themselves.
+func (b *Bytecode) validate() error {
+	if err := b.validateInstructions(b.Instructions, nil); err != nil {
+		return err
+	}
+
+	for i, constant := range b.Constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		if fn.NumLocals > maxLocals || fn.NumParameters > fn.NumLocals {
+			return fmt.Errorf("constant %d: function with %d parameters and %d locals",
+				i, fn.NumParameters, fn.NumLocals)
+		}
+
+		if err := b.validateInstructions(fn.Instructions, fn); err != nil {
+			return fmt.Errorf("constant %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validateInstructions checks ins, the body of fn or the main program if fn
+// is nil. The instructions themselves were decoded by readInstructions.
+func (b *Bytecode) validateInstructions(
+	ins code.Instructions,
+	fn *object.CompiledFunction,
+) error {
+	starts := make(map[int]bool)
+	it := code.NewInstructionIterator(ins)
+	for offset := 0; ; offset = it.Offset() {
+		if _, _, _, ok := it.Next(); !ok {
+			break
+		}
+		starts[offset] = true
+	}
+	// Jumping past the last instruction ends the function.
+	starts[len(ins)] = true
+
+	it = code.NewInstructionIterator(ins)
+	for offset := 0; ; offset = it.Offset() {
+		op, operands, _, ok := it.Next()
+		if !ok {
+			break
+		}
+
+		if err := b.validateOperands(op, operands, starts, fn); err != nil {
+			return fmt.Errorf("instruction at %d: %w", offset, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *Bytecode) validateOperands(
+	op code.Opcode,
+	operands []int,
+	starts map[int]bool,
+	fn *object.CompiledFunction,
+) error {
+	switch op {
+	case code.OpConstant, code.OpConstantWide:
+		if operands[0] >= len(b.Constants) {
+			return fmt.Errorf("constant %d out of range", operands[0])
+		}
+
+	case code.OpClosure:
+		if operands[0] >= len(b.Constants) {
+			return fmt.Errorf("constant %d out of range", operands[0])
+		}
+		if _, ok := b.Constants[operands[0]].(*object.CompiledFunction); !ok {
+			return fmt.Errorf("closure over constant %d, which is not a function",
+				operands[0])
+		}
+
+	case code.OpGetBuiltin:
+		if operands[0] >= len(object.Builtins)+len(b.Builtins) {
+			return fmt.Errorf("undefined builtin %d", operands[0])
+		}
+
+	case code.OpJump, code.OpJumpNotTruthy, code.OpJumpTruthy:
+		if !starts[operands[0]] {
+			return fmt.Errorf("jump to %d, not an instruction", operands[0])
+		}
+
+	case code.OpGetGlobalWide, code.OpSetGlobalWide:
+		if operands[0] >= maxGlobals {
+			return fmt.Errorf("global %d out of range", operands[0])
+		}
+
+	case code.OpGetLocal, code.OpSetLocal:
+		if fn == nil {
+			return fmt.Errorf("local %d outside a function", operands[0])
+		}
+		if operands[0] >= fn.NumLocals {
+			return fmt.Errorf("local %d of %d", operands[0], fn.NumLocals)
+		}
+	}
+
+	return nil
+}
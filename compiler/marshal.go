@@ -0,0 +1,155 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+// Serialized bytecode starts with bytecodeMagic followed by
+// BytecodeFormatVersion. Any change to the layout below must bump the
+// version so old files are rejected instead of misread.
+//
+// The format is written with encoding/binary rather than gob: the layout is
+// explicit and independent of Go struct definitions, so renaming a field in
+// object or compiler cannot silently change what's on disk, and every
+// constant costs only its tag and payload. All integers are big-endian, like
+// instruction operands.
+//
+//	magic    [4]byte "MNKB"
+//	version  uint16
+//	main     instructions, lines
+//	builtins uint32 count, then count names
+//	count    uint32, then count constants
+//
+// instructions are a uint32 length followed by the raw bytes, lines a
+// uint32 length followed by one uint32 per entry, and each name of a
+// registered builtin a uint32 length followed by the name. A constant is a one byte
+// tag followed by its value:
+//
+//	tagInteger          int64
+//	tagFloat            uint64 (IEEE 754 bits)
+//	tagBigInt           uint32 length, decimal text
+//	tagBoolean          uint8, 0 or 1
+//	tagString           uint32 length, bytes
+//	tagNull             nothing
+//	tagCompiledFunction uint32 locals, uint32 parameters, instructions, lines,
+//	                    uint32 length, name
+var bytecodeMagic = [4]byte{'M', 'N', 'K', 'B'}
+
+// BytecodeFormatVersion is the version of the serialized bytecode layout
+// written by Marshal.
+const BytecodeFormatVersion uint16 = 4
+
+const (
+	tagInteger byte = iota + 1
+	tagFloat
+	tagBigInt
+	tagBoolean
+	tagString
+	tagNull
+	tagCompiledFunction
+)
+
+// Marshal writes b to w in the binary format described above, so it can be
+// compiled once and loaded many times with LoadBytecode. Source maps and
+// global names are not written.
+func (b *Bytecode) Marshal(w io.Writer) error {
+	e := &encoder{w: w}
+
+	e.write(bytecodeMagic)
+	e.write(BytecodeFormatVersion)
+	e.writeBytes(b.Instructions)
+	e.writeLines(b.Lines)
+
+	e.writeLength(len(b.Builtins))
+	for _, name := range b.Builtins {
+		e.writeBytes([]byte(name))
+	}
+
+	e.writeLength(len(b.Constants))
+	for _, constant := range b.Constants {
+		e.writeConstant(constant)
+	}
+
+	return e.err
+}
+
+// encoder writes big-endian values to w, remembering the first error so
+// callers can check once at the end.
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) write(v any) {
+	if e.err != nil {
+		return
+	}
+
+	e.err = binary.Write(e.w, binary.BigEndian, v)
+}
+
+func (e *encoder) writeLength(n int) {
+	if e.err == nil && uint64(n) > math.MaxUint32 {
+		e.err = fmt.Errorf("length %d too large to serialize", n)
+	}
+
+	e.write(uint32(n))
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeLength(len(b))
+	e.write(b)
+}
+
+func (e *encoder) writeLines(lines []int) {
+	e.writeLength(len(lines))
+	for _, line := range lines {
+		e.write(uint32(line))
+	}
+}
+
+func (e *encoder) writeConstant(obj object.Object) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.write(tagInteger)
+		e.write(obj.Value)
+
+	case *object.Float:
+		e.write(tagFloat)
+		e.write(math.Float64bits(obj.Value))
+
+	case *object.BigInt:
+		e.write(tagBigInt)
+		e.writeBytes([]byte(obj.Value.String()))
+
+	case *object.Boolean:
+		e.write(tagBoolean)
+		e.write(obj.Value)
+
+	case *object.String:
+		e.write(tagString)
+		e.writeBytes([]byte(obj.Value))
+
+	case *object.Null:
+		e.write(tagNull)
+
+	case *object.CompiledFunction:
+		e.write(tagCompiledFunction)
+		e.writeLength(obj.NumLocals)
+		e.writeLength(obj.NumParameters)
+		e.writeBytes(obj.Instructions)
+		e.writeLines(obj.Lines)
+		e.writeBytes([]byte(obj.Name))
+
+	default:
+		if e.err == nil {
+			e.err = fmt.Errorf("cannot serialize constant of type %s",
+				obj.Type())
+		}
+	}
+}
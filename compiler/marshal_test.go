@@ -0,0 +1,386 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ZeroBl21/go-interpreter/code"
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+func TestMarshal(t *testing.T) {
+	bytecode := &Bytecode{
+		Instructions: code.Make(code.OpConstant, 0),
+		Lines:        []int{1, 1, 1},
+		Builtins:     []string{"dbl"},
+		Constants: []object.Object{
+			&object.Integer{Value: -2},
+			&object.Float{Value: 1.5},
+			object.TRUE,
+			&object.String{Value: "hi"},
+			object.NULL,
+			&object.CompiledFunction{
+				Instructions:  code.Make(code.OpReturn),
+				NumLocals:     2,
+				NumParameters: 1,
+				Name:          "f",
+			},
+		},
+	}
+
+	expected := concatBytes(
+		[]byte("MNKB"), []byte{0, 4}, // header
+		[]byte{0, 0, 0, 3}, []byte{byte(code.OpConstant), 0, 0}, // instructions
+		[]byte{0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1}, // lines
+		[]byte{0, 0, 0, 1, 0, 0, 0, 3, 'd', 'b', 'l'},          // builtins
+		[]byte{0, 0, 0, 6}, // constant count
+		[]byte{tagInteger, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe},
+		[]byte{tagFloat, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+		[]byte{tagBoolean, 1},
+		[]byte{tagString, 0, 0, 0, 2, 'h', 'i'},
+		[]byte{tagNull},
+		[]byte{tagCompiledFunction, 0, 0, 0, 2, 0, 0, 0, 1},
+		[]byte{0, 0, 0, 1, byte(code.OpReturn)}, // function instructions
+		[]byte{0, 0, 0, 0},                      // function lines
+		[]byte{0, 0, 0, 1, 'f'},                 // function name
+	)
+
+	var buf bytes.Buffer
+	if err := bytecode.Marshal(&buf); err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("wrong serialization.\nwant=%v\ngot =%v", expected, buf.Bytes())
+	}
+}
+
+func TestMarshalCompiledProgram(t *testing.T) {
+	compiler := New()
+	input := `let f = fn(a) { a * 9999999999 * 9999999999 }; f("x")`
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := compiler.Bytecode().Marshal(&buf); err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), []byte("MNKB\x00\x04")) {
+		t.Errorf("missing header. got=%q", buf.Bytes()[:6])
+	}
+}
+
+func TestMarshalUnsupportedConstant(t *testing.T) {
+	bytecode := &Bytecode{
+		Constants: []object.Object{&object.Array{}},
+	}
+
+	err := bytecode.Marshal(&bytes.Buffer{})
+	if err == nil {
+		t.Fatalf("expected an error, got none")
+	}
+
+	if err.Error() != "cannot serialize constant of type ARRAY" {
+		t.Errorf("wrong error. got=%q", err)
+	}
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	out := []byte{}
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+
+	return out
+}
+
+func TestLoadBytecode(t *testing.T) {
+	input := `
+	let f = fn(a, b) { let c = a + b; c * 2.5 };
+	f(1, 2);
+	"done"`
+
+	compiler := New()
+	compiler.RegisterBuiltin("double")
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	original := compiler.Bytecode()
+
+	var buf bytes.Buffer
+	if err := original.Marshal(&buf); err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	loaded, err := LoadBytecode(&buf)
+	if err != nil {
+		t.Fatalf("load error: %s", err)
+	}
+
+	if !bytes.Equal(loaded.Instructions, original.Instructions) {
+		t.Errorf("wrong instructions.\nwant=%s\ngot =%s",
+			original.Instructions, loaded.Instructions)
+	}
+
+	if fmt.Sprint(loaded.Lines) != fmt.Sprint(original.Lines) {
+		t.Errorf("wrong lines. want=%v, got=%v", original.Lines, loaded.Lines)
+	}
+
+	if fmt.Sprint(loaded.Builtins) != "[double]" {
+		t.Errorf("wrong builtins. want=[double], got=%v", loaded.Builtins)
+	}
+
+	err = testConstants(t, []any{
+		[]code.Instructions{
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpGetLocal, 1),
+			code.Make(code.OpAdd),
+			code.Make(code.OpSetLocal, 2),
+			code.Make(code.OpGetLocal, 2),
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpMul),
+			code.Make(code.OpReturnValue),
+		},
+		1,
+		2,
+		"done",
+	}, loaded.Constants[1:])
+	if err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+
+	fn := loaded.Constants[1].(*object.CompiledFunction)
+	if fn.NumLocals != 3 || fn.NumParameters != 2 || fn.Name != "f" {
+		t.Errorf("wrong function metadata. locals=%d, parameters=%d, name=%q",
+			fn.NumLocals, fn.NumParameters, fn.Name)
+	}
+
+	if f, ok := loaded.Constants[0].(*object.Float); !ok || f.Value != 2.5 {
+		t.Errorf("wrong float constant. got=%+v", loaded.Constants[0])
+	}
+}
+
+func TestLoadBytecodeBigInt(t *testing.T) {
+	value, _ := new(big.Int).SetString("-99999999999999999999", 10)
+	bytecode := &Bytecode{
+		Instructions: code.Instructions{},
+		Constants:    []object.Object{&object.BigInt{Value: value}},
+	}
+
+	var buf bytes.Buffer
+	if err := bytecode.Marshal(&buf); err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	loaded, err := LoadBytecode(&buf)
+	if err != nil {
+		t.Fatalf("load error: %s", err)
+	}
+
+	if !object.Equals(loaded.Constants[0], bytecode.Constants[0]) {
+		t.Errorf("wrong constant. want=%s, got=%s",
+			bytecode.Constants[0].Inspect(), loaded.Constants[0].Inspect())
+	}
+}
+
+func TestLoadBytecodeSingletons(t *testing.T) {
+	bytecode := &Bytecode{
+		Constants: []object.Object{object.TRUE, object.FALSE, object.NULL},
+	}
+
+	var buf bytes.Buffer
+	if err := bytecode.Marshal(&buf); err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	loaded, err := LoadBytecode(&buf)
+	if err != nil {
+		t.Fatalf("load error: %s", err)
+	}
+
+	for i, want := range bytecode.Constants {
+		if loaded.Constants[i] != want {
+			t.Errorf("constant %d is not the %s singleton. got=%p, want=%p",
+				i, want.Inspect(), loaded.Constants[i], want)
+		}
+	}
+}
+
+func TestLoadBytecodeErrors(t *testing.T) {
+	compiler := New()
+	if err := compiler.Compile(parse(`let f = fn(x) { x + "a" }; f("b")`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := compiler.Bytecode().Marshal(&buf); err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	valid := buf.Bytes()
+
+	// Every strict prefix is truncated input.
+	for i := 0; i < len(valid); i++ {
+		_, err := LoadBytecode(bytes.NewReader(valid[:i]))
+		if err == nil {
+			t.Fatalf("expected an error for input truncated to %d bytes", i)
+		}
+	}
+
+	tests := []struct {
+		input    []byte
+		expected string
+	}{
+		{
+			[]byte("NOPE\x00\x01"),
+			`invalid bytecode: bad magic "NOPE"`,
+		},
+		{
+			[]byte("MNKB\x00\x01"),
+			"unsupported bytecode version 1, want 4",
+		},
+		{
+			concatBytes([]byte("MNKB\x00\x04"), []byte{0, 0, 0, 1, 255}),
+			"invalid bytecode: instruction at 0: opcode 255 undefined",
+		},
+		{
+			concatBytes([]byte("MNKB\x00\x04"),
+				[]byte{0, 0, 0, 2, byte(code.OpConstant), 0}),
+			"invalid bytecode: instruction at 0: truncated OpConstant",
+		},
+		{
+			concatBytes([]byte("MNKB\x00\x04"),
+				[]byte{0, 0, 0, 0}, []byte{0, 0, 0, 0}, []byte{0, 0, 0, 0},
+				[]byte{0, 0, 0, 1, 99}),
+			"invalid bytecode: unknown constant tag 99",
+		},
+		{
+			concatBytes([]byte("MNKB\x00\x04"),
+				[]byte{0, 0, 0, 0}, []byte{0, 0, 0, 0}, []byte{0, 0, 0, 0},
+				[]byte{0, 0, 0, 0, 0}),
+			"invalid bytecode: unexpected data after constant pool",
+		},
+		{
+			concatBytes([]byte("MNKB\x00\x04"),
+				[]byte{0, 0, 0, 0}, []byte{0xff, 0xff, 0xff, 0xff}),
+			"invalid bytecode: unexpected EOF",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := LoadBytecode(bytes.NewReader(tt.input))
+		if err == nil {
+			t.Errorf("expected error %q, got none", tt.expected)
+			continue
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestLoadBytecodeInvalidOperands(t *testing.T) {
+	fn := func(numLocals, numParameters int, ins ...code.Instructions) *object.CompiledFunction {
+		return &object.CompiledFunction{
+			Instructions:  concatInstructions(ins),
+			NumLocals:     numLocals,
+			NumParameters: numParameters,
+		}
+	}
+
+	tests := []struct {
+		bytecode *Bytecode
+		expected string
+	}{
+		{
+			&Bytecode{Instructions: code.Make(code.OpConstant, 500)},
+			"instruction at 0: constant 500 out of range",
+		},
+		{
+			&Bytecode{Instructions: code.Make(code.OpConstantWide, 1<<20)},
+			"instruction at 0: constant 1048576 out of range",
+		},
+		{
+			&Bytecode{Instructions: code.Make(code.OpSetGlobalWide, 1<<30)},
+			"instruction at 0: global 1073741824 out of range",
+		},
+		{
+			&Bytecode{
+				Instructions: code.Make(code.OpClosure, 1, 0),
+				Constants:    []object.Object{fn(0, 0)},
+			},
+			"instruction at 0: constant 1 out of range",
+		},
+		{
+			&Bytecode{
+				Instructions: code.Make(code.OpClosure, 0, 0),
+				Constants:    []object.Object{&object.Integer{Value: 1}},
+			},
+			"instruction at 0: closure over constant 0, which is not a function",
+		},
+		{
+			&Bytecode{
+				Instructions: code.Make(code.OpGetBuiltin, len(object.Builtins)+1),
+				Builtins:     []string{"double"},
+			},
+			fmt.Sprintf("instruction at 0: undefined builtin %d",
+				len(object.Builtins)+1),
+		},
+		{
+			&Bytecode{Instructions: code.Make(code.OpJump, 1<<30)},
+			"instruction at 0: jump to 1073741824, not an instruction",
+		},
+		{
+			&Bytecode{Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 2),
+			})},
+			"instruction at 1: jump to 2, not an instruction",
+		},
+		{
+			&Bytecode{Instructions: code.Make(code.OpGetLocal, 0)},
+			"instruction at 0: local 0 outside a function",
+		},
+		{
+			&Bytecode{Constants: []object.Object{
+				fn(1, 1, code.Make(code.OpSetLocal, 1)),
+			}},
+			"constant 0: instruction at 0: local 1 of 1",
+		},
+		{
+			&Bytecode{Constants: []object.Object{
+				fn(1, 0, code.Make(code.OpJumpTruthy, 99)),
+			}},
+			"constant 0: instruction at 0: jump to 99, not an instruction",
+		},
+		{
+			&Bytecode{Constants: []object.Object{fn(1<<20, 0)}},
+			"constant 0: function with 0 parameters and 1048576 locals",
+		},
+		{
+			&Bytecode{Constants: []object.Object{fn(1, 2)}},
+			"constant 0: function with 2 parameters and 1 locals",
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := tt.bytecode.Marshal(&buf); err != nil {
+			t.Fatalf("marshal error: %s", err)
+		}
+
+		_, err := LoadBytecode(&buf)
+		if err == nil {
+			t.Errorf("expected error %q, got none", tt.expected)
+			continue
+		}
+
+		if expected := "invalid bytecode: " + tt.expected; err.Error() != expected {
+			t.Errorf("wrong error. want=%q, got=%q", expected, err)
+		}
+	}
+}
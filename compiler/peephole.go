@@ -0,0 +1,204 @@
+package compiler
+
+import (
+	"github.com/ZeroBl21/go-interpreter/code"
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+type decodedInstruction struct {
+	op       code.Opcode
+	operands []int
+	pos      int
+	width    int
+	line     int
+	span     code.Span
+	hasSpan  bool
+}
+
+// Peephole returns a copy of ins with redundant instructions removed:
+//
+//   - an OpJump whose target is the instruction right after it, and
+//   - a side-effect free push immediately discarded by an OpPop, as long as
+//     the OpPop is not a jump target and not the final instruction, whose
+//     value the REPL reads back as the last popped element.
+//
+// Every jump operand is re-patched to account for the removed bytes.
+func Peephole(ins code.Instructions) code.Instructions {
+	out, _, _ := peephole(ins, nil, nil)
+	return out
+}
+
+// Peephole runs the peephole pass over the main program and every compiled
+// function in the constant pool, keeping their line tables and source maps
+// in sync. The compiler already does so from OptimizeSafe on; this is for
+// bytecode compiled with OptimizeNone or built by other means.
+func (b *Bytecode) Peephole() {
+	b.Instructions, b.Lines, b.SourceMap =
+		peephole(b.Instructions, b.Lines, b.SourceMap)
+
+	for _, constant := range b.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			fn.Instructions, fn.Lines, fn.SourceMap =
+				peephole(fn.Instructions, fn.Lines, fn.SourceMap)
+		}
+	}
+}
+
+func peephole(
+	ins code.Instructions,
+	lines []int,
+	sourceMap *code.SourceMap,
+) (code.Instructions, []int, *code.SourceMap) {
+	decoded, ok := decodeInstructions(ins, lines, sourceMap)
+	if !ok {
+		return ins, lines, sourceMap
+	}
+
+	for {
+		removed := peepholeRemovals(decoded)
+		if len(removed) == 0 {
+			break
+		}
+
+		decoded = removeInstructions(decoded, removed)
+	}
+
+	out := code.Instructions{}
+	var outLines []int
+	var outSourceMap *code.SourceMap
+	if sourceMap != nil {
+		outSourceMap = &code.SourceMap{}
+	}
+
+	for _, d := range decoded {
+		if outSourceMap != nil && d.hasSpan {
+			outSourceMap.Add(len(out), d.span)
+		}
+
+		out = append(out, code.Make(d.op, d.operands...)...)
+
+		if lines != nil {
+			for i := 0; i < d.width; i++ {
+				outLines = append(outLines, d.line)
+			}
+		}
+	}
+
+	return out, outLines, outSourceMap
+}
+
+func decodeInstructions(
+	ins code.Instructions,
+	lines []int,
+	sourceMap *code.SourceMap,
+) ([]decodedInstruction, bool) {
+	decoded := []decodedInstruction{}
+
+	it := code.NewInstructionIterator(ins)
+	for {
+		i := it.Offset()
+		op, operands, width, ok := it.Next()
+		if !ok {
+			break
+		}
+
+		d := decodedInstruction{
+			op:       op,
+			operands: operands,
+			pos:      i,
+			width:    width,
+		}
+		if i < len(lines) {
+			d.line = lines[i]
+		}
+		d.span, d.hasSpan = sourceMap.SpanForOffset(i)
+		decoded = append(decoded, d)
+	}
+
+	return decoded, it.Err() == nil
+}
+
+func peepholeRemovals(decoded []decodedInstruction) map[int]bool {
+	targets := map[int]bool{}
+	for _, d := range decoded {
+		if isJump(d.op) {
+			targets[d.operands[0]] = true
+		}
+	}
+
+	removed := map[int]bool{}
+	for i, d := range decoded {
+		if d.op == code.OpJump && d.operands[0] == d.pos+d.width {
+			removed[i] = true
+			continue
+		}
+
+		if i+2 >= len(decoded) || removed[i] {
+			continue
+		}
+
+		next := decoded[i+1]
+		if isPurePush(d.op) && next.op == code.OpPop && !targets[next.pos] {
+			removed[i] = true
+			removed[i+1] = true
+		}
+	}
+
+	return removed
+}
+
+// removeInstructions drops the instructions at the removed indexes and
+// re-patches jumps. A jump to a removed instruction lands on the next kept
+// one.
+func removeInstructions(
+	decoded []decodedInstruction,
+	removed map[int]bool,
+) []decodedInstruction {
+	newPositions := make(map[int]int, len(decoded)+1)
+	kept := []decodedInstruction{}
+
+	pos := 0
+	for i, d := range decoded {
+		newPositions[d.pos] = pos
+		if removed[i] {
+			continue
+		}
+
+		kept = append(kept, d)
+		pos += d.width
+	}
+
+	if len(decoded) > 0 {
+		last := decoded[len(decoded)-1]
+		newPositions[last.pos+last.width] = pos
+	}
+
+	pos = 0
+	for i := range kept {
+		if isJump(kept[i].op) {
+			kept[i].operands = []int{newPositions[kept[i].operands[0]]}
+		}
+
+		kept[i].pos = pos
+		pos += kept[i].width
+	}
+
+	return kept
+}
+
+func isJump(op code.Opcode) bool {
+	return op == code.OpJump || op == code.OpJumpNotTruthy ||
+		op == code.OpJumpTruthy
+}
+
+func isPurePush(op code.Opcode) bool {
+	switch op {
+	case code.OpConstant, code.OpConstantWide, code.OpTrue, code.OpFalse,
+		code.OpNull, code.OpGetGlobal, code.OpGetGlobalWide, code.OpGetLocal,
+		code.OpGetFree,
+		code.OpGetBuiltin, code.OpCurrentClosure:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,153 @@
+package compiler
+
+import (
+	"testing"
+
+	"github.com/ZeroBl21/go-interpreter/code"
+)
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		input                string
+		expectedInstructions []code.Instructions
+	}{
+		{
+			input: "if (true) { 1; if (false) { 2; 3 } }; 4",
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 26),
+				// 0006
+				code.Make(code.OpFalse),
+				// 0007
+				code.Make(code.OpJumpNotTruthy, 20),
+				// 0012
+				code.Make(code.OpConstant, 2),
+				// 0015
+				code.Make(code.OpJump, 21),
+				// 0020
+				code.Make(code.OpNull),
+				// 0021
+				code.Make(code.OpJump, 27),
+				// 0026
+				code.Make(code.OpNull),
+				// 0027
+				code.Make(code.OpPop),
+				// 0028
+				code.Make(code.OpConstant, 3),
+				// 0031
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "let a = 1; a; 2; if (a) { 3 }; a",
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0014
+				code.Make(code.OpConstant, 2),
+				// 0017
+				code.Make(code.OpJump, 23),
+				// 0022
+				code.Make(code.OpNull),
+				// 0023
+				code.Make(code.OpPop),
+				// 0024
+				code.Make(code.OpGetGlobal, 0),
+				// 0027
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New(WithOptimizations(OptimizeNone))
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+		before := len(bytecode.Instructions)
+
+		bytecode.Peephole()
+
+		err := testInstructions(tt.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Fatalf("testInstructions failed: %s", err)
+		}
+
+		if after := len(bytecode.Instructions); after >= before {
+			t.Errorf("instructions did not shrink. before=%d, after=%d",
+				before, after)
+		}
+	}
+}
+
+func TestPeepholeJumpToNext(t *testing.T) {
+	ins := concatInstructions([]code.Instructions{
+		// 0000
+		code.Make(code.OpTrue),
+		// 0001
+		code.Make(code.OpJumpNotTruthy, 16),
+		// 0006
+		code.Make(code.OpJump, 11),
+		// 0011
+		code.Make(code.OpJump, 16),
+		// 0016
+		code.Make(code.OpNull),
+		// 0017
+		code.Make(code.OpPop),
+	})
+
+	expected := []code.Instructions{
+		// 0000
+		code.Make(code.OpTrue),
+		// 0001
+		code.Make(code.OpJumpNotTruthy, 6),
+		// 0006
+		code.Make(code.OpNull),
+		// 0007
+		code.Make(code.OpPop),
+	}
+
+	if err := testInstructions(expected, Peephole(ins)); err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+}
+
+func TestPeepholeKeepsSourceMap(t *testing.T) {
+	input := `1;
+2;
+3`
+
+	compiler := New()
+	compiler.EnableSourceMaps()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	bytecode.Peephole()
+
+	// Only `3; OpPop` is left.
+	if len(bytecode.Instructions) != 4 {
+		t.Fatalf("wrong instructions length. want=4, got=%d\n%s",
+			len(bytecode.Instructions), bytecode.Instructions)
+	}
+
+	expected := code.Span{Line: 3, StartCol: 1, EndCol: 2}
+	for offset := range bytecode.Instructions {
+		span, ok := bytecode.SpanForOffset(offset)
+		if !ok || span != expected {
+			t.Errorf("wrong span for offset %d. want=%s, got=%s",
+				offset, expected, span)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package compiler
 
+import "sort"
+
 type SymbolScope string
 
 const (
-	LocalScope   SymbolScope = "LOCAL"
-	GlobalScope  SymbolScope = "GLOBAL"
-	BuiltinScope SymbolScope = "BUILTIN"
-	FreeScope    SymbolScope = "FREE"
+	LocalScope    SymbolScope = "LOCAL"
+	GlobalScope   SymbolScope = "GLOBAL"
+	BuiltinScope  SymbolScope = "BUILTIN"
+	FreeScope     SymbolScope = "FREE"
+	FunctionScope SymbolScope = "FUNCTION"
 )
 
 type Symbol struct {
@@ -40,20 +43,66 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	return s
 }
 
+// Copy returns a table with the same symbols as s that can be defined into
+// without affecting s, to compile input speculatively. The copy shares s's
+// Outer table.
+func (s *SymbolTable) Copy() *SymbolTable {
+	store := make(map[string]Symbol, len(s.store))
+	for name, symbol := range s.store {
+		store[name] = symbol
+	}
+
+	return &SymbolTable{
+		Outer:          s.Outer,
+		store:          store,
+		numDefinitions: s.numDefinitions,
+		FreeSymbols:    append([]Symbol{}, s.FreeSymbols...),
+	}
+}
+
+// Define binds name to a new slot in this table, a global one in the
+// outermost table and a local one otherwise. Defining a name again in the
+// same table rebinds it: the existing slot is reused, so code compiled
+// earlier that refers to the name sees the new value from then on. A name
+// that only shadows a builtin, a free variable or the function's own name
+// gets a slot of its own.
 func (s *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Index: s.numDefinitions}
+	scope := LocalScope
+	if s.Outer == nil {
+		scope = GlobalScope
+	}
+
+	if existing, ok := s.store[name]; ok && existing.Scope == scope {
+		return existing
+	}
+
+	symbol := Symbol{Name: name, Scope: scope, Index: s.numDefinitions}
+	s.store[name] = symbol
+	s.numDefinitions++
+
+	return symbol
+}
+
+// DefineHidden reserves a slot like Define for a value the compiler keeps to
+// itself, like the counter of a for loop. The symbol has no name, so programs
+// can't refer to it and Symbols doesn't list it.
+func (s *SymbolTable) DefineHidden() Symbol {
+	symbol := Symbol{Index: s.numDefinitions}
 	if s.Outer == nil {
 		symbol.Scope = GlobalScope
 	} else {
 		symbol.Scope = LocalScope
 	}
 
-	s.store[name] = symbol
 	s.numDefinitions++
 
 	return symbol
 }
 
+// Resolve looks name up in this table and its enclosing ones. A local of an
+// enclosing function is captured: it is recorded in FreeSymbols and the
+// returned symbol has FreeScope, indexing into the closure's free variables.
+// Globals and builtins are returned as they are.
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
 	if !ok && s.Outer != nil {
@@ -74,6 +123,39 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	return obj, ok
 }
 
+// Symbols returns the symbols with the given scope defined in this table,
+// not its enclosing ones, ordered by index.
+func (s *SymbolTable) Symbols(scope SymbolScope) []Symbol {
+	symbols := []Symbol{}
+	for _, symbol := range s.store {
+		if symbol.Scope == scope {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].Index < symbols[j].Index
+	})
+
+	return symbols
+}
+
+// Definitions returns the global or local symbols defined in this table,
+// ordered by index. Symbols of enclosing tables are not included.
+func (s *SymbolTable) Definitions() []Symbol {
+	if s.Outer == nil {
+		return s.Symbols(GlobalScope)
+	}
+	return s.Symbols(LocalScope)
+}
+
+// NumDefinitions returns the number of slots defined in this table, which is
+// the number of globals or locals the code using it needs, hidden ones
+// included.
+func (s *SymbolTable) NumDefinitions() int {
+	return s.numDefinitions
+}
+
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
 	s.store[name] = symbol
@@ -81,8 +163,10 @@ func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	return symbol
 }
 
+// DefineFree records original as a free variable of this table and returns
+// the FreeScope symbol that refers to it.
 func (s *SymbolTable) DefineFree(original Symbol) Symbol {
-  s.FreeSymbols = append(s.FreeSymbols, original)
+	s.FreeSymbols = append(s.FreeSymbols, original)
 
 	symbol := Symbol{
 		Name:  original.Name,
@@ -93,3 +177,13 @@ func (s *SymbolTable) DefineFree(original Symbol) Symbol {
 
 	return symbol
 }
+
+// DefineFunctionName binds name to the function whose body this table
+// belongs to, so the function can refer to itself before the surrounding
+// let statement has finished.
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
+	s.store[name] = symbol
+
+	return symbol
+}
@@ -0,0 +1,107 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+// A serialized symbol table uses the encoding of marshal.go with its own
+// magic and version:
+//
+//	magic        [4]byte "MNKS"
+//	version      uint16
+//	definitions  uint32, the number of global slots, hidden ones included
+//	count        uint32, then count globals
+//
+// and each global is a uint32 index followed by a uint32 length and the
+// name. Builtins are not written: LoadSymbolTable defines object.Builtins
+// by name, so a table saved by an older build resolves them the way the
+// running one numbers them.
+var symbolTableMagic = [4]byte{'M', 'N', 'K', 'S'}
+
+// SymbolTableFormatVersion is the version of the serialized symbol table
+// layout written by SymbolTable.Marshal.
+const SymbolTableFormatVersion uint16 = 1
+
+// Marshal writes the globals of s to w, so a session saved along with its
+// bytecode resolves the same names once reloaded with LoadSymbolTable. Only
+// the outermost table of a program can be written; enclosed tables belong
+// to a function being compiled.
+func (s *SymbolTable) Marshal(w io.Writer) error {
+	if s.Outer != nil {
+		return errors.New("cannot serialize an enclosed symbol table")
+	}
+
+	e := &encoder{w: w}
+
+	e.write(symbolTableMagic)
+	e.write(SymbolTableFormatVersion)
+	e.writeLength(s.numDefinitions)
+
+	globals := s.Symbols(GlobalScope)
+	e.writeLength(len(globals))
+	for _, symbol := range globals {
+		e.writeLength(symbol.Index)
+		e.writeBytes([]byte(symbol.Name))
+	}
+
+	return e.err
+}
+
+// LoadSymbolTable reads a table written by SymbolTable.Marshal. The table
+// has object.Builtins defined as New does; builtins registered by an
+// embedder with Compiler.RegisterBuiltin have to be registered again.
+func LoadSymbolTable(r io.Reader) (*SymbolTable, error) {
+	d := &decoder{r: r}
+
+	var magic [4]byte
+	d.read(&magic)
+	if d.err == nil && magic != symbolTableMagic {
+		return nil, fmt.Errorf("invalid symbol table: bad magic %q", magic[:])
+	}
+
+	var version uint16
+	d.read(&version)
+	if d.err == nil && version != SymbolTableFormatVersion {
+		return nil, fmt.Errorf("unsupported symbol table version %d, want %d",
+			version, SymbolTableFormatVersion)
+	}
+
+	s := NewSymbolTable()
+	for i, v := range object.Builtins {
+		s.DefineBuiltin(i, v.Name)
+	}
+
+	s.numDefinitions = d.readLength()
+
+	count := d.readLength()
+	for i := 0; i < count && d.err == nil; i++ {
+		index := d.readLength()
+		name := string(d.readBytes())
+		if d.err != nil {
+			break
+		}
+
+		if index >= s.numDefinitions {
+			d.err = fmt.Errorf("global %s has index %d of %d",
+				name, index, s.numDefinitions)
+			break
+		}
+		s.store[name] = Symbol{Name: name, Scope: GlobalScope, Index: index}
+	}
+
+	if d.err == nil {
+		if n, _ := r.Read(make([]byte, 1)); n > 0 {
+			d.err = errors.New("unexpected data after globals")
+		}
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid symbol table: %w", d.err)
+	}
+
+	return s, nil
+}
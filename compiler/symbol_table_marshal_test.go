@@ -0,0 +1,138 @@
+package compiler
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+func TestMarshalSymbolTable(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("a")
+	global.DefineHidden()
+	global.Define("bc")
+
+	expected := concatBytes(
+		[]byte("MNKS"), []byte{0, 1}, // header
+		[]byte{0, 0, 0, 3},                       // definitions
+		[]byte{0, 0, 0, 2},                       // global count
+		[]byte{0, 0, 0, 0, 0, 0, 0, 1, 'a'},      // a
+		[]byte{0, 0, 0, 2, 0, 0, 0, 2, 'b', 'c'}, // bc
+	)
+
+	var buf bytes.Buffer
+	if err := global.Marshal(&buf); err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("wrong serialization.\nwant=%v\ngot =%v", expected, buf.Bytes())
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	if err := local.Marshal(&bytes.Buffer{}); err == nil {
+		t.Errorf("expected an error marshaling an enclosed table")
+	}
+}
+
+func TestLoadSymbolTable(t *testing.T) {
+	compiler := New()
+	input := `let a = 1; let b = fn(x) { x + a }; for (x in [1]) {}; let c = b(2);`
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	original := compiler.symbolTable
+
+	var buf bytes.Buffer
+	if err := original.Marshal(&buf); err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	loaded, err := LoadSymbolTable(&buf)
+	if err != nil {
+		t.Fatalf("load error: %s", err)
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		want, _ := original.Resolve(name)
+		got, ok := loaded.Resolve(name)
+		if !ok || got != want {
+			t.Errorf("wrong symbol for %s. want=%+v, got=%+v", name, want, got)
+		}
+	}
+
+	for i, builtin := range object.Builtins {
+		expected := Symbol{Name: builtin.Name, Scope: BuiltinScope, Index: i}
+		if got, _ := loaded.Resolve(builtin.Name); got != expected {
+			t.Errorf("builtin not re-linked. want=%+v, got=%+v", expected, got)
+		}
+	}
+
+	if loaded.NumDefinitions() != original.NumDefinitions() {
+		t.Errorf("wrong number of definitions. want=%d, got=%d",
+			original.NumDefinitions(), loaded.NumDefinitions())
+	}
+
+	// Names defined after loading don't reuse a slot, hidden ones included.
+	if d := loaded.Define("d"); d.Index != original.NumDefinitions() {
+		t.Errorf("expected d to get index %d, got=%+v",
+			original.NumDefinitions(), d)
+	}
+}
+
+func TestLoadSymbolTableErrors(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	var buf bytes.Buffer
+	if err := global.Marshal(&buf); err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	valid := buf.Bytes()
+
+	// Every strict prefix is truncated input.
+	for i := 0; i < len(valid); i++ {
+		_, err := LoadSymbolTable(bytes.NewReader(valid[:i]))
+		if err == nil {
+			t.Fatalf("expected an error for input truncated to %d bytes", i)
+		}
+	}
+
+	tests := []struct {
+		input    []byte
+		expected string
+	}{
+		{
+			[]byte("MNKB\x00\x01"),
+			`invalid symbol table: bad magic "MNKB"`,
+		},
+		{
+			[]byte("MNKS\x00\x02"),
+			"unsupported symbol table version 2, want 1",
+		},
+		{
+			concatBytes([]byte("MNKS\x00\x01"),
+				[]byte{0, 0, 0, 1}, []byte{0, 0, 0, 1},
+				[]byte{0, 0, 0, 1, 0, 0, 0, 1, 'a'}),
+			"invalid symbol table: global a has index 1 of 1",
+		},
+		{
+			concatBytes(valid, []byte{0}),
+			"invalid symbol table: unexpected data after globals",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := LoadSymbolTable(bytes.NewReader(tt.input))
+		if err == nil {
+			t.Errorf("expected error %q, got none", tt.expected)
+			continue
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
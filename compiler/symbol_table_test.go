@@ -1,6 +1,7 @@
 package compiler
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -255,6 +256,44 @@ func TestResolveFree(t *testing.T) {
 	}
 }
 
+func TestResolveFreeOnce(t *testing.T) {
+	global := NewSymbolTable()
+
+	firstLocal := NewEnclosedSymbolTable(global)
+	firstLocal.Define("a")
+
+	secondLocal := NewEnclosedSymbolTable(firstLocal)
+	thirdLocal := NewEnclosedSymbolTable(secondLocal)
+
+	for i := 0; i < 2; i++ {
+		result, ok := thirdLocal.Resolve("a")
+		if !ok {
+			t.Fatalf("name a not resolvable")
+		}
+
+		expected := Symbol{Name: "a", Scope: FreeScope, Index: 0}
+		if result != expected {
+			t.Errorf("expected a to resolve to %+v, got=%+v", expected, result)
+		}
+	}
+
+	if len(thirdLocal.FreeSymbols) != 1 {
+		t.Errorf("wrong number of free symbols. got=%d, want=1",
+			len(thirdLocal.FreeSymbols))
+	}
+
+	// The intermediate function captures a as well, so it can hand it down.
+	expected := Symbol{Name: "a", Scope: FreeScope, Index: 0}
+	if len(secondLocal.FreeSymbols) != 1 || secondLocal.store["a"] != expected {
+		t.Errorf("intermediate table did not capture a. got=%+v",
+			secondLocal.FreeSymbols)
+	}
+	if thirdLocal.FreeSymbols[0] != expected {
+		t.Errorf("wrong free symbol. got=%+v, want=%+v",
+			thirdLocal.FreeSymbols[0], expected)
+	}
+}
+
 func TestResolveUnresolvableFree(t *testing.T) {
 	global := NewSymbolTable()
 	global.Define("a")
@@ -297,3 +336,199 @@ func TestResolveUnresolvableFree(t *testing.T) {
 		}
 	}
 }
+
+func TestDefineAndResolveFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineFunctionName("a")
+
+	expected := Symbol{Name: "a", Scope: FunctionScope, Index: 0}
+
+	result, ok := global.Resolve(expected.Name)
+	if !ok {
+		t.Fatalf("function name %s not resolvable", expected.Name)
+	}
+
+	if result != expected {
+		t.Errorf("expected %s to resolve to %+v, got=%+v",
+			expected.Name, expected, result)
+	}
+}
+
+func TestShadowingFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineFunctionName("a")
+	global.Define("a")
+
+	expected := Symbol{Name: "a", Scope: GlobalScope, Index: 0}
+
+	result, ok := global.Resolve(expected.Name)
+	if !ok {
+		t.Fatalf("function name %s not resolvable", expected.Name)
+	}
+
+	if result != expected {
+		t.Errorf("expected %s to resolve to %+v, got=%+v",
+			expected.Name, expected, result)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	copied := global.Copy()
+
+	if b := copied.Define("b"); b.Index != 1 {
+		t.Errorf("expected b to get index 1 in the copy, got=%+v", b)
+	}
+
+	if _, ok := global.Resolve("b"); ok {
+		t.Errorf("defining in the copy changed the original")
+	}
+
+	if c := global.Define("c"); c.Index != 1 {
+		t.Errorf("expected c to get index 1 in the original, got=%+v", c)
+	}
+
+	if a, ok := copied.Resolve("a"); !ok || a.Index != 0 {
+		t.Errorf("copy lost a: got=%+v, %t", a, ok)
+	}
+}
+
+func TestDefineHidden(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	hidden := global.DefineHidden()
+	b := global.Define("b")
+
+	expected := Symbol{Scope: GlobalScope, Index: 1}
+	if hidden != expected {
+		t.Errorf("expected hidden=%+v, got=%+v", expected, hidden)
+	}
+	if b.Index != 2 {
+		t.Errorf("expected b to get index 2, got=%+v", b)
+	}
+
+	if symbols := global.Symbols(GlobalScope); len(symbols) != 2 {
+		t.Errorf("hidden symbol listed: %+v", symbols)
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	if hidden := local.DefineHidden(); hidden.Scope != LocalScope {
+		t.Errorf("expected a local hidden symbol, got=%+v", hidden)
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(1, "b")
+	global.Define("x")
+	global.DefineBuiltin(0, "a")
+	global.Define("y")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("z")
+
+	tests := []struct {
+		table    *SymbolTable
+		scope    SymbolScope
+		expected []Symbol
+	}{
+		{global, GlobalScope, []Symbol{
+			{Name: "x", Scope: GlobalScope, Index: 0},
+			{Name: "y", Scope: GlobalScope, Index: 1},
+		}},
+		{global, BuiltinScope, []Symbol{
+			{Name: "a", Scope: BuiltinScope, Index: 0},
+			{Name: "b", Scope: BuiltinScope, Index: 1},
+		}},
+		{local, GlobalScope, []Symbol{}},
+		{local, LocalScope, []Symbol{
+			{Name: "z", Scope: LocalScope, Index: 0},
+		}},
+	}
+
+	for _, tt := range tests {
+		symbols := tt.table.Symbols(tt.scope)
+		if len(symbols) != len(tt.expected) {
+			t.Errorf("wrong number of %s symbols. want=%d, got=%d",
+				tt.scope, len(tt.expected), len(symbols))
+			continue
+		}
+
+		for i, symbol := range symbols {
+			if symbol != tt.expected[i] {
+				t.Errorf("expected %+v, got=%+v", tt.expected[i], symbol)
+			}
+		}
+	}
+}
+
+func TestDefinitions(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("a")
+	global.DefineHidden()
+	global.Define("b")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("c")
+	local.Resolve("a")
+
+	tests := []struct {
+		table               *SymbolTable
+		expected            []Symbol
+		expectedDefinitions int
+	}{
+		{global, []Symbol{
+			{Name: "a", Scope: GlobalScope, Index: 0},
+			{Name: "b", Scope: GlobalScope, Index: 2},
+		}, 3},
+		{local, []Symbol{
+			{Name: "c", Scope: LocalScope, Index: 0},
+		}, 1},
+	}
+
+	for _, tt := range tests {
+		if got := tt.table.Definitions(); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("wrong definitions. want=%+v, got=%+v", tt.expected, got)
+		}
+
+		if got := tt.table.NumDefinitions(); got != tt.expectedDefinitions {
+			t.Errorf("wrong number of definitions. want=%d, got=%d",
+				tt.expectedDefinitions, got)
+		}
+	}
+}
+
+func TestRedefine(t *testing.T) {
+	global := NewSymbolTable()
+	a := global.Define("a")
+	global.Define("b")
+
+	if again := global.Define("a"); again != a {
+		t.Errorf("redefining a in the same scope. want=%+v, got=%+v", a, again)
+	}
+	if n := global.NumDefinitions(); n != 2 {
+		t.Errorf("redefinition took a new slot: %d definitions", n)
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	shadow := local.Define("a")
+	expected := Symbol{Name: "a", Scope: LocalScope, Index: 0}
+	if shadow != expected {
+		t.Errorf("expected a local shadowing the global=%+v, got=%+v",
+			expected, shadow)
+	}
+
+	if resolved, _ := global.Resolve("a"); resolved != a {
+		t.Errorf("shadowing changed the global. want=%+v, got=%+v", a, resolved)
+	}
+
+	global.DefineBuiltin(0, "len")
+	expected = Symbol{Name: "len", Scope: GlobalScope, Index: 2}
+	if shadow := global.Define("len"); shadow != expected {
+		t.Errorf("expected a global shadowing the builtin=%+v, got=%+v",
+			expected, shadow)
+	}
+}
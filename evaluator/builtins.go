@@ -4,11 +4,10 @@ import (
 	"github.com/ZeroBl21/go-interpreter/object"
 )
 
-var builtins = map[string]*object.Builtin{
-	"len":   object.GetBuiltinByName("len"),
-	"print": object.GetBuiltinByName("print"),
-	"first": object.GetBuiltinByName("first"),
-	"last": object.GetBuiltinByName("last"),
-	"rest": object.GetBuiltinByName("rest"),
-	"push": object.GetBuiltinByName("push"),
+var builtins = map[string]*object.Builtin{}
+
+func init() {
+	for _, def := range object.Builtins {
+		builtins[def.Name] = def.Builtin
+	}
 }
@@ -8,9 +8,9 @@ import (
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL  = object.NULL
+	TRUE  = object.TRUE
+	FALSE = object.FALSE
 )
 
 func Eval(node ast.Node, env *object.Environment) object.Object {
@@ -92,6 +92,10 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return &object.Function{Parameters: params, Body: body, Env: env}
 
 	case *ast.CallExpression:
+		if node.Function.TokenLiteral() == "quote" && len(node.Arguments) == 1 {
+			return quote(node.Arguments[0], env)
+		}
+
 		function := Eval(node.Function, env)
 		if isError(function) {
 			return function
@@ -350,9 +354,8 @@ func evalHashLiteral(
 	node *ast.HashLiteral,
 	env *object.Environment,
 ) object.Object {
-	pairs := make(map[object.HashKey]object.HashPair)
-
-	for keyNode, valueNode := range node.Pairs {
+	hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+	for _, keyNode := range node.OrderedKeys() {
 		key := Eval(keyNode, env)
 		if isError(key) {
 			return key
@@ -363,16 +366,15 @@ func evalHashLiteral(
 			return newError("unusable as hash key: %s", key.Type())
 		}
 
-		value := Eval(valueNode, env)
+		value := Eval(node.Pairs[keyNode], env)
 		if isError(value) {
 			return value
 		}
 
-		hashed := hashKey.HashKey()
-		pairs[hashed] = object.HashPair{Key: key, Value: value}
+		hash.Set(hashKey.HashKey(), object.HashPair{Key: key, Value: value})
 	}
 
-	return &object.Hash{Pairs: pairs}
+	return hash
 }
 
 func isTruthy(obj object.Object) bool {
@@ -418,7 +420,13 @@ func applyFunction(fn object.Object, args []object.Object) object.Object {
 		return unWrapReturnValue(evaluated)
 
 	case *object.Builtin:
-		if result := fn.Fn(args...); result != nil {
+		var result object.Object
+		if fn.CallbackFn != nil {
+			result = fn.CallbackFn(callFunction, args...)
+		} else {
+			result = fn.Fn(args...)
+		}
+		if result != nil {
 			return result
 		}
 		return NULL
@@ -428,6 +436,16 @@ func applyFunction(fn object.Object, args []object.Object) object.Object {
 	}
 }
 
+// callFunction is the object.Caller handed to builtins like `map`.
+func callFunction(fn object.Object, args ...object.Object) (object.Object, error) {
+	result := applyFunction(fn, args)
+	if errObj, ok := result.(*object.Error); ok {
+		return nil, errObj
+	}
+
+	return result, nil
+}
+
 func extendFunctionEnv(
 	fn *object.Function,
 	args []object.Object,
@@ -3,9 +3,11 @@ package evaluator
 import (
 	"testing"
 
+	"github.com/ZeroBl21/go-interpreter/compiler"
 	"github.com/ZeroBl21/go-interpreter/lexer"
 	"github.com/ZeroBl21/go-interpreter/object"
 	"github.com/ZeroBl21/go-interpreter/parser"
+	"github.com/ZeroBl21/go-interpreter/vm"
 )
 
 func TestEvalIntegerExpression(t *testing.T) {
@@ -392,6 +394,12 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("hello world")`, 11},
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
+		{`reduce([1, 2, 3], fn(acc, x) { acc + x }, 0)`, 6},
+		{`len(map([1, 2, 3], fn(x) { x * 2 }))`, 3},
+		{`len(filter([1, 2, 3], fn(x) { x > 1 }))`, 2},
+		{`map([1], fn(x) { x + true })`, "type mismatch: INTEGER + BOOLEAN"},
+		{`map([1], len)`, "argument to `len` not supported, got INTEGER"},
+		{`filter(["a", 1], len)`, "argument to `len` not supported, got INTEGER"},
 	}
 
 	for _, tt := range tests {
@@ -503,6 +511,57 @@ func TestHashIndexExpressions(t *testing.T) {
 	}
 }
 
+// TestAgreesWithVM runs a corpus of programs through both the evaluator and
+// the compiler and VM, which must produce the same result.
+func TestAgreesWithVM(t *testing.T) {
+	corpus := []string{
+		`5 + 10 * 2 - 3 / 3`,
+		`-(7 - 3) * 2`,
+		`1 < 2 == true`,
+		`!(1 != 1)`,
+		`!!5`,
+		`"mon" + "key"`,
+		`let a = 5; let b = a * 2; a + b`,
+		`if (1 > 2) { 10 } else { 20 }`,
+		`if (false) { 10 }`,
+		`if (1) { 10 }`,
+		`let f = fn(x) { if (x > 5) { return x; } 0 }; f(10) + f(1)`,
+		`let f = fn() { return 1; 2 }; f()`,
+		`let add = fn(a, b) { a + b }; add(add(1, 2), 3)`,
+		`let adder = fn(x) { fn(y) { x + y } }; adder(2)(3)`,
+		`let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(15)`,
+		`[1, 2 * 2, "three"]`,
+		`[1, 2, 3][1]`,
+		`[1, 2, 3][5]`,
+		`{"one": 1}["one"]`,
+		`{"one": 1}["two"]`,
+		`len("hello") + len([1, 2])`,
+		`rest(push([1, 2], 3))`,
+		`first([])`,
+	}
+
+	for _, input := range corpus {
+		program := parser.New(lexer.New(input)).ParseProgram()
+
+		evaluated := Eval(program, object.NewEnvironment())
+
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error for %q: %s", input, err)
+		}
+		machine := vm.New(comp.Bytecode())
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error for %q: %s", input, err)
+		}
+		ran := machine.LastPoppedStackElem()
+
+		if evaluated.Inspect() != ran.Inspect() {
+			t.Errorf("results differ for %q. evaluator=%s, vm=%s",
+				input, evaluated.Inspect(), ran.Inspect())
+		}
+	}
+}
+
 func testEval(input string) object.Object {
 	l := lexer.New(input)
 	p := parser.New(l)
@@ -1,6 +1,8 @@
 package lexer
 
 import (
+	"strings"
+
 	"github.com/ZeroBl21/go-interpreter/token"
 )
 
@@ -10,17 +12,29 @@ type Lexer struct {
 	position     int    // current position in input (points to current char)
 	readPosition int    // current reading position in input (after current char)
 	ch           byte   // current char under examination
+	line         int    // current line in input (line of current char)
+	column       int    // current column in input (column of current char)
+
+	// templates holds, for every `${` interpolation being lexed, innermost
+	// last, how many braces are open inside it, so the `}` closing it can be
+	// told apart from one closing a block or hash.
+	templates []int
 }
 
 // New creates a new Lexer instance with the given input text.
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
 
 // readChar reads the next character from the input and updates the lexer's position.
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+
 	if l.readPosition >= len(l.input) {
 		l.ch = 0 // Reached end of input, set current char to 0 (NULL)
 	} else {
@@ -29,6 +43,7 @@ func (l *Lexer) readChar() {
 
 	l.position = l.readPosition
 	l.readPosition += 1
+	l.column++
 }
 
 // peekChar returns the next character in the input without advancing the reading position.
@@ -45,6 +60,7 @@ func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 
 	l.skipWhitespace()
+	line, column := l.line, l.column
 
 	switch l.ch {
 	case ';':
@@ -63,9 +79,16 @@ func (l *Lexer) NextToken() token.Token {
 	case '-':
 		tok = newToken(token.MINUS, l.ch)
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		if l.peekChar() == '*' {
+			l.readChar()
+			tok = token.Token{Type: token.POWER, Literal: "**"}
+		} else {
+			tok = newToken(token.ASTERISK, l.ch)
+		}
 	case '/':
 		tok = newToken(token.SLASH, l.ch)
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
 	case '!':
 		if l.peekChar() == '=' {
 			ch := l.ch
@@ -75,6 +98,24 @@ func (l *Lexer) NextToken() token.Token {
 		} else {
 			tok = newToken(token.BANG, l.ch)
 		}
+	case '&':
+		if l.peekChar() == '&' {
+			l.readChar()
+			tok = token.Token{Type: token.AND, Literal: "&&"}
+		} else {
+			tok = newToken(token.BIT_AND, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '|' {
+			l.readChar()
+			tok = token.Token{Type: token.OR, Literal: "||"}
+		} else {
+			tok = newToken(token.BIT_OR, l.ch)
+		}
+	case '^':
+		tok = newToken(token.BIT_XOR, l.ch)
+	case '~':
+		tok = newToken(token.BIT_NOT, l.ch)
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case ':':
@@ -84,20 +125,42 @@ func (l *Lexer) NextToken() token.Token {
 	case ')':
 		tok = newToken(token.RPAREN, l.ch)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekChar() == '<' {
+			l.readChar()
+			tok = token.Token{Type: token.SHIFT_LEFT, Literal: "<<"}
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekChar() == '>' {
+			l.readChar()
+			tok = token.Token{Type: token.SHIFT_RIGHT, Literal: ">>"}
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
 	case '{':
+		if n := len(l.templates); n > 0 {
+			l.templates[n-1]++
+		}
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
-		tok = newToken(token.RBRACE, l.ch)
+		n := len(l.templates)
+		switch {
+		case n > 0 && l.templates[n-1] == 0:
+			l.templates = l.templates[:n-1]
+			tok = l.readTemplatePart(token.TEMPLATE_MIDDLE, token.TEMPLATE_TAIL)
+		case n > 0:
+			l.templates[n-1]--
+			tok = newToken(token.RBRACE, l.ch)
+		default:
+			tok = newToken(token.RBRACE, l.ch)
+		}
 	case '[':
 		tok = newToken(token.LBRACKET, l.ch)
 	case ']':
 		tok = newToken(token.RBRACKET, l.ch)
 	case '"':
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok = l.readTemplatePart(token.TEMPLATE_HEAD, token.STRING)
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -105,12 +168,13 @@ func (l *Lexer) NextToken() token.Token {
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Line, tok.Column = line, column
 			return tok
 		}
 
 		if isDigit(l.ch) {
-			tok.Literal = l.readNumber()
-			tok.Type = token.INT
+			tok.Literal, tok.Type = l.readNumber()
+			tok.Line, tok.Column = line, column
 			return tok
 		}
 
@@ -118,10 +182,25 @@ func (l *Lexer) NextToken() token.Token {
 	}
 
 	l.readChar()
+	tok.Line, tok.Column = line, column
 
 	return tok
 }
 
+// Tokens reads the rest of the input and returns its tokens, ending with the
+// EOF token.
+func (l *Lexer) Tokens() []token.Token {
+	var tokens []token.Token
+
+	for {
+		tok := l.NextToken()
+		tokens = append(tokens, tok)
+		if tok.Type == token.EOF {
+			return tokens
+		}
+	}
+}
+
 func newToken(tokenType token.TokenType, ch byte) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
@@ -136,27 +215,57 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[position:l.position]
 }
 
-// readNumber reads a number from the input and returns it as a string.
-func (l *Lexer) readNumber() string {
+// readNumber reads a number from the input and returns it as a string along
+// with its token type. A single '.' followed by a digit makes it a FLOAT.
+func (l *Lexer) readNumber() (string, token.TokenType) {
 	position := l.position
+	tokenType := token.TokenType(token.INT)
+
 	for isDigit(l.ch) {
 		l.readChar()
 	}
 
-	return l.input[position:l.position]
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
+		l.readChar()
+
+		for isDigit(l.ch) {
+			l.readChar()
+		}
+	}
+
+	return l.input[position:l.position], tokenType
 }
 
-// readString reads a following string from the input and returns it.
-func (l *Lexer) readString() string {
-	position := l.position + 1
+// readTemplatePart reads the characters of a string literal following l.ch,
+// which is its opening quote or the `}` ending an interpolation. A part
+// ending in `${` starts an interpolation and gets type interpolated, one
+// ending in the closing quote or at the end of input gets type closed.
+// `\$` stands for a literal `$`, so `\${` doesn't start an interpolation;
+// other backslashes are kept as written.
+func (l *Lexer) readTemplatePart(interpolated, closed token.TokenType) token.Token {
+	var out strings.Builder
+
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+
+		switch {
+		case l.ch == '"' || l.ch == 0:
+			return token.Token{Type: closed, Literal: out.String()}
+
+		case l.ch == '\\' && l.peekChar() == '$':
+			l.readChar()
+			out.WriteByte('$')
+
+		case l.ch == '$' && l.peekChar() == '{':
+			l.readChar()
+			l.templates = append(l.templates, 0)
+			return token.Token{Type: interpolated, Literal: out.String()}
+
+		default:
+			out.WriteByte(l.ch)
 		}
 	}
-
-	return l.input[position:l.position]
 }
 
 // Skips whitespaces, tabs, and new lines for reading tokens
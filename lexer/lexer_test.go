@@ -16,7 +16,7 @@ func TestNextToken(t *testing.T) {
   };
 
   let result = add(five, ten);
-  !-/*5;
+  !-/*%5;
   5 < 10 > 5;
 
   if (5 < 10) {
@@ -32,6 +32,10 @@ func TestNextToken(t *testing.T) {
   "foo bar"
   [1, 2];
   {"foo": "bar"}
+  3.14 1.
+  a && b || c
+  a & b | c ^ ~d << 1 >> 2
+  2 ** 3 * 4
   `
 
 	tests := []struct {
@@ -79,6 +83,7 @@ func TestNextToken(t *testing.T) {
 		{token.MINUS, "-"},
 		{token.SLASH, "/"},
 		{token.ASTERISK, "*"},
+		{token.PERCENT, "%"},
 		{token.INT, "5"},
 		{token.SEMICOLON, ";"},
 		{token.INT, "5"},
@@ -131,7 +136,172 @@ func TestNextToken(t *testing.T) {
 		{token.COLON, ":"},
 		{token.STRING, "bar"},
 		{token.RBRACE, "}"},
+		{token.FLOAT, "3.14"},
+		{token.INT, "1"},
+		{token.ILLEGAL, "."},
+		{token.IDENT, "a"},
+		{token.AND, "&&"},
+		{token.IDENT, "b"},
+		{token.OR, "||"},
+		{token.IDENT, "c"},
+		{token.IDENT, "a"},
+		{token.BIT_AND, "&"},
+		{token.IDENT, "b"},
+		{token.BIT_OR, "|"},
+		{token.IDENT, "c"},
+		{token.BIT_XOR, "^"},
+		{token.BIT_NOT, "~"},
+		{token.IDENT, "d"},
+		{token.SHIFT_LEFT, "<<"},
+		{token.INT, "1"},
+		{token.SHIFT_RIGHT, ">>"},
+		{token.INT, "2"},
+		{token.INT, "2"},
+		{token.POWER, "**"},
+		{token.INT, "3"},
+		{token.ASTERISK, "*"},
+		{token.INT, "4"},
+
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestTokenLines(t *testing.T) {
+	input := `let a = 1;
+let b = "two
+lines";
+
+  b`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+	}{
+		{"let", 1},
+		{"a", 1},
+		{"=", 1},
+		{"1", 1},
+		{";", 1},
+		{"let", 2},
+		{"b", 2},
+		{"=", 2},
+		{"two\nlines", 2},
+		{";", 3},
+		{"b", 5},
+		{"", 5},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
 
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Line != tt.expectedLine {
+			t.Fatalf("tests[%d] - line wrong. expected=%d, got=%d",
+				i, tt.expectedLine, tok.Line)
+		}
+	}
+}
+
+func TestTokenColumns(t *testing.T) {
+	input := `let a = "b";
+  a == 10`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{"let", 1, 1},
+		{"a", 1, 5},
+		{"=", 1, 7},
+		{"b", 1, 9},
+		{";", 1, 12},
+		{"a", 2, 3},
+		{"==", 2, 5},
+		{"10", 2, 8},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - position wrong. expected=%d:%d, got=%d:%d",
+				i, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tokens := New(`let x = 5 @`).Tokens()
+
+	expected := []token.TokenType{
+		token.LET, token.IDENT, token.ASSIGN, token.INT, token.ILLEGAL, token.EOF,
+	}
+
+	if len(tokens) != len(expected) {
+		t.Fatalf("wrong number of tokens. want=%d, got=%d (%+v)",
+			len(expected), len(tokens), tokens)
+	}
+
+	for i, tt := range expected {
+		if tokens[i].Type != tt {
+			t.Errorf("tokens[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt, tokens[i].Type)
+		}
+	}
+}
+
+func TestTemplateStrings(t *testing.T) {
+	input := `"a ${x} b ${ {"k": "v ${y}"}["k"] } c" "\${x} $x"`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.TEMPLATE_HEAD, "a "},
+		{token.IDENT, "x"},
+		{token.TEMPLATE_MIDDLE, " b "},
+		{token.LBRACE, "{"},
+		{token.STRING, "k"},
+		{token.COLON, ":"},
+		{token.TEMPLATE_HEAD, "v "},
+		{token.IDENT, "y"},
+		{token.TEMPLATE_TAIL, ""},
+		{token.RBRACE, "}"},
+		{token.LBRACKET, "["},
+		{token.STRING, "k"},
+		{token.RBRACKET, "]"},
+		{token.TEMPLATE_TAIL, " c"},
+		{token.STRING, "${x} $x"},
 		{token.EOF, ""},
 	}
 
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/user"
+	"path/filepath"
 
 	"github.com/ZeroBl21/go-interpreter/repl"
 )
@@ -14,8 +16,33 @@ func main() {
 		panic(err)
 	}
 
-	fmt.Printf("Hello %s! This is the Monkey programming language!\n",
-		user.Username)
-	fmt.Printf("Feel free to type in commands\n")
-	repl.Start(os.Stdin, os.Stdout)
+	history := flag.String("history", filepath.Join(user.HomeDir, ".monkey_history"),
+		"file to keep REPL history in, empty to not keep it")
+	modeName := flag.String("mode", "auto",
+		"auto, interactive, or script to print only results without prompts")
+	flag.Parse()
+
+	var mode repl.Mode
+	switch *modeName {
+	case "auto":
+		mode = repl.ModeAuto
+	case "interactive":
+		mode = repl.ModeInteractive
+	case "script":
+		mode = repl.ModeScript
+	default:
+		fmt.Fprintf(os.Stderr, "unknown mode %q\n", *modeName)
+		os.Exit(2)
+	}
+
+	interactive := mode == repl.ModeInteractive ||
+		(mode == repl.ModeAuto && repl.IsInteractive(os.Stdin, os.Stdout))
+	if interactive {
+		fmt.Printf("Hello %s! This is the Monkey programming language!\n",
+			user.Username)
+		fmt.Printf("Feel free to type in commands\n")
+	}
+
+	repl.Start(os.Stdin, os.Stdout,
+		repl.WithHistoryFile(*history), repl.WithMode(mode))
 }
@@ -2,8 +2,15 @@ package object
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
 )
 
+// Builtins is the registry of functions available to every Monkey program.
+// The position of each entry is its index for OpGetBuiltin, so new builtins
+// must be appended to keep compiled bytecode stable.
 var Builtins = []struct {
 	Name    string
 	Builtin *Builtin
@@ -19,10 +26,11 @@ var Builtins = []struct {
 			switch arg := args[0].(type) {
 
 			case *Array:
-				return &Integer{Value: int64(len(arg.Elements))}
+				return NewInteger(int64(len(arg.Elements)))
 
 			case *String:
-				return &Integer{Value: int64(len(arg.Value))}
+				// Strings are indexed and sliced by character.
+				return NewInteger(int64(utf8.RuneCountInString(arg.Value)))
 
 			default:
 				return newError("argument to `len` not supported, got %s",
@@ -32,15 +40,12 @@ var Builtins = []struct {
 	},
 	{
 		"print",
-		&Builtin{Fn: func(args ...Object) Object {
-			{
-				for _, arg := range args {
-					fmt.Println(arg.Inspect())
-				}
-
-				return nil
-			}
-		}},
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				return writeLines(os.Stdout, args...)
+			},
+			OutputFn: writeLines,
+		},
 	},
 	{
 		"first",
@@ -135,8 +140,56 @@ var Builtins = []struct {
 			return &Array{Elements: newElements}
 		}},
 	},
+	{
+		"puts",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				return writeLines(os.Stdout, args...)
+			},
+			OutputFn: writeLines,
+		},
+	},
+	{"abs", &Builtin{Fn: builtinAbs}},
+	{"min", &Builtin{Fn: builtinMin}},
+	{"max", &Builtin{Fn: builtinMax}},
+	{"pow", &Builtin{Fn: builtinPow}},
+	{"sqrt", &Builtin{Fn: builtinSqrt}},
+	{"split", &Builtin{Fn: builtinSplit}},
+	{"join", &Builtin{Fn: builtinJoin}},
+	{"trim", &Builtin{Fn: stringFunction("trim", strings.TrimSpace)}},
+	{"upper", &Builtin{Fn: stringFunction("upper", strings.ToUpper)}},
+	{"lower", &Builtin{Fn: stringFunction("lower", strings.ToLower)}},
+	{"map", &Builtin{CallbackFn: builtinMap}},
+	{"filter", &Builtin{CallbackFn: builtinFilter}},
+	{"reduce", &Builtin{CallbackFn: builtinReduce}},
+	{
+		"type",
+		&Builtin{Fn: func(args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+
+			return &String{Value: string(args[0].Type())}
+		}},
+	},
+	{"int", &Builtin{Fn: builtinInt}},
+	{"float", &Builtin{Fn: builtinFloat}},
+	{"str", &Builtin{Fn: builtinStr}},
+	{"bool", &Builtin{Fn: builtinBool}},
+	{"keys", &Builtin{Fn: builtinKeys}},
+	{"values", &Builtin{Fn: builtinValues}},
+	{"has", &Builtin{Fn: builtinHas}},
 }
 
+func init() {
+	for _, def := range Builtins {
+		def.Builtin.Name = def.Name
+	}
+}
+
+// GetBuiltinByName returns the builtin registered under name, or nil if there
+// is none.
 func GetBuiltinByName(name string) *Builtin {
 	for _, def := range Builtins {
 		if def.Name == name {
@@ -147,6 +200,16 @@ func GetBuiltinByName(name string) *Builtin {
 	return nil
 }
 
+// writeLines writes the Inspect output of each argument to out on its own
+// line. It backs `puts` and `print`.
+func writeLines(out io.Writer, args ...Object) Object {
+	for _, arg := range args {
+		fmt.Fprintln(out, arg.Inspect())
+	}
+
+	return nil
+}
+
 func newError(format string, a ...any) *Error {
 	return &Error{Message: fmt.Sprintf(format, a...)}
 }
@@ -0,0 +1,127 @@
+package object
+
+func builtinMap(call Caller, args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2",
+			len(args))
+	}
+
+	arr, fn, errObj := arrayAndFunction("map", args)
+	if errObj != nil {
+		return errObj
+	}
+
+	elements := make([]Object, len(arr.Elements))
+	for i, el := range arr.Elements {
+		result, errObj := apply(call, fn, el)
+		if errObj != nil {
+			return errObj
+		}
+		elements[i] = result
+	}
+
+	return &Array{Elements: elements}
+}
+
+func builtinFilter(call Caller, args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2",
+			len(args))
+	}
+
+	arr, fn, errObj := arrayAndFunction("filter", args)
+	if errObj != nil {
+		return errObj
+	}
+
+	elements := []Object{}
+	for _, el := range arr.Elements {
+		result, errObj := apply(call, fn, el)
+		if errObj != nil {
+			return errObj
+		}
+		if isTruthy(result) {
+			elements = append(elements, el)
+		}
+	}
+
+	return &Array{Elements: elements}
+}
+
+func builtinReduce(call Caller, args ...Object) Object {
+	if len(args) != 3 {
+		return newError("wrong number of arguments. got=%d, want=3",
+			len(args))
+	}
+
+	arr, fn, errObj := arrayAndFunction("reduce", args)
+	if errObj != nil {
+		return errObj
+	}
+
+	acc := args[2]
+	for _, el := range arr.Elements {
+		result, errObj := apply(call, fn, acc, el)
+		if errObj != nil {
+			return errObj
+		}
+		acc = result
+	}
+
+	return acc
+}
+
+// arrayAndFunction checks the array and function arguments shared by the
+// higher-order builtins.
+func arrayAndFunction(name string, args []Object) (*Array, Object, *Error) {
+	arr, ok := args[0].(*Array)
+	if !ok {
+		return nil, nil, newError("first argument to `%s` must be ARRAY, got %s",
+			name, args[0].Type())
+	}
+
+	switch args[1].(type) {
+	case *Closure, *Function, *Builtin:
+	default:
+		return nil, nil, newError("second argument to `%s` must be a function, got %s",
+			name, args[1].Type())
+	}
+
+	return arr, args[1], nil
+}
+
+// isTruthy follows the interpreters: everything but false and null is true.
+func isTruthy(obj Object) bool {
+	switch obj := obj.(type) {
+	case *Boolean:
+		return obj.Value
+	case *Null:
+		return false
+	default:
+		return true
+	}
+}
+
+func toError(err error) *Error {
+	if errObj, ok := err.(*Error); ok {
+		return errObj
+	}
+
+	return newError("%s", err)
+}
+
+// apply calls fn with args through call. Both a failed call and an *Error
+// returned by fn, like one from a builtin such as `len`, end the builtin with
+// that error instead of being collected as a value.
+func apply(call Caller, fn Object, args ...Object) (Object, *Error) {
+	result, err := call(fn, args...)
+	if err != nil {
+		return nil, toError(err)
+	}
+
+	if errObj, ok := result.(*Error); ok {
+		return nil, errObj
+	}
+
+	return result, nil
+}
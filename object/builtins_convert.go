@@ -0,0 +1,95 @@
+package object
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+)
+
+func builtinInt(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+
+	switch arg := args[0].(type) {
+	case *Integer, *BigInt:
+		return arg
+
+	case *Float:
+		if math.IsNaN(arg.Value) || math.IsInf(arg.Value, 0) {
+			return newError("cannot convert %s to INTEGER", arg.Inspect())
+		}
+		v, _ := big.NewFloat(math.Trunc(arg.Value)).Int(nil)
+		return NormalizeBigInt(v)
+
+	case *String:
+		v, ok := new(big.Int).SetString(arg.Value, 10)
+		if !ok {
+			return newError("cannot convert %q to INTEGER", arg.Value)
+		}
+		return NormalizeBigInt(v)
+
+	case *Boolean:
+		if arg.Value {
+			return NewInteger(1)
+		}
+		return NewInteger(0)
+
+	default:
+		return newError("argument to `int` not supported, got %s",
+			args[0].Type())
+	}
+}
+
+func builtinFloat(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+
+	switch arg := args[0].(type) {
+	case *Float:
+		return arg
+
+	case *Integer, *BigInt:
+		return &Float{Value: ToFloat(arg)}
+
+	case *String:
+		v, err := strconv.ParseFloat(arg.Value, 64)
+		if err != nil {
+			return newError("cannot convert %q to FLOAT", arg.Value)
+		}
+		return &Float{Value: v}
+
+	default:
+		return newError("argument to `float` not supported, got %s",
+			args[0].Type())
+	}
+}
+
+func builtinStr(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+
+	if s, ok := args[0].(*String); ok {
+		return s
+	}
+
+	return &String{Value: args[0].Inspect()}
+}
+
+func builtinBool(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+
+	if isTruthy(args[0]) {
+		return TRUE
+	}
+
+	return FALSE
+}
@@ -0,0 +1,92 @@
+package object
+
+import "sort"
+
+func builtinKeys(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+
+	hash, ok := args[0].(*Hash)
+	if !ok {
+		return newError("argument to `keys` must be HASH, got %s",
+			args[0].Type())
+	}
+
+	return &Array{Elements: hash.Keys()}
+}
+
+func builtinValues(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+
+	hash, ok := args[0].(*Hash)
+	if !ok {
+		return newError("argument to `values` must be HASH, got %s",
+			args[0].Type())
+	}
+
+	pairs := hash.OrderedPairs()
+	elements := make([]Object, len(pairs))
+	for i, pair := range pairs {
+		elements[i] = pair.Value
+	}
+
+	return &Array{Elements: elements}
+}
+
+func builtinHas(args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2",
+			len(args))
+	}
+
+	hash, ok := args[0].(*Hash)
+	if !ok {
+		return newError("first argument to `has` must be HASH, got %s",
+			args[0].Type())
+	}
+	key, ok := args[1].(Hashable)
+	if !ok {
+		return newError("unusable as hash key: %s", args[1].Type())
+	}
+
+	if _, ok := hash.Pairs[key.HashKey()]; ok {
+		return TRUE
+	}
+
+	return FALSE
+}
+
+// sortedPairs returns the pairs of hash ordered by their HashKey, for hashes
+// built without Set, so they still don't depend on map iteration order.
+// Integer keys come out in numeric order; the order of strings is arbitrary
+// but stable.
+func sortedPairs(hash *Hash) []HashPair {
+	hashKeys := make([]HashKey, 0, len(hash.Pairs))
+	for hashKey := range hash.Pairs {
+		hashKeys = append(hashKeys, hashKey)
+	}
+
+	sort.Slice(hashKeys, func(i, j int) bool {
+		a, b := hashKeys[i], hashKeys[j]
+		switch {
+		case a.Type != b.Type:
+			return a.Type < b.Type
+		case a.Type == INTEGER_OBJ:
+			return int64(a.Value) < int64(b.Value)
+		default:
+			return a.Value < b.Value
+		}
+	})
+
+	pairs := make([]HashPair, len(hashKeys))
+	for i, hashKey := range hashKeys {
+		pairs[i] = hash.Pairs[hashKey]
+	}
+
+	return pairs
+}
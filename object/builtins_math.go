@@ -0,0 +1,125 @@
+package object
+
+import (
+	"math"
+	"math/big"
+)
+
+func builtinAbs(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+
+	switch arg := args[0].(type) {
+	case *Integer:
+		if arg.Value >= 0 {
+			return arg
+		}
+		if arg.Value == math.MinInt64 {
+			return &BigInt{Value: new(big.Int).Neg(big.NewInt(arg.Value))}
+		}
+		return NewInteger(-arg.Value)
+
+	case *BigInt:
+		return NormalizeBigInt(new(big.Int).Abs(arg.Value))
+
+	case *Float:
+		return &Float{Value: math.Abs(arg.Value)}
+
+	default:
+		return newError("argument to `abs` must be INTEGER or FLOAT, got %s",
+			args[0].Type())
+	}
+}
+
+func builtinMin(args ...Object) Object {
+	return extremum("min", -1, args)
+}
+
+func builtinMax(args ...Object) Object {
+	return extremum("max", 1, args)
+}
+
+// extremum returns the argument that compares furthest in the direction of
+// sign, keeping the first on ties so min(1, 1.0) is the Integer 1.
+func extremum(name string, sign int, args []Object) Object {
+	if len(args) == 0 {
+		return newError("wrong number of arguments. got=0, want at least 1")
+	}
+
+	for _, arg := range args {
+		if !IsNumeric(arg) {
+			return newError("argument to `%s` must be INTEGER or FLOAT, got %s",
+				name, arg.Type())
+		}
+	}
+
+	result := args[0]
+	for _, arg := range args[1:] {
+		if compareNumbers(arg, result) == sign {
+			result = arg
+		}
+	}
+
+	return result
+}
+
+// compareNumbers returns -1, 0 or 1 as a is less than, equal to or greater
+// than b. Integral pairs are compared exactly; anything involving a Float is
+// compared as float64.
+func compareNumbers(a, b Object) int {
+	if IsIntegral(a) && IsIntegral(b) {
+		return ToBigInt(a).Cmp(ToBigInt(b))
+	}
+
+	x, y := ToFloat(a), ToFloat(b)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func builtinPow(args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2",
+			len(args))
+	}
+
+	for _, arg := range args {
+		if !IsNumeric(arg) {
+			return newError("argument to `pow` must be INTEGER or FLOAT, got %s",
+				arg.Type())
+		}
+	}
+
+	base, exp := args[0], args[1]
+	if IsIntegral(base) && IsIntegral(exp) && ToBigInt(exp).Sign() >= 0 {
+		return NormalizeBigInt(new(big.Int).Exp(ToBigInt(base), ToBigInt(exp), nil))
+	}
+
+	return &Float{Value: math.Pow(ToFloat(base), ToFloat(exp))}
+}
+
+func builtinSqrt(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+	if !IsNumeric(args[0]) {
+		return newError("argument to `sqrt` must be INTEGER or FLOAT, got %s",
+			args[0].Type())
+	}
+
+	x := ToFloat(args[0])
+	if x < 0 {
+		return newError("argument to `sqrt` must not be negative, got %s",
+			args[0].Inspect())
+	}
+
+	return &Float{Value: math.Sqrt(x)}
+}
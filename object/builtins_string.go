@@ -0,0 +1,78 @@
+package object
+
+import "strings"
+
+func builtinSplit(args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2",
+			len(args))
+	}
+
+	s, ok := args[0].(*String)
+	if !ok {
+		return newError("first argument to `split` must be STRING, got %s",
+			args[0].Type())
+	}
+	sep, ok := args[1].(*String)
+	if !ok {
+		return newError("second argument to `split` must be STRING, got %s",
+			args[1].Type())
+	}
+
+	parts := strings.Split(s.Value, sep.Value)
+	elements := make([]Object, len(parts))
+	for i, part := range parts {
+		elements[i] = &String{Value: part}
+	}
+
+	return &Array{Elements: elements}
+}
+
+func builtinJoin(args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2",
+			len(args))
+	}
+
+	arr, ok := args[0].(*Array)
+	if !ok {
+		return newError("first argument to `join` must be ARRAY, got %s",
+			args[0].Type())
+	}
+	sep, ok := args[1].(*String)
+	if !ok {
+		return newError("second argument to `join` must be STRING, got %s",
+			args[1].Type())
+	}
+
+	parts := make([]string, len(arr.Elements))
+	for i, el := range arr.Elements {
+		str, ok := el.(*String)
+		if !ok {
+			return newError("elements passed to `join` must be STRING, got %s at index %d",
+				el.Type(), i)
+		}
+		parts[i] = str.Value
+	}
+
+	return &String{Value: strings.Join(parts, sep.Value)}
+}
+
+// stringFunction adapts a func(string) string into a one argument builtin
+// named name.
+func stringFunction(name string, fn func(string) string) BuiltinFunction {
+	return func(args ...Object) Object {
+		if len(args) != 1 {
+			return newError("wrong number of arguments. got=%d, want=1",
+				len(args))
+		}
+
+		s, ok := args[0].(*String)
+		if !ok {
+			return newError("argument to `%s` must be STRING, got %s",
+				name, args[0].Type())
+		}
+
+		return &String{Value: fn(s.Value)}
+	}
+}
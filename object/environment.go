@@ -1,10 +1,14 @@
 package object
 
+// Environment binds names to values for the evaluator. Lookups that miss
+// fall back to the enclosing environment, giving lexical scoping.
 type Environment struct {
 	store map[string]Object
 	outer *Environment
 }
 
+// NewEnclosedEnvironment returns an empty environment nested in outer, as
+// created for each function call.
 func NewEnclosedEnvironment(outer *Environment) *Environment {
 	env := NewEnvironment()
 	env.outer = outer
@@ -18,6 +22,7 @@ func NewEnvironment() *Environment {
 	return &Environment{store: s, outer: nil}
 }
 
+// Get looks name up in e and then its enclosing environments.
 func (e *Environment) Get(name string) (Object, bool) {
 	obj, ok := e.store[name]
 	if !ok && e.outer != nil {
@@ -27,6 +32,8 @@ func (e *Environment) Get(name string) (Object, bool) {
 	return obj, ok
 }
 
+// Set binds name in e itself, shadowing any binding in an enclosing
+// environment, and returns val.
 func (e *Environment) Set(name string, val Object) Object {
 	e.store[name] = val
 
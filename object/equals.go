@@ -0,0 +1,66 @@
+package object
+
+// Equals reports whether a and b hold the same value. Objects of different
+// types are never equal. Arrays and hashes are compared element by element;
+// any other object without a comparable value falls back to identity.
+func Equals(a, b Object) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch a := a.(type) {
+	case *Integer:
+		return a.Value == b.(*Integer).Value
+
+	case *BigInt:
+		return a.Value.Cmp(b.(*BigInt).Value) == 0
+
+	case *Float:
+		return a.Value == b.(*Float).Value
+
+	case *String:
+		return a.Value == b.(*String).Value
+
+	case *Boolean:
+		return a.Value == b.(*Boolean).Value
+
+	case *Null:
+		return true
+
+	case *Array:
+		other := b.(*Array)
+		if len(a.Elements) != len(other.Elements) {
+			return false
+		}
+
+		for i, el := range a.Elements {
+			if !Equals(el, other.Elements[i]) {
+				return false
+			}
+		}
+
+		return true
+
+	case *Hash:
+		other := b.(*Hash)
+		if len(a.Pairs) != len(other.Pairs) {
+			return false
+		}
+
+		for key, pair := range a.Pairs {
+			otherPair, ok := other.Pairs[key]
+			if !ok || !Equals(pair.Value, otherPair.Value) {
+				return false
+			}
+		}
+
+		return true
+
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,62 @@
+package object
+
+import "math/big"
+
+// IsIntegral reports whether obj is an Integer or a BigInt.
+func IsIntegral(obj Object) bool {
+	switch obj.(type) {
+	case *Integer, *BigInt:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsNumeric reports whether obj is an Integer, a BigInt or a Float.
+func IsNumeric(obj Object) bool {
+	switch obj.(type) {
+	case *Integer, *BigInt, *Float:
+		return true
+	default:
+		return false
+	}
+}
+
+// ToFloat widens an Integer, BigInt or Float to a float64. Callers must check
+// IsNumeric first.
+func ToFloat(obj Object) float64 {
+	switch obj := obj.(type) {
+	case *Integer:
+		return float64(obj.Value)
+	case *BigInt:
+		f, _ := new(big.Float).SetInt(obj.Value).Float64()
+		return f
+	case *Float:
+		return obj.Value
+	}
+
+	return 0
+}
+
+// ToBigInt widens an Integer or BigInt to a *big.Int. Callers must check
+// IsIntegral first and must not mutate the result.
+func ToBigInt(obj Object) *big.Int {
+	switch obj := obj.(type) {
+	case *Integer:
+		return big.NewInt(obj.Value)
+	case *BigInt:
+		return obj.Value
+	}
+
+	return new(big.Int)
+}
+
+// NormalizeBigInt returns an Integer when v fits in an int64 so the common
+// case stays on the fast path, and a BigInt otherwise.
+func NormalizeBigInt(v *big.Int) Object {
+	if v.IsInt64() {
+		return NewInteger(v.Int64())
+	}
+
+	return &BigInt{Value: v}
+}
@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
 	"strings"
 
 	"github.com/ZeroBl21/go-interpreter/ast"
@@ -14,6 +18,8 @@ type ObjectType string
 
 const (
 	INTEGER_OBJ = "INTEGER"
+	FLOAT_OBJ   = "FLOAT"
+	BIGINT_OBJ  = "BIGINT"
 	STRING_OBJ  = "STRING"
 	BOOLEAN_OBJ = "BOOLEAN"
 	ARRAY_OBJ   = "ARRAY"
@@ -28,6 +34,9 @@ const (
 
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
 	CLOSURE_OBJ           = "CLOSURE"
+
+	QUOTE_OBJ = "QUOTE"
+	MACRO_OBJ = "MACRO"
 )
 
 type Object interface {
@@ -57,6 +66,69 @@ func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 func (i *Integer) HashKey() HashKey { return HashKey{Type: i.Type(), Value: uint64(i.Value)} }
 
+// Integers in this range are interned by NewInteger.
+const (
+	minInternedInteger = -128
+	maxInternedInteger = 255
+)
+
+var internedIntegers = func() []*Integer {
+	integers := make([]*Integer, maxInternedInteger-minInternedInteger+1)
+	for i := range integers {
+		integers[i] = &Integer{Value: int64(i + minInternedInteger)}
+	}
+	return integers
+}()
+
+// NewInteger returns an Integer holding value. Small values, the bulk of
+// what counters and indexes produce, come from a shared table instead of
+// being allocated, much like TRUE and FALSE. Integers are never modified
+// after creation; an interned one must not be either, since every holder of
+// the value shares it.
+func NewInteger(value int64) *Integer {
+	if value >= minInternedInteger && value <= maxInternedInteger {
+		return internedIntegers[value-minInternedInteger]
+	}
+
+	return &Integer{Value: value}
+}
+
+// BigInt holds integers that do not fit in an int64. The VM only produces it
+// when Integer arithmetic overflows, and folds results back into an Integer
+// whenever they fit again.
+type BigInt struct {
+	Value *big.Int
+}
+
+func (bi *BigInt) Type() ObjectType { return BIGINT_OBJ }
+func (bi *BigInt) Inspect() string  { return bi.Value.String() }
+func (bi *BigInt) HashKey() HashKey {
+	h := fnv.New64a()
+	h.Write(bi.Value.Bytes())
+	if bi.Value.Sign() < 0 {
+		h.Write([]byte{'-'})
+	}
+
+	return HashKey{Type: bi.Type(), Value: h.Sum64()}
+}
+
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+func (f *Float) Inspect() string {
+	out := strconv.FormatFloat(f.Value, 'f', -1, 64)
+	if !strings.ContainsAny(out, ".IN") {
+		out += ".0"
+	}
+
+	return out
+}
+func (f *Float) HashKey() HashKey {
+	return HashKey{Type: f.Type(), Value: math.Float64bits(f.Value)}
+}
+
 type String struct {
 	Value string
 }
@@ -74,6 +146,15 @@ type Boolean struct {
 	Value bool
 }
 
+// TRUE, FALSE and NULL are the only Boolean and Null values the interpreters
+// produce, so booleans and null can be compared by pointer. Don't construct
+// others.
+var (
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+	NULL  = &Null{}
+)
+
 func (b *Boolean) Type() ObjectType { return BOOLEAN_OBJ }
 func (b *Boolean) Inspect() string  { return fmt.Sprintf("%t", b.Value) }
 func (b *Boolean) HashKey() HashKey {
@@ -115,6 +196,8 @@ type Null struct{}
 func (n *Null) Type() ObjectType { return NULL_OBJ }
 func (n *Null) Inspect() string  { return "null" }
 
+// ReturnValue wraps the value of a return statement so the evaluator can
+// unwind nested blocks until it reaches the enclosing function body.
 type ReturnValue struct {
 	Value Object
 }
@@ -124,11 +207,39 @@ func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
 type Error struct {
 	Message string
+	Line    int // source line a runtime error was raised on, 0 if unknown
+	// Trace holds the calls active when a runtime error was raised, see
+	// StackTrace.
+	Trace []StackFrame
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
 func (e *Error) Inspect() string  { return "Error " + e.Message }
 
+// Error lets an *Error travel through Go code as a regular error value, which
+// is how the VM reports runtime failures back to its caller.
+func (e *Error) Error() string { return e.Message }
+
+// StackTrace returns the calls that were active when the VM raised e,
+// innermost first and ending with the main program. It is empty for errors
+// that weren't raised by the VM. A call made in tail position replaces its
+// caller, so the caller doesn't appear.
+func (e *Error) StackTrace() []StackFrame { return e.Trace }
+
+// StackFrame is one entry of a stack trace.
+type StackFrame struct {
+	Function string // function name, "<anonymous>" or "<main>"
+	Line     int    // line being executed, 0 if unknown
+}
+
+func (f StackFrame) String() string {
+	if f.Line == 0 {
+		return f.Function
+	}
+
+	return fmt.Sprintf("%s (line %d)", f.Function, f.Line)
+}
+
 type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
@@ -154,17 +265,83 @@ func (f *Function) Inspect() string {
 	return out.String()
 }
 
+// Quote is the unevaluated code passed to quote.
+type Quote struct {
+	Node ast.Node
+}
+
+func (q *Quote) Type() ObjectType { return QUOTE_OBJ }
+func (q *Quote) Inspect() string {
+	return "QUOTE(" + q.Node.String() + ")"
+}
+
+// Macro is a macro literal bound by DefineMacros, closed over the
+// environment it was defined in.
+type Macro struct {
+	Parameters []*ast.Identifier
+	Body       *ast.BlockStatement
+	Env        *Environment
+}
+
+func (m *Macro) Type() ObjectType { return MACRO_OBJ }
+func (m *Macro) Inspect() string {
+	var out bytes.Buffer
+
+	params := []string{}
+	for _, p := range m.Parameters {
+		params = append(params, p.String())
+	}
+
+	out.WriteString("macro")
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") {\n")
+	out.WriteString(m.Body.String())
+	out.WriteString("\n}")
+
+	return out.String()
+}
+
+// BuiltinFunction is the Go implementation behind a Monkey builtin. Returning
+// nil is treated as returning null.
 type BuiltinFunction func(args ...Object) Object
 
+// OutputFunction is a builtin that writes to the output of the interpreter
+// running it instead of a fixed destination.
+type OutputFunction func(out io.Writer, args ...Object) Object
+
+// Caller calls the Monkey function fn with args on behalf of a builtin. The
+// error reports a failure the interpreter can't represent as a value, like a
+// runtime error in the VM.
+type Caller func(fn Object, args ...Object) (Object, error)
+
+// CallbackFunction is a builtin that calls back into Monkey functions, like
+// `map`. If a call fails it should return the error as an *Error.
+type CallbackFunction func(call Caller, args ...Object) Object
+
 type Builtin struct {
-	Fn BuiltinFunction
+	// Name is the name programs call the builtin by.
+	Name string
+	Fn   BuiltinFunction
+	// OutputFn, when set, is called in place of Fn by interpreters that have
+	// a configurable output, like the VM. Fn remains the fallback writing to
+	// os.Stdout.
+	OutputFn OutputFunction
+	// CallbackFn, when set, is called in place of Fn with a Caller bound to
+	// the running interpreter. Builtins that set it may leave Fn nil.
+	CallbackFn CallbackFunction
 }
 
 func (b *Builtin) Type() ObjectType { return BUILTIN_OBJ }
 func (b *Builtin) Inspect() string  { return "builtin function" }
 
 type CompiledFunction struct {
+	// Name is the name the function was bound to with let, empty for
+	// anonymous functions. It is only used in stack traces.
+	Name          string
 	Instructions  code.Instructions
+	Lines         []int           // source line of each instruction byte, may be nil
+	SourceMap     *code.SourceMap // source spans of the instructions, may be nil
 	NumLocals     int
 	NumParameters int
 }
@@ -176,14 +353,60 @@ func (cf *CompiledFunction) Inspect() string {
 
 type Hash struct {
 	Pairs map[HashKey]HashPair
+
+	// keys lists the keys of Pairs in insertion order. It is kept by Set; a
+	// Hash whose Pairs were filled in directly has none and is listed in
+	// sortedPairs order instead.
+	keys []HashKey
 }
 
 func (h *Hash) Type() ObjectType { return HASH_OBJ }
+
+// Set stores pair under key. A new key goes after all existing ones, while
+// overwriting a key keeps its place.
+func (h *Hash) Set(key HashKey, pair HashPair) {
+	if h.Pairs == nil {
+		h.Pairs = make(map[HashKey]HashPair)
+	}
+
+	if _, ok := h.Pairs[key]; !ok {
+		h.keys = append(h.keys, key)
+	}
+	h.Pairs[key] = pair
+}
+
+// OrderedPairs returns the pairs of h in insertion order, or ordered by
+// HashKey if h was filled in without Set. Inspect, the keys and values
+// builtins and for loops all list pairs in this order.
+func (h *Hash) OrderedPairs() []HashPair {
+	if len(h.keys) != len(h.Pairs) {
+		return sortedPairs(h)
+	}
+
+	pairs := make([]HashPair, len(h.keys))
+	for i, key := range h.keys {
+		pairs[i] = h.Pairs[key]
+	}
+
+	return pairs
+}
+
+// Keys returns the keys of h in the order of OrderedPairs.
+func (h *Hash) Keys() []Object {
+	pairs := h.OrderedPairs()
+	keys := make([]Object, len(pairs))
+	for i, pair := range pairs {
+		keys[i] = pair.Key
+	}
+
+	return keys
+}
+
 func (h *Hash) Inspect() string {
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for _, pair := range h.Pairs {
+	for _, pair := range h.OrderedPairs() {
 		pairs = append(pairs, fmt.Sprintf("%s: %s",
 			pair.Key.Inspect(), pair.Value.Inspect()))
 	}
@@ -20,3 +20,188 @@ func TestStringHashKey(t *testing.T) {
 		t.Errorf("strings with different content have same hash keys")
 	}
 }
+
+func TestGetBuiltinByName(t *testing.T) {
+	tests := []struct {
+		input    []Object
+		expected int64
+	}{
+		{[]Object{&String{Value: "four"}}, 4},
+		{[]Object{&Array{Elements: []Object{
+			&Integer{Value: 1}, &Integer{Value: 2},
+		}}}, 2},
+	}
+
+	builtin := GetBuiltinByName("len")
+	if builtin == nil {
+		t.Fatalf("builtin len not found")
+	}
+
+	if builtin.Name != "len" {
+		t.Errorf("wrong builtin name. want=%q, got=%q", "len", builtin.Name)
+	}
+
+	for _, tt := range tests {
+		result, ok := builtin.Fn(tt.input...).(*Integer)
+		if !ok {
+			t.Fatalf("len did not return Integer")
+		}
+
+		if result.Value != tt.expected {
+			t.Errorf("wrong length. want=%d, got=%d", tt.expected, result.Value)
+		}
+	}
+
+	if _, ok := builtin.Fn(&Integer{Value: 1}).(*Error); !ok {
+		t.Errorf("len(1) did not return Error")
+	}
+
+	if GetBuiltinByName("nope") != nil {
+		t.Errorf("unknown builtin was found")
+	}
+}
+
+func TestReturnValueInspect(t *testing.T) {
+	rv := &ReturnValue{Value: &Integer{Value: 10}}
+
+	if rv.Type() != RETURN_VALUE_OBJ {
+		t.Errorf("wrong type. want=%s, got=%s", RETURN_VALUE_OBJ, rv.Type())
+	}
+
+	if rv.Inspect() != "10" {
+		t.Errorf("Inspect not delegated. want=%q, got=%q", "10", rv.Inspect())
+	}
+}
+
+func TestHashInspect(t *testing.T) {
+	a := &String{Value: "a"}
+	b := &String{Value: "b"}
+	three := &Integer{Value: 3}
+
+	hash := &Hash{}
+	hash.Set(b.HashKey(), HashPair{Key: b, Value: &Integer{Value: 1}})
+	hash.Set(a.HashKey(), HashPair{Key: a, Value: &Integer{Value: 2}})
+	hash.Set(three.HashKey(), HashPair{Key: three, Value: TRUE})
+
+	if got := hash.Inspect(); got != `{b: 1, a: 2, 3: true}` {
+		t.Errorf("pairs not in insertion order. got=%s", got)
+	}
+
+	// Overwriting a key keeps its place.
+	hash.Set(b.HashKey(), HashPair{Key: b, Value: &Integer{Value: 10}})
+	if got := hash.Inspect(); got != `{b: 10, a: 2, 3: true}` {
+		t.Errorf("overwritten key moved. got=%s", got)
+	}
+
+	// Hashes built from Pairs alone have no insertion order to follow and
+	// are sorted like the keys builtin sorts them.
+	direct := &Hash{Pairs: map[HashKey]HashPair{
+		b.HashKey():     {Key: b, Value: FALSE},
+		three.HashKey(): {Key: three, Value: TRUE},
+	}}
+	if got := direct.Inspect(); got != `{3: true, b: false}` {
+		t.Errorf("pairs not sorted. got=%s", got)
+	}
+}
+
+func TestEquals(t *testing.T) {
+	one := &Integer{Value: 1}
+	two := &Integer{Value: 2}
+
+	hash := func(k, v Object) *Hash {
+		return &Hash{Pairs: map[HashKey]HashPair{
+			k.(Hashable).HashKey(): {Key: k, Value: v},
+		}}
+	}
+
+	tests := []struct {
+		a, b     Object
+		expected bool
+	}{
+		{one, &Integer{Value: 1}, true},
+		{one, two, false},
+		{one, &String{Value: "1"}, false},
+		{&String{Value: "a"}, &String{Value: "a"}, true},
+		{&Boolean{Value: true}, &Boolean{Value: true}, true},
+		{&Null{}, &Null{}, true},
+		{&Array{Elements: []Object{one, two}},
+			&Array{Elements: []Object{&Integer{Value: 1}, &Integer{Value: 2}}},
+			true},
+		{&Array{Elements: []Object{one, two}},
+			&Array{Elements: []Object{two, one}},
+			false},
+		{&Array{Elements: []Object{one}},
+			&Array{Elements: []Object{one, two}},
+			false},
+		{&Array{Elements: []Object{&Array{Elements: []Object{one}}}},
+			&Array{Elements: []Object{&Array{Elements: []Object{one}}}},
+			true},
+		{hash(&String{Value: "a"}, one), hash(&String{Value: "a"}, one), true},
+		{hash(&String{Value: "a"}, one), hash(&String{Value: "a"}, two), false},
+		{hash(&String{Value: "a"}, one), hash(&String{Value: "b"}, one), false},
+		{&Hash{Pairs: map[HashKey]HashPair{}}, hash(one, one), false},
+	}
+
+	for i, tt := range tests {
+		if got := Equals(tt.a, tt.b); got != tt.expected {
+			t.Errorf("tests[%d] - Equals(%s, %s) wrong. want=%t, got=%t",
+				i, tt.a.Inspect(), tt.b.Inspect(), tt.expected, got)
+		}
+	}
+}
+
+func TestNewInteger(t *testing.T) {
+	for _, value := range []int64{-129, -128, -1, 0, 1, 255, 256, 1 << 40} {
+		integer := NewInteger(value)
+		if integer.Value != value {
+			t.Errorf("NewInteger(%d) has wrong value. got=%d", value, integer.Value)
+		}
+
+		interned := value >= -128 && value <= 255
+		if same := NewInteger(value) == integer; same != interned {
+			t.Errorf("NewInteger(%d) twice: same pointer=%t, want %t",
+				value, same, interned)
+		}
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	outer := NewEnvironment()
+	outer.Set("a", NewInteger(1))
+	outer.Set("b", NewInteger(2))
+
+	inner := NewEnclosedEnvironment(outer)
+	inner.Set("b", NewInteger(20))
+	inner.Set("c", NewInteger(30))
+
+	tests := []struct {
+		env      *Environment
+		name     string
+		expected int64
+		ok       bool
+	}{
+		{inner, "a", 1, true},  // falls through to outer
+		{inner, "b", 20, true}, // shadows outer
+		{inner, "c", 30, true}, // inner only
+		{outer, "b", 2, true},  // unaffected by shadowing
+		{outer, "c", 0, false}, // not visible from outer
+		{inner, "d", 0, false}, // undefined anywhere
+	}
+
+	for _, tt := range tests {
+		obj, ok := tt.env.Get(tt.name)
+		if ok != tt.ok {
+			t.Errorf("Get(%q) ok wrong. want=%t, got=%t", tt.name, tt.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		integer, isInt := obj.(*Integer)
+		if !isInt || integer.Value != tt.expected {
+			t.Errorf("Get(%q) wrong. want=%d, got=%s",
+				tt.name, tt.expected, obj.Inspect())
+		}
+	}
+}
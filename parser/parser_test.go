@@ -144,6 +144,41 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestFloatLiteralExpression(t *testing.T) {
+	input := "3.14;"
+
+	l := lexer.New(input)
+	p := New(l)
+
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program has not enough statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	literal, ok := stmt.Expression.(*ast.FloatLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+	}
+
+	if literal.Value != 3.14 {
+		t.Errorf("literal.Value not %g. got=%g", 3.14, literal.Value)
+	}
+
+	if literal.TokenLiteral() != "3.14" {
+		t.Errorf("literal.TokenLiteral not %s. got=%s", "3.14",
+			literal.TokenLiteral())
+	}
+}
+
 func TestParsingPrefixExpressions(t *testing.T) {
 	prefixTests := []struct {
 		input        string
@@ -208,6 +243,74 @@ func TestStringLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestTemplateLiteralExpression(t *testing.T) {
+	input := `"a ${x + 1} b ${"c ${y}"}"`
+
+	l := lexer.New(input)
+	p := New(l)
+
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	template, ok := stmt.Expression.(*ast.TemplateLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.TemplateLiteral. got=%T", stmt.Expression)
+	}
+
+	if len(template.Parts) != 5 {
+		t.Fatalf("template has not 5 parts. got=%d", len(template.Parts))
+	}
+
+	for i, expected := range []string{"a ", " b ", ""} {
+		text, ok := template.Parts[i*2].(*ast.StringLiteral)
+		if !ok {
+			t.Fatalf("part %d not *ast.StringLiteral. got=%T",
+				i*2, template.Parts[i*2])
+		}
+		if text.Value != expected {
+			t.Errorf("part %d wrong. want=%q, got=%q", i*2, expected, text.Value)
+		}
+	}
+
+	testInfixExpressions(t, template.Parts[1], "x", "+", 1)
+
+	nested, ok := template.Parts[3].(*ast.TemplateLiteral)
+	if !ok {
+		t.Fatalf("part 3 not *ast.TemplateLiteral. got=%T", template.Parts[3])
+	}
+	if nested.String() != "c ${y}" {
+		t.Errorf("nested template wrong. got=%q", nested.String())
+	}
+}
+
+func TestTemplateLiteralErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"a ${}"`, "empty interpolation in string"},
+		{`"a ${x`, "expected } to end interpolation, got EOF instead"},
+		{`"a ${x y}"`, "expected } to end interpolation, got IDENT instead"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("expected parser errors for %q, got none", tt.input)
+			continue
+		}
+
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q",
+				tt.input, tt.expected, errors[0])
+		}
+	}
+}
+
 func TestParsingInfixExpressions(t *testing.T) {
 	infixTest := []struct {
 		input      string
@@ -219,6 +322,12 @@ func TestParsingInfixExpressions(t *testing.T) {
 		{"5 - 5;", 5, "-", 5},
 		{"5 * 5;", 5, "*", 5},
 		{"5 / 5;", 5, "/", 5},
+		{"5 % 5;", 5, "%", 5},
+		{"5 & 5;", 5, "&", 5},
+		{"5 | 5;", 5, "|", 5},
+		{"5 ^ 5;", 5, "^", 5},
+		{"5 << 5;", 5, "<<", 5},
+		{"5 >> 5;", 5, ">>", 5},
 		{"5 > 5;", 5, ">", 5},
 		{"5 < 5;", 5, "<", 5},
 		{"5 == 5;", 5, "==", 5},
@@ -262,6 +371,26 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"-a * b",
 			"((-a) * b)",
 		},
+		{
+			"a * b ** c",
+			"(a * (b ** c))",
+		},
+		{
+			"a ** b ** c",
+			"(a ** (b ** c))",
+		},
+		{
+			"-a ** b",
+			"(-(a ** b))",
+		},
+		{
+			"a ** -b",
+			"(a ** (-b))",
+		},
+		{
+			"a ** b[0]",
+			"(a ** (b[0]))",
+		},
 		{
 			"!-a",
 			"(!(-a))",
@@ -282,6 +411,18 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"a * b / c",
 			"((a * b) / c)",
 		},
+		{
+			"a + b % c * d",
+			"(a + ((b % c) * d))",
+		},
+		{
+			"a | b & c << d == e ^ f",
+			"((a | ((b & c) << d)) == (e ^ f))",
+		},
+		{
+			"~a + b >> -c",
+			"((~a) + (b >> (-c)))",
+		},
 		{
 			"a + b / c",
 			"(a + (b / c))",
@@ -362,6 +503,14 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"add(a * b[2], b[1], 2 * [1, 2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
 		},
+		{
+			"a || b && c == d",
+			"(a || (b && (c == d)))",
+		},
+		{
+			"a && b || !c",
+			"((a && b) || (!c))",
+		},
 	}
 
 	for _, tt := range tests {
@@ -427,6 +576,291 @@ func TestIfExpression(t *testing.T) {
 	}
 }
 
+func TestWhileStatement(t *testing.T) {
+	input := `while (x < y) { x = x + 1 }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.WhileStatement. got=%T",
+			program.Statements[0])
+	}
+
+	if !testInfixExpressions(t, stmt.Condition, "x", "<", "y") {
+		return
+	}
+
+	if len(stmt.Body.Statements) != 1 {
+		t.Fatalf("body is not 1 statements. got=%d\n",
+			len(stmt.Body.Statements))
+	}
+
+	if stmt.Body.String() != "x = (x + 1)" {
+		t.Errorf("body.String() wrong. got=%q", stmt.Body.String())
+	}
+}
+
+func TestDoWhileStatement(t *testing.T) {
+	input := `do { x = x + 1 } while (x < y)`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.DoWhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.DoWhileStatement. got=%T",
+			program.Statements[0])
+	}
+
+	if stmt.Body.String() != "x = (x + 1)" {
+		t.Errorf("body.String() wrong. got=%q", stmt.Body.String())
+	}
+
+	testInfixExpressions(t, stmt.Condition, "x", "<", "y")
+}
+
+func TestForEachStatement(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedKey   string
+		expectedValue string
+	}{
+		{"for (x in xs) { x }", "", "x"},
+		{"for (k, v in h) { v }", "k", "v"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+				1, len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ForEachStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ForEachStatement. got=%T",
+				program.Statements[0])
+		}
+
+		if tt.expectedKey == "" {
+			if stmt.Key != nil {
+				t.Errorf("expected no key variable, got=%s", stmt.Key)
+			}
+		} else {
+			testIdentifier(t, stmt.Key, tt.expectedKey)
+		}
+
+		testIdentifier(t, stmt.Value, tt.expectedValue)
+
+		if len(stmt.Body.Statements) != 1 {
+			t.Errorf("body is not 1 statements. got=%d\n",
+				len(stmt.Body.Statements))
+		}
+	}
+}
+
+func TestSwitchStatement(t *testing.T) {
+	input := `switch (x) { case 1: a; b case y + 1: c default: d }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.SwitchStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.SwitchStatement. got=%T",
+			program.Statements[0])
+	}
+
+	if !testIdentifier(t, stmt.Subject, "x") {
+		return
+	}
+
+	if len(stmt.Cases) != 2 {
+		t.Fatalf("switch has not 2 cases. got=%d\n", len(stmt.Cases))
+	}
+
+	if !testLiteralExpression(t, stmt.Cases[0].Value, 1) {
+		return
+	}
+	if stmt.Cases[0].Body.String() != "ab" {
+		t.Errorf("first case body wrong. got=%q", stmt.Cases[0].Body.String())
+	}
+
+	if !testInfixExpressions(t, stmt.Cases[1].Value, "y", "+", 1) {
+		return
+	}
+	if stmt.Cases[1].Body.String() != "c" {
+		t.Errorf("second case body wrong. got=%q", stmt.Cases[1].Body.String())
+	}
+
+	if stmt.Default == nil || stmt.Default.String() != "d" {
+		t.Errorf("default body wrong. got=%v", stmt.Default)
+	}
+}
+
+func TestSwitchStatementErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"switch (x) { 1 }", "expected case or default, got INT instead"},
+		{"switch (x) { default: 1 default: 2 }", "multiple defaults in switch"},
+		{"switch (x) { case 1 2 }", "expected next token to be :, got INT instead"},
+		{"switch (x) { case 1: 2", "expected case or default, got EOF instead"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("expected parser errors for %q, got none", tt.input)
+			continue
+		}
+
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q",
+				tt.input, tt.expected, errors[0])
+		}
+	}
+}
+
+func TestBreakAndContinueStatements(t *testing.T) {
+	input := `while (true) { break; continue; }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.WhileStatement. got=%T",
+			program.Statements[0])
+	}
+
+	if len(stmt.Body.Statements) != 2 {
+		t.Fatalf("body is not 2 statements. got=%d\n",
+			len(stmt.Body.Statements))
+	}
+
+	if _, ok := stmt.Body.Statements[0].(*ast.BreakStatement); !ok {
+		t.Errorf("body.Statements[0] is not ast.BreakStatement. got=%T",
+			stmt.Body.Statements[0])
+	}
+
+	if _, ok := stmt.Body.Statements[1].(*ast.ContinueStatement); !ok {
+		t.Errorf("body.Statements[1] is not ast.ContinueStatement. got=%T",
+			stmt.Body.Statements[1])
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 5", "x = 5"},
+		{"x = y = 5 + 1", "x = y = (5 + 1)"},
+		{"x = y == z", "x = (y == z)"},
+		{"a[0] = 5", "(a[0]) = 5"},
+		{`h["k"] = h["k"] + 1`, "(h[k]) = ((h[k]) + 1)"},
+		{"a[0][1] = b[2] = 3", "((a[0])[1]) = (b[2]) = 3"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestInvalidAssignmentTarget(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 = 2", "invalid assignment target 1"},
+		{"a[1:2] = 3", "invalid assignment target (a[1:2])"},
+		{"f() = 3", "invalid assignment target f()"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 || errors[0] != tt.expected {
+			t.Errorf("expected %q error. got=%v", tt.expected, errors)
+		}
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedLine   int
+		expectedColumn int
+	}{
+		{"let = 5;", 1, 5},
+		{"1 +", 1, 4},
+		{"let x = 1;\nlet y = (2", 2, 11},
+		{"1 = 2", 1, 3},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.ParseErrors()
+		if len(errors) == 0 {
+			t.Errorf("expected parser errors for %q, got none", tt.input)
+			continue
+		}
+
+		err := errors[0]
+		if err.Line != tt.expectedLine || err.Column != tt.expectedColumn {
+			t.Errorf("wrong position for %q (%s). expected=%d:%d, got=%d:%d",
+				tt.input, err.Message, tt.expectedLine, tt.expectedColumn,
+				err.Line, err.Column)
+		}
+	}
+}
+
 func TestFunctionLiteralParsing(t *testing.T) {
 	input := `fn(x, y) { x + y; }`
 
@@ -475,6 +909,84 @@ func TestFunctionLiteralParsing(t *testing.T) {
 	testInfixExpressions(t, bodyStmt.Expression, "x", "+", "y")
 }
 
+func TestMacroLiteralParsing(t *testing.T) {
+	input := `macro(x, y) { x + y; }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	macro, ok := stmt.Expression.(*ast.MacroLiteral)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.MacroLiteral. got=%T",
+			stmt.Expression)
+	}
+
+	if len(macro.Parameters) != 2 {
+		t.Fatalf("macro literal parameters wrong. want 2, got=%d\n",
+			len(macro.Parameters))
+	}
+
+	testLiteralExpression(t, macro.Parameters[0], "x")
+	testLiteralExpression(t, macro.Parameters[1], "y")
+
+	if len(macro.Body.Statements) != 1 {
+		t.Fatalf("macro.Body.Statements has not 1 statements. got=%d\n",
+			len(macro.Body.Statements))
+	}
+
+	bodyStmt, ok := macro.Body.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("macro body stmt is not ast.ExpressionStatement. got=%T",
+			macro.Body.Statements[0])
+	}
+
+	testInfixExpressions(t, bodyStmt.Expression, "x", "+", "y")
+}
+
+func TestFunctionLiteralWithName(t *testing.T) {
+	input := `let myFunction = fn() { };`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.LetStatement. got=%T",
+			program.Statements[0])
+	}
+
+	function, ok := stmt.Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("stmt.Value is not ast.FunctionLiteral. got=%T",
+			stmt.Value)
+	}
+
+	if function.Name != "myFunction" {
+		t.Fatalf("function literal name wrong. want 'myFunction', got=%q\n",
+			function.Name)
+	}
+}
+
 func TestFunctionParameterParsing(t *testing.T) {
 	tests := []struct {
 		input          string
@@ -594,6 +1106,48 @@ func TestParsingArrayIndexExpression(t *testing.T) {
 	}
 }
 
+func TestParsingSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"myArray[1:3]", "(myArray[1:3])"},
+		{"myArray[:3]", "(myArray[:3])"},
+		{"myArray[1:]", "(myArray[1:])"},
+		{"myArray[:]", "(myArray[:])"},
+		{"myArray[-2:a + 1]", "(myArray[(-2):(a + 1)])"},
+		{"a[1:2][0]", "((a[1:2])[0])"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	program := New(lexer.New("myArray[1:]")).ParseProgram()
+	stmt, _ := program.Statements[0].(*ast.ExpressionStatement)
+	slice, ok := stmt.Expression.(*ast.SliceExpression)
+	if !ok {
+		t.Fatalf("exp not ast.SliceExpression, got=%T", stmt.Expression)
+	}
+
+	if !testIdentifier(t, slice.Left, "myArray") ||
+		!testIntegerLiteral(t, slice.Low, 1) {
+		return
+	}
+
+	if slice.High != nil {
+		t.Errorf("slice.High is not nil. got=%s", slice.High)
+	}
+}
+
 func TestParsingEmptyHashLiteral(t *testing.T) {
 	input := `{}`
 
@@ -649,6 +1203,17 @@ func TestParsingHashLiteralsStringKeys(t *testing.T) {
 
 		testIntegerLiteral(t, value, expectedValue)
 	}
+
+	for i, want := range []string{"one", "two", "three"} {
+		if hash.Keys[i].String() != want {
+			t.Errorf("hash.Keys[%d] wrong. want=%q, got=%q",
+				i, want, hash.Keys[i].String())
+		}
+	}
+
+	if hash.String() != "{one:1, two:2, three:3}" {
+		t.Errorf("hash.String() not in source order. got=%q", hash.String())
+	}
 }
 
 func TestParsingHashLiteralsIntegerKeys(t *testing.T) {
@@ -0,0 +1,53 @@
+package repl
+
+import (
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+const (
+	GREEN   = "\033[32m"
+	YELLOW  = "\033[33m"
+	MAGENTA = "\033[35m"
+	CYAN    = "\033[36m"
+	GRAY    = "\033[90m"
+)
+
+// typeColors are the colors results are printed in, by type. Types not
+// listed, like functions, are printed plainly.
+var typeColors = map[object.ObjectType]string{
+	object.INTEGER_OBJ: YELLOW,
+	object.BIGINT_OBJ:  YELLOW,
+	object.FLOAT_OBJ:   YELLOW,
+	object.STRING_OBJ:  GREEN,
+	object.BOOLEAN_OBJ: CYAN,
+	object.NULL_OBJ:    GRAY,
+	object.ARRAY_OBJ:   MAGENTA,
+	object.HASH_OBJ:    BLUE,
+}
+
+// colorize returns the Inspect output of obj in the color of its type.
+// Strings are quoted so they can't be mistaken for other values.
+func colorize(obj object.Object) string {
+	text := obj.Inspect()
+	if str, ok := obj.(*object.String); ok {
+		text = strconv.Quote(str.Value)
+	}
+
+	color, ok := typeColors[obj.Type()]
+	if !ok {
+		return text
+	}
+
+	return color + text + RESET
+}
+
+// isTerminalWriter reports whether out writes to a terminal, where escape
+// codes are shown as colors rather than copied as text.
+func isTerminalWriter(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	return ok && isTerminal(int(f.Fd()))
+}
@@ -0,0 +1,69 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// maxHistory is how many of the most recent lines are recalled from the
+// history file.
+const maxHistory = 1000
+
+// history holds the lines entered so far, oldest first, and appends new
+// ones to a file so they survive a restart. With an empty path it is only
+// kept in memory.
+type history struct {
+	path  string
+	lines []string
+}
+
+// loadHistory reads the history file at path. A file that doesn't exist yet
+// is an empty history.
+func loadHistory(path string) (*history, error) {
+	h := &history{path: path}
+	if path == "" {
+		return h, nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		h.lines = append(h.lines, scanner.Text())
+	}
+	if len(h.lines) > maxHistory {
+		h.lines = h.lines[len(h.lines)-maxHistory:]
+	}
+
+	return h, scanner.Err()
+}
+
+// add records line, skipping blank lines and repeats of the previous line.
+// Failing to write the file only loses persistence, so it isn't reported.
+func (h *history) add(line string) {
+	if line == "" || (len(h.lines) > 0 && h.lines[len(h.lines)-1] == line) {
+		return
+	}
+
+	h.lines = append(h.lines, line)
+	if h.path == "" {
+		return
+	}
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	f.WriteString(line + "\n")
+}
@@ -0,0 +1,260 @@
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// lineReader reads one line of input after showing prompt.
+type lineReader interface {
+	readLine(prompt string) (string, error)
+}
+
+// completer returns the words that could complete prefix.
+type completer func(prefix string) []string
+
+// newLineReader returns a line editor with history and completion when in
+// is a terminal, and a plain reader otherwise, so piped input keeps working.
+func newLineReader(in io.Reader, out io.Writer, h *history, complete completer) lineReader {
+	if f, ok := in.(*os.File); ok && isTerminal(int(f.Fd())) {
+		return &lineEditor{
+			in:       bufio.NewReader(f),
+			out:      out,
+			fd:       int(f.Fd()),
+			history:  h,
+			complete: complete,
+		}
+	}
+
+	return newScannerReader(in, out)
+}
+
+func newScannerReader(in io.Reader, out io.Writer) *scannerReader {
+	return &scannerReader{scanner: bufio.NewScanner(in), out: out}
+}
+
+type scannerReader struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+}
+
+func (r *scannerReader) readLine(prompt string) (string, error) {
+	fmt.Fprint(r.out, prompt)
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+
+	return r.scanner.Text(), nil
+}
+
+const (
+	keyCtrlA     = 1
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyBackspace = 8
+	keyTab       = 9
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// lineEditor reads lines from a terminal in raw mode, supporting cursor
+// movement, recalling history with the up and down arrows and completing
+// words with tab. The terminal is only in raw mode while a line is being
+// read, so program output is unaffected.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int
+	history  *history
+	complete completer
+}
+
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	var line []rune
+	pos := 0
+	// index is the history entry shown, len(e.history.lines) being the line
+	// the user was typing, saved in pending while browsing.
+	index := len(e.history.lines)
+	pending := ""
+
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\033[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\033[%dD", back)
+		}
+	}
+	show := func(s string) {
+		line = []rune(s)
+		pos = len(line)
+		redraw()
+	}
+
+	io.WriteString(e.out, prompt)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			io.WriteString(e.out, "\r\n")
+			e.history.add(string(line))
+			return string(line), nil
+
+		case keyCtrlC:
+			io.WriteString(e.out, "^C\r\n")
+			line, pos = nil, 0
+			index = len(e.history.lines)
+			io.WriteString(e.out, prompt)
+
+		case keyCtrlD:
+			if len(line) == 0 {
+				io.WriteString(e.out, "\r\n")
+				return "", io.EOF
+			}
+
+		case keyCtrlA:
+			pos = 0
+			redraw()
+
+		case keyCtrlE:
+			pos = len(line)
+			redraw()
+
+		case keyTab:
+			start := wordStart(line, pos)
+			prefix := string(line[start:pos])
+			candidates := e.complete(prefix)
+
+			common := longestCommonPrefix(candidates)
+			if len(common) > len(prefix) {
+				insert := []rune(common[len(prefix):])
+				line = append(line[:pos], append(insert, line[pos:]...)...)
+				pos += len(insert)
+				redraw()
+			} else if len(candidates) > 1 {
+				fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+				redraw()
+			}
+
+		case keyBackspace, keyDelete:
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+				redraw()
+			}
+
+		case keyEscape:
+			switch e.readEscape() {
+			case 'A':
+				if index > 0 {
+					if index == len(e.history.lines) {
+						pending = string(line)
+					}
+					index--
+					show(e.history.lines[index])
+				}
+			case 'B':
+				if index < len(e.history.lines) {
+					index++
+					if index == len(e.history.lines) {
+						show(pending)
+					} else {
+						show(e.history.lines[index])
+					}
+				}
+			case 'C':
+				if pos < len(line) {
+					pos++
+					redraw()
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+					redraw()
+				}
+			case 'H':
+				pos = 0
+				redraw()
+			case 'F':
+				pos = len(line)
+				redraw()
+			}
+
+		default:
+			if r < ' ' {
+				continue
+			}
+			line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+			pos++
+			redraw()
+		}
+	}
+}
+
+// wordStart returns where the identifier ending at pos in line starts.
+func wordStart(line []rune, pos int) int {
+	start := pos
+	for start > 0 && isIdentRune(line[start-1]) {
+		start--
+	}
+
+	return start
+}
+
+func isIdentRune(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || r == '_'
+}
+
+// longestCommonPrefix returns the longest prefix all of words share.
+func longestCommonPrefix(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	return prefix
+}
+
+// readEscape reads the rest of an escape sequence like "\033[A" and returns
+// its final byte, or 0 for sequences the editor doesn't handle.
+func (e *lineEditor) readEscape() byte {
+	b, err := e.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0
+	}
+
+	// Parameters, like the 3 in "\033[3~", come before the final byte.
+	for {
+		b, err = e.in.ReadByte()
+		if err != nil {
+			return 0
+		}
+		if b < '0' || b > '9' {
+			if b == ';' {
+				continue
+			}
+			return b
+		}
+	}
+}
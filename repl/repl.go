@@ -1,21 +1,30 @@
 package repl
 
 import (
-	"bufio"
 	"fmt"
 	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/ZeroBl21/go-interpreter/ast"
 	"github.com/ZeroBl21/go-interpreter/compiler"
+	"github.com/ZeroBl21/go-interpreter/evaluator"
 	"github.com/ZeroBl21/go-interpreter/lexer"
 	"github.com/ZeroBl21/go-interpreter/object"
 	"github.com/ZeroBl21/go-interpreter/parser"
+	"github.com/ZeroBl21/go-interpreter/token"
 	"github.com/ZeroBl21/go-interpreter/vm"
 )
 
 const (
 	RESET  = "\033[0m"
+	RED    = "\033[31m"
 	BLUE   = "\033[34m"
 	PROMPT = BLUE + ">> " + RESET
+	// CONTINUATION_PROMPT asks for the rest of an unfinished input.
+	CONTINUATION_PROMPT = BLUE + ".. " + RESET
 )
 
 const MONKEY_FACE = `            __,__
@@ -31,61 +40,539 @@ const MONKEY_FACE = `            __,__
            '-----'
 `
 
-func Start(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
+// session is the state one REPL keeps between inputs: the compiler's symbol
+// table and constants, and the VM holding the globals.
+type session struct {
+	out io.Writer
+	// interactive is whether someone is typing at the prompt, as opposed
+	// to a script being piped in.
+	interactive bool
+	// colors is whether to use escape codes, which only make sense when
+	// out is a terminal.
+	colors      bool
+	constants   []object.Object
+	symbolTable *compiler.SymbolTable
+	// macroEnv holds the macros defined so far.
+	macroEnv *object.Environment
+	// One VM runs every input, keeping the globals between them.
+	machine *vm.VM
 
-	constants := []object.Object{}
-	globals := make([]object.Object, vm.GlobalSize)
+	// timing is whether to report how long each input took, as measured
+	// by the last eval.
+	timing               bool
+	compileTime, runTime time.Duration
+}
+
+func newSession(out io.Writer) *session {
+	s := &session{
+		out:         out,
+		interactive: true,
+		colors:      isTerminalWriter(out),
+	}
+	s.reset()
+
+	return s
+}
+
+// reset returns the session to its starting state, with only the builtins
+// defined.
+func (s *session) reset() {
 	symbolTable := compiler.NewSymbolTable()
 	for i, v := range object.Builtins {
 		symbolTable.DefineBuiltin(i, v.Name)
 	}
 
+	s.symbolTable = symbolTable
+	s.constants = []object.Object{}
+	s.macroEnv = object.NewEnvironment()
+	s.machine = nil
+}
+
+// Option configures the REPL started by Start.
+type Option func(*config)
+
+type config struct {
+	historyFile string
+	mode        Mode
+}
+
+// Mode says whether the REPL is used interactively or runs a script.
+type Mode int
+
+const (
+	// ModeAuto is interactive when both input and output are terminals.
+	ModeAuto Mode = iota
+	// ModeInteractive shows prompts and edits lines at a terminal.
+	ModeInteractive
+	// ModeScript prints only what the program prints and the results of
+	// its inputs, without prompts, banners or colors.
+	ModeScript
+)
+
+// WithMode forces the REPL into mode instead of detecting it.
+func WithMode(mode Mode) Option {
+	return func(c *config) {
+		c.mode = mode
+	}
+}
+
+// IsInteractive reports whether Start in ModeAuto treats in and out as an
+// interactive session, so callers can decide whether to greet the user.
+func IsInteractive(in io.Reader, out io.Writer) bool {
+	f, ok := in.(*os.File)
+	return ok && isTerminal(int(f.Fd())) && isTerminalWriter(out)
+}
+
+// WithHistoryFile keeps the lines entered at a terminal in the file at path,
+// and recalls them with the up arrow in later sessions. Without it history
+// only lasts for the session.
+func WithHistoryFile(path string) Option {
+	return func(c *config) {
+		c.historyFile = path
+	}
+}
+
+func Start(in io.Reader, out io.Writer, opts ...Option) {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	s := newSession(out)
+	switch cfg.mode {
+	case ModeAuto:
+		s.interactive = IsInteractive(in, out)
+	case ModeScript:
+		s.interactive = false
+	}
+	s.colors = s.colors && s.interactive
+
+	var reader lineReader
+	if s.interactive {
+		h, err := loadHistory(cfg.historyFile)
+		if err != nil {
+			s.printError(fmt.Sprintf("could not load history: %s", err))
+		}
+		reader = newLineReader(in, out, h, s.complete)
+	} else {
+		reader = newScannerReader(in, out)
+	}
+
 	for {
-		fmt.Fprintf(out, PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
+		input, ok := s.readInput(reader)
+		if !ok {
 			return
 		}
 
-		line := scanner.Text()
-		l := lexer.New(line)
-		p := parser.New(l)
-
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+		if strings.HasPrefix(input, ":") {
+			s.command(input)
 			continue
 		}
 
-		comp := compiler.NewWithState(symbolTable, constants)
-		if err := comp.Compile(program); err != nil {
-			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n",
-				err)
-			continue
+		if result, ok := s.eval(input); ok && result != nil {
+			s.printResult(result)
+			if s.timing {
+				fmt.Fprintf(out, "compiled in %s, ran in %s\n",
+					s.compileTime, s.runTime)
+			}
+		}
+	}
+}
+
+// command runs a REPL command, a line starting with a colon.
+func (s *session) command(input string) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(input), " ")
+	arg = strings.TrimSpace(arg)
+
+	switch name {
+	case ":load":
+		if arg == "" {
+			s.printError("usage: :load <path>")
+			return
+		}
+		s.load(arg)
+
+	case ":ast":
+		if arg == "" {
+			s.printError("usage: :ast <input>")
+			return
+		}
+		if program, ok := s.parse(arg); ok {
+			io.WriteString(s.out, ast.Dump(program))
+		}
+
+	case ":save":
+		if arg == "" {
+			s.printError("usage: :save <path>")
+			return
+		}
+		if err := s.save(arg); err != nil {
+			s.printError(fmt.Sprintf("could not save: %s", err))
+			return
+		}
+		fmt.Fprintf(s.out, "session saved to %s\n", arg)
+
+	case ":restore":
+		if arg == "" {
+			s.printError("usage: :restore <path>")
+			return
+		}
+		if err := s.restore(arg); err != nil {
+			s.printError(fmt.Sprintf("could not restore: %s", err))
+			return
+		}
+		fmt.Fprintf(s.out, "session restored from %s\n", arg)
+
+	case ":reset":
+		s.reset()
+		io.WriteString(s.out, "session reset\n")
+
+	case ":env":
+		if arg != "" && arg != "all" {
+			s.printError("usage: :env [all]")
+			return
+		}
+		s.env(arg == "all")
+
+	case ":time":
+		switch arg {
+		case "on", "off":
+			s.timing = arg == "on"
+		default:
+			s.printError("usage: :time on|off")
+		}
+
+	case ":tokens":
+		s.tokens(arg)
+
+	case ":bytecode":
+		if arg == "" {
+			s.printError("usage: :bytecode <input>")
+			return
+		}
+		s.bytecode(arg)
+
+	default:
+		s.printError(fmt.Sprintf("unknown command %s", name))
+	}
+}
+
+// load runs the source file at path as if it had been typed at the prompt,
+// so its definitions become available. Its result isn't printed.
+func (s *session) load(path string) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		s.printError(fmt.Sprintf("could not load: %s", err))
+		return
+	}
+
+	s.eval(string(source))
+}
+
+// eval compiles and runs input, reporting any error to the output. ok is
+// false if there was one.
+func (s *session) eval(input string) (result object.Object, ok bool) {
+	start := time.Now()
+	code, ok := s.compile(input, s.symbolTable, s.constants, s.macroEnv)
+	if !ok {
+		return nil, false
+	}
+	s.constants = code.Constants
+	s.compileTime = time.Since(start)
+
+	if s.machine == nil {
+		s.machine = vm.New(code, vm.WithOutput(s.out))
+	} else {
+		s.machine.Reset(code)
+	}
+
+	start = time.Now()
+	err := s.machine.Run()
+	s.runTime = time.Since(start)
+	if err != nil {
+		if errObj, ok := err.(*object.Error); ok {
+			s.printRuntimeError(errObj)
+			return nil, false
+		}
+
+		fmt.Fprintf(s.out, "Woops! Executing bytecode failed:\n%s\n",
+			err)
+		return nil, false
+	}
+
+	return s.machine.LastPoppedStackElem(), true
+}
+
+// parse parses input, reporting any errors to the output. ok is false if
+// there were some.
+func (s *session) parse(input string) (program *ast.Program, ok bool) {
+	l := lexer.New(input)
+	p := parser.New(l)
+
+	program = p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		s.printParserErrors(input, p.ParseErrors())
+		return nil, false
+	}
+
+	return program, true
+}
+
+// compile parses input, expands its macros and compiles it against
+// symbolTable, constants and the macros in macroEnv, reporting any error to
+// the output. ok is false if there was one.
+func (s *session) compile(
+	input string,
+	symbolTable *compiler.SymbolTable,
+	constants []object.Object,
+	macroEnv *object.Environment,
+) (code *compiler.Bytecode, ok bool) {
+	program, ok := s.parse(input)
+	if !ok {
+		return nil, false
+	}
+
+	evaluator.DefineMacros(program, macroEnv)
+	if _, err := evaluator.ExpandMacros(program, macroEnv); err != nil {
+		fmt.Fprintf(s.out, "Woops! Macro expansion failed:\n %s\n", err)
+		return nil, false
+	}
+
+	comp := compiler.NewWithState(symbolTable, constants,
+		compiler.WithOptimizations(compiler.OptimizeAggressive))
+	if err := comp.Compile(program); err != nil {
+		fmt.Fprintf(s.out, "Woops! Compilation failed:\n %s\n",
+			err)
+		return nil, false
+	}
+
+	// The compiler runs the peephole pass over each function as it finishes
+	// it, so functions compiled for earlier inputs are left alone.
+	return comp.Bytecode(), true
+}
+
+// env prints the globals defined in the session with their current values,
+// and with all the builtins too.
+//
+//	>> let a = 1; let b = [a, "two"];
+//	>> :env
+//	a = 1
+//	b = [1, two]
+func (s *session) env(all bool) {
+	var globals []object.Object
+	if s.machine != nil {
+		globals = s.machine.Globals()
+	}
+
+	for _, symbol := range s.symbolTable.Definitions() {
+		// A failed compilation can define a name that was never set.
+		value := "(not set)"
+		if symbol.Index < len(globals) && globals[symbol.Index] != nil {
+			value = globals[symbol.Index].Inspect()
+		}
+		fmt.Fprintf(s.out, "%s = %s\n", symbol.Name, value)
+	}
+
+	if !all {
+		return
+	}
+	for _, symbol := range s.symbolTable.Symbols(compiler.BuiltinScope) {
+		fmt.Fprintf(s.out, "%s = builtin function\n", symbol.Name)
+	}
+}
+
+// complete returns the globals, builtins and keywords starting with prefix,
+// sorted. An empty prefix completes nothing rather than everything.
+func (s *session) complete(prefix string) []string {
+	if prefix == "" {
+		return nil
+	}
+
+	var words []string
+	for _, word := range token.Keywords() {
+		if strings.HasPrefix(word, prefix) {
+			words = append(words, word)
+		}
+	}
+	for _, scope := range []compiler.SymbolScope{compiler.GlobalScope, compiler.BuiltinScope} {
+		for _, symbol := range s.symbolTable.Symbols(scope) {
+			if strings.HasPrefix(symbol.Name, prefix) {
+				words = append(words, symbol.Name)
+			}
 		}
+	}
+	sort.Strings(words)
 
-		code := comp.Bytecode()
-		constants = code.Constants
+	return words
+}
 
-		machine := vm.NewWithGlobalsStore(code, globals)
-		if err := machine.Run(); err != nil {
-			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n%s\n",
-				err)
+// tokens prints the tokens of input one per line with their position,
+// highlighting the ones the lexer didn't recognize.
+func (s *session) tokens(input string) {
+	for _, tok := range lexer.New(input).Tokens() {
+		line := fmt.Sprintf("%d:%-4d %-10s %q", tok.Line, tok.Column,
+			tok.Type, tok.Literal)
+		if tok.Type == token.ILLEGAL {
+			line = s.paint(RED, line)
 		}
+		io.WriteString(s.out, line+"\n")
+	}
+}
+
+// bytecode compiles input and prints its instructions and the constants it
+// adds, without running it. It compiles against copies of the session's
+// state, so definitions in input aren't kept.
+func (s *session) bytecode(input string) {
+	// Limiting the capacity makes the compiler's appends copy instead of
+	// writing into the session's backing array.
+	constants := s.constants[:len(s.constants):len(s.constants)]
+
+	macroEnv := object.NewEnclosedEnvironment(s.macroEnv)
+	code, ok := s.compile(input, s.symbolTable.Copy(), constants, macroEnv)
+	if !ok {
+		return
+	}
 
-		lastPopped := machine.LastPoppedStackElem()
-		io.WriteString(out, lastPopped.Inspect())
-		io.WriteString(out, "\n")
+	io.WriteString(s.out, code.Disassemble())
+
+	if len(code.Constants) == len(constants) {
+		return
+	}
+
+	io.WriteString(s.out, "\nConstants:\n")
+	for i := len(constants); i < len(code.Constants); i++ {
+		switch constant := code.Constants[i].(type) {
+		case *object.CompiledFunction:
+			fmt.Fprintf(s.out, "%d: fn(%d params, %d locals)\n",
+				i, constant.NumParameters, constant.NumLocals)
+			ins := compiler.Disassemble(constant.Instructions, code.Constants)
+			for _, line := range strings.Split(strings.TrimSuffix(ins, "\n"), "\n") {
+				fmt.Fprintf(s.out, "    %s\n", line)
+			}
+		case *object.String:
+			fmt.Fprintf(s.out, "%d: %q\n", i, constant.Value)
+		default:
+			fmt.Fprintf(s.out, "%d: %s\n", i, constant.Inspect())
+		}
 	}
 }
 
-func printParserErrors(out io.Writer, errors []string) {
-	io.WriteString(out, MONKEY_FACE)
-	io.WriteString(out, "Woops! We ran into some monkey business here\n")
-	io.WriteString(out, " parser errors:\n")
+// printResult prints the value an input evaluated to, colored by type when
+// colors are on.
+func (s *session) printResult(result object.Object) {
+	text := result.Inspect()
+	if s.colors {
+		text = colorize(result)
+	}
 
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
+	io.WriteString(s.out, text+"\n")
+}
+
+func (s *session) printError(msg string) {
+	io.WriteString(s.out, s.paint(RED, msg)+"\n")
+}
+
+// paint returns text in color if colors are on, and unchanged otherwise.
+func (s *session) paint(color, text string) string {
+	if !s.colors {
+		return text
+	}
+
+	return color + text + RESET
+}
+
+// readInput reads one line, and more lines for as long as the input has
+// unclosed braces, parentheses or brackets, so a function can be typed or
+// pasted across lines. When interactive, an empty continuation line ends the
+// input early, leaving the parser to report what's missing.
+func (s *session) readInput(reader lineReader) (string, bool) {
+	prompt, continuation := "", ""
+	switch {
+	case s.colors:
+		prompt, continuation = PROMPT, CONTINUATION_PROMPT
+	case s.interactive:
+		prompt, continuation = ">> ", ".. "
+	}
+
+	input, err := reader.readLine(prompt)
+	if err != nil {
+		return "", false
+	}
+
+	for isIncomplete(input) {
+		line, err := reader.readLine(continuation)
+		if err != nil || (s.interactive && line == "") {
+			break
+		}
+		input += "\n" + line
+	}
+
+	return input, true
+}
+
+// isIncomplete reports whether input opens more delimiters than it closes.
+func isIncomplete(input string) bool {
+	l := lexer.New(input)
+
+	depth := 0
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.LBRACE, token.LPAREN, token.LBRACKET:
+			depth++
+		case token.RBRACE, token.RPAREN, token.RBRACKET:
+			depth--
+		}
+	}
+
+	return depth > 0
+}
+
+func (s *session) printRuntimeError(err *object.Error) {
+	msg := err.Inspect()
+	if err.Line > 0 {
+		msg = fmt.Sprintf("runtime error at line %d: %s", err.Line, err.Message)
+	}
+
+	s.printError(msg)
+
+	// A trace of just the main program says nothing the line doesn't.
+	if trace := err.StackTrace(); len(trace) > 1 {
+		for _, frame := range trace {
+			fmt.Fprintf(s.out, "    at %s\n", frame)
+		}
+	}
+}
+
+func (s *session) printParserErrors(input string, errors []parser.ParseError) {
+	if s.interactive {
+		io.WriteString(s.out, MONKEY_FACE)
+	}
+	io.WriteString(s.out, "Woops! We ran into some monkey business here\n")
+	io.WriteString(s.out, " parser errors:\n")
+
+	lines := strings.Split(input, "\n")
+	for _, err := range errors {
+		io.WriteString(s.out, "\t"+err.Message+"\n")
+
+		if err.Line < 1 || err.Line > len(lines) {
+			continue
+		}
+		io.WriteString(s.out, "\t\t"+lines[err.Line-1]+"\n")
+		io.WriteString(s.out, "\t\t"+caret(lines[err.Line-1], err.Column)+
+			s.paint(RED, "^")+"\n")
+	}
+}
+
+// caret returns the indentation that puts a marker under column of source.
+// Tabs are kept so it lines up however wide the terminal shows them.
+func caret(source string, column int) string {
+	var b strings.Builder
+	for i := 0; i < column-1; i++ {
+		if i < len(source) && source[i] == '\t' {
+			b.WriteByte('\t')
+		} else {
+			b.WriteByte(' ')
+		}
 	}
+	return b.String()
 }
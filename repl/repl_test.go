@@ -0,0 +1,249 @@
+package repl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ZeroBl21/go-interpreter/object"
+)
+
+func TestNoColorsWhenNotATerminal(t *testing.T) {
+	input := `1
+"two"
+[1, 2]
+{"a": true}
+let f = fn() { -"s" }; f()
+let = 1
+:tokens @
+`
+
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+
+	if strings.Contains(out.String(), "\033") {
+		t.Errorf("output contains escape codes:\n%q", out.String())
+	}
+
+	for _, want := range []string{"1\n", "two\n", "[1, 2]\n", "{a: true}\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestColorize(t *testing.T) {
+	tests := []struct {
+		obj      object.Object
+		expected string
+	}{
+		{&object.Integer{Value: 1}, YELLOW + "1" + RESET},
+		{&object.Float{Value: 1.5}, YELLOW + "1.5" + RESET},
+		{&object.String{Value: "a"}, GREEN + `"a"` + RESET},
+		{object.TRUE, CYAN + "true" + RESET},
+		{object.NULL, GRAY + "null" + RESET},
+		{&object.Array{Elements: []object.Object{}}, MAGENTA + "[]" + RESET},
+		{&object.Builtin{}, "builtin function"},
+	}
+
+	for _, tt := range tests {
+		if got := colorize(tt.obj); got != tt.expected {
+			t.Errorf("colorize(%s) wrong. want=%q, got=%q",
+				tt.obj.Inspect(), tt.expected, got)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	var out bytes.Buffer
+	s := newSession(&out)
+	s.eval("let first_name = 1; let fizz = 2;")
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"fi", []string{"filter", "first", "first_name", "fizz"}},
+		{"fir", []string{"first", "first_name"}},
+		{"le", []string{"len", "let"}},
+		{"wh", []string{"while"}},
+		{"zz", nil},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		got := s.complete(tt.prefix)
+		if strings.Join(got, " ") != strings.Join(tt.expected, " ") {
+			t.Errorf("complete(%q) wrong. want=%v, got=%v",
+				tt.prefix, tt.expected, got)
+		}
+	}
+}
+
+func TestLongestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		words    []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"first"}, "first"},
+		{[]string{"first", "first_name"}, "first"},
+		{[]string{"filter", "first", "fizz"}, "fi"},
+		{[]string{"len", "push"}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := longestCommonPrefix(tt.words); got != tt.expected {
+			t.Errorf("longestCommonPrefix(%v) wrong. want=%q, got=%q",
+				tt.words, tt.expected, got)
+		}
+	}
+}
+
+func TestEarlierFunctionsUnchanged(t *testing.T) {
+	s := newSession(&bytes.Buffer{})
+	if _, ok := s.eval("let f = fn(x) { x; 1 }"); !ok {
+		t.Fatalf("eval failed")
+	}
+
+	var fn *object.CompiledFunction
+	for _, constant := range s.constants {
+		if f, ok := constant.(*object.CompiledFunction); ok {
+			fn = f
+		}
+	}
+	if fn == nil {
+		t.Fatalf("no function in the constants: %v", s.constants)
+	}
+	instructions := fn.Instructions
+
+	for _, input := range []string{"f(1)", "let g = fn() { 2; 3 }; g()"} {
+		if _, ok := s.eval(input); !ok {
+			t.Fatalf("eval of %q failed", input)
+		}
+	}
+
+	if &fn.Instructions[0] != &instructions[0] {
+		t.Errorf("function of an earlier input was rewritten:\n%s",
+			fn.Instructions)
+	}
+}
+
+func TestModes(t *testing.T) {
+	input := "let f = fn(x) {\n\n  x * 2\n};\nf(21)\nlet = 1\n"
+
+	tests := []struct {
+		mode     Mode
+		expected []string
+		absent   []string
+	}{
+		{ModeScript, []string{"42\n"}, []string{">> ", ".. ", MONKEY_FACE}},
+		{ModeAuto, []string{"42\n"}, []string{">> ", MONKEY_FACE}},
+		{ModeInteractive, []string{">> ", ".. ", MONKEY_FACE}, nil},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		Start(strings.NewReader(input), &out, WithMode(tt.mode))
+
+		for _, want := range tt.expected {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("mode %d: output doesn't contain %q:\n%s",
+					tt.mode, want, out.String())
+			}
+		}
+		for _, unwanted := range tt.absent {
+			if strings.Contains(out.String(), unwanted) {
+				t.Errorf("mode %d: output contains %q:\n%s",
+					tt.mode, unwanted, out.String())
+			}
+		}
+	}
+}
+
+func TestSaveRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session")
+
+	saved := `let base = 10;
+let add = fn(x) { x + base };
+let make = fn(n) { fn() { n * 2 } };
+let twice = make(21);
+let config = {"name": "monkey", "sizes": [1, 2]};
+let count = len;
+:save ` + path + "\n"
+
+	var out bytes.Buffer
+	Start(strings.NewReader(saved), &out, WithMode(ModeScript))
+	if want := "session saved to " + path + "\n"; !strings.HasSuffix(out.String(), want) {
+		t.Fatalf("wrong output saving. want suffix=%q, got=%q", want, out.String())
+	}
+
+	restored := `:restore ` + path + `
+add(5)
+twice()
+config["sizes"]
+count("four")
+let base = 100;
+add(5)
+`
+	out.Reset()
+	Start(strings.NewReader(restored), &out, WithMode(ModeScript))
+
+	expected := "session restored from " + path + "\n15\n42\n[1, 2]\n4\n100\n105\n"
+	if out.String() != expected {
+		t.Errorf("wrong output after restoring.\nwant=%q\ngot =%q",
+			expected, out.String())
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	s := newSession(&bytes.Buffer{})
+	s.eval("let a = 1;")
+	valid := filepath.Join(dir, "valid")
+	if err := s.save(valid); err != nil {
+		t.Fatalf("save error: %s", err)
+	}
+	data, _ := os.ReadFile(valid)
+
+	newer := append([]byte{}, data...)
+	newer[5]++
+	// The constants follow the symbol table section.
+	symbolsLen := int(data[6])<<24 | int(data[7])<<16 | int(data[8])<<8 | int(data[9])
+	oldBytecode := append([]byte{}, data...)
+	oldBytecode[10+symbolsLen+4+5] = 2
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"text", []byte("let a = 1;"), "not a saved session"},
+		{"newer", newer, "unsupported session version 2, want 1"},
+		{"old-bytecode", oldBytecode, "unsupported bytecode version 2, want 4"},
+		{"truncated", data[:len(data)-1], "invalid globals: unexpected EOF"},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		os.WriteFile(path, tt.data, 0o644)
+
+		err := s.restore(path)
+		if err == nil {
+			t.Errorf("%s: expected error %q, got none", tt.name, tt.expected)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%s: wrong error. want=%q, got=%q",
+				tt.name, tt.expected, err)
+		}
+	}
+
+	// A failed restore leaves the session alone.
+	if result, ok := s.eval("a"); !ok || result.Inspect() != "1" {
+		t.Errorf("session changed by a failed restore. got=%v", result)
+	}
+}
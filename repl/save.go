@@ -0,0 +1,115 @@
+package repl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ZeroBl21/go-interpreter/code"
+	"github.com/ZeroBl21/go-interpreter/compiler"
+	"github.com/ZeroBl21/go-interpreter/object"
+	"github.com/ZeroBl21/go-interpreter/vm"
+)
+
+// A saved session starts with sessionMagic and sessionFormatVersion,
+// followed by the symbol table, the constants as bytecode without
+// instructions and the globals, each as a uint32 length and the bytes
+// written by compiler's Marshal functions. Those carry versions of their
+// own, so a change to any of them is caught on restore too.
+var sessionMagic = [4]byte{'M', 'N', 'K', 'R'}
+
+const sessionFormatVersion uint16 = 1
+
+// save writes the definitions of the session to the file at path, so
+// restore can bring them back in a later session. Macros are not saved.
+func (s *session) save(path string) error {
+	var globals []object.Object
+	if s.machine != nil {
+		globals = s.machine.Globals()
+	}
+
+	var symbols, constants, values bytes.Buffer
+	if err := s.symbolTable.Marshal(&symbols); err != nil {
+		return err
+	}
+	bytecode := &compiler.Bytecode{
+		Instructions: code.Instructions{},
+		Constants:    s.constants,
+	}
+	if err := bytecode.Marshal(&constants); err != nil {
+		return err
+	}
+	if err := compiler.MarshalGlobals(&values, globals); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, sessionMagic)
+	binary.Write(&buf, binary.BigEndian, sessionFormatVersion)
+	for _, section := range []*bytes.Buffer{&symbols, &constants, &values} {
+		binary.Write(&buf, binary.BigEndian, uint32(section.Len()))
+		buf.Write(section.Bytes())
+	}
+
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// restore replaces the state of the session with the one saved to the file
+// at path. The session is left as it was if the file can't be restored.
+func (s *session) restore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	var version uint16
+	if err := binary.Read(f, binary.BigEndian, &magic); err != nil || magic != sessionMagic {
+		return errors.New("not a saved session")
+	}
+	if err := binary.Read(f, binary.BigEndian, &version); err != nil {
+		return errors.New("not a saved session")
+	}
+	if version != sessionFormatVersion {
+		return fmt.Errorf("unsupported session version %d, want %d",
+			version, sessionFormatVersion)
+	}
+
+	symbolTable, err := compiler.LoadSymbolTable(readSection(f))
+	if err != nil {
+		return err
+	}
+	bytecode, err := compiler.LoadBytecode(readSection(f))
+	if err != nil {
+		return err
+	}
+	globals, err := compiler.LoadGlobals(readSection(f))
+	if err != nil {
+		return err
+	}
+	if n, _ := f.Read(make([]byte, 1)); n > 0 {
+		return errors.New("unexpected data at the end of the session")
+	}
+
+	s.symbolTable = symbolTable
+	s.constants = bytecode.Constants
+	s.macroEnv = object.NewEnvironment()
+	s.machine = vm.NewWithGlobalsStore(bytecode, globals, vm.WithOutput(s.out))
+
+	return nil
+}
+
+// readSection returns a reader for the next length-prefixed section of r. A
+// truncated section reads short, which the loader reports.
+func readSection(r io.Reader) io.Reader {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return bytes.NewReader(nil)
+	}
+
+	return io.LimitReader(r, int64(n))
+}
@@ -22,3 +22,18 @@ func NewFrame(cl *object.Closure, basePointer int) *Frame {
 func (f *Frame) Instructions() code.Instructions {
 	return f.cl.Fn.Instructions
 }
+
+// Line returns the source line of the instruction at ip, or 0 when the
+// function was compiled without line information.
+func (f *Frame) Line() int {
+	return f.lineAt(f.ip)
+}
+
+func (f *Frame) lineAt(offset int) int {
+	lines := f.cl.Fn.Lines
+	if offset < 0 || offset >= len(lines) {
+		return 0
+	}
+
+	return lines[offset]
+}
@@ -1,7 +1,14 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"strings"
 
 	"github.com/ZeroBl21/go-interpreter/code"
 	"github.com/ZeroBl21/go-interpreter/compiler"
@@ -9,52 +16,205 @@ import (
 )
 
 const (
-	StackSize  = 2048
+	StackSize = 2048
+	// GlobalSize is the number of globals OpSetGlobal's operand can address;
+	// the compiler numbers globals past it with OpSetGlobalWide. A VM's
+	// globals grow on demand, so this is only a convenient size to pre-size
+	// a store for NewWithGlobalsStore.
 	GlobalSize = 65536
 	MaxFrames  = 1024
+
+	// cancelCheckInterval is how many instructions RunContext executes
+	// between checks of its context.
+	cancelCheckInterval = 1024
 )
 
+// ErrBreakpoint is returned by Step and Run when execution reaches a line
+// with a breakpoint, see SetBreakpoint.
+var ErrBreakpoint = errors.New("breakpoint reached")
+
 var (
-	True  = &object.Boolean{Value: true}
-	False = &object.Boolean{Value: false}
-	Null  = &object.Null{}
+	True  = object.TRUE
+	False = object.FALSE
+	Null  = object.NULL
 )
 
 type VM struct {
 	constants []object.Object
 
-	stack []object.Object
-	sp    int // Always points to the next value. Top of stack is stack[sp-1]
+	stack     []object.Object
+	sp        int // Always points to the next value. Top of stack is stack[sp-1]
+	stackSize int
+	underflow bool // set by pop on an empty stack, reported by step
+
+	globals     []object.Object
+	globalNames map[string]int
+
+	frames       []*Frame
+	framesIndex  int
+	maxCallDepth int // number of frames, including the main one
+
+	maxInstructions int // 0 means unlimited
+	instructions    int // instructions dispatched so far
+
+	breakpoints map[int]bool
+	line        int // source line of the next instruction, once reached
+
+	out io.Writer // where output builtins like `puts` write
+
+	overflow           IntegerOverflow
+	falseyZeroAndEmpty bool
+
+	registered   map[string]*object.Builtin // by name, see RegisterBuiltin
+	builtinNames []string                   // Bytecode.Builtins of the program
+}
+
+// Option configures optional VM behaviour, see New.
+type Option func(*VM)
+
+// WithOutput makes builtins like `puts` write to w instead of os.Stdout.
+func WithOutput(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.out = w
+	}
+}
+
+// WithMaxCallDepth limits how many calls may be active at once, counting the
+// main program, to n instead of MaxFrames. Exceeding it is a runtime error.
+// Values below 1 are ignored. Deep recursion can still run out of value
+// stack (see WithStackSize) first, which is reported as a stack overflow.
+func WithMaxCallDepth(n int) Option {
+	return func(vm *VM) {
+		if n >= 1 {
+			vm.maxCallDepth = n
+		}
+	}
+}
+
+// WithStackSize gives the VM a value stack of n slots instead of StackSize.
+// The stack holds every operand and every active call's arguments and locals,
+// so programs with deep non-tail recursion may need more; running out is
+// reported as a stack overflow. Values below 1 are ignored.
+func WithStackSize(n int) Option {
+	return func(vm *VM) {
+		if n >= 1 {
+			vm.stackSize = n
+		}
+	}
+}
+
+// WithMaxInstructions stops the VM with an "instruction limit exceeded"
+// error once it has dispatched n instructions, bounding how long untrusted
+// programs can run. Values below 1 mean no limit, the default.
+func WithMaxInstructions(n int) Option {
+	return func(vm *VM) {
+		vm.maxInstructions = n
+	}
+}
+
+// IntegerOverflow selects what happens when arithmetic on Integers doesn't
+// fit in an int64, see WithIntegerOverflow.
+type IntegerOverflow int
+
+const (
+	// PromoteOnOverflow carries on with an exact BigInt, the default.
+	PromoteOnOverflow IntegerOverflow = iota
+	// ErrorOnOverflow stops with an "integer overflow" runtime error.
+	ErrorOnOverflow
+	// WrapOnOverflow wraps around like int64 arithmetic in Go.
+	WrapOnOverflow
+)
+
+// WithIntegerOverflow sets what +, -, *, /, ** and negation do when their
+// Integer result overflows an int64. Arithmetic on values that are already
+// BigInts is always exact.
+func WithIntegerOverflow(mode IntegerOverflow) Option {
+	return func(vm *VM) {
+		vm.overflow = mode
+	}
+}
+
+// WithFalseyZeroAndEmpty makes 0, 0.0 and "" count as false in conditions
+// and for !, && and ||, like in many scripting languages. By default only
+// false and null do, as in Monkey. Builtins like `filter` and `bool` keep
+// Monkey's rules either way.
+func WithFalseyZeroAndEmpty(on bool) Option {
+	return func(vm *VM) {
+		vm.falseyZeroAndEmpty = on
+	}
+}
+
+func New(bytecode *compiler.Bytecode, opts ...Option) *VM {
+	vm := &VM{
+		stackSize:    StackSize,
+		maxCallDepth: MaxFrames,
+
+		out: os.Stdout,
+	}
+
+	for _, opt := range opts {
+		opt(vm)
+	}
 
-	globals []object.Object
+	vm.stack = make([]object.Object, vm.stackSize)
+	vm.frames = make([]*Frame, vm.maxCallDepth)
+	vm.Reset(bytecode)
 
-	frames      []*Frame
-	framesIndex int
+	return vm
 }
 
-func New(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+// Reset prepares vm to run bytecode, reusing its stack and frames instead of
+// allocating new ones. The globals are kept, like Compiler.Reset keeps the
+// symbol table, so a REPL or server can run program after program on one VM;
+// call ResetGlobals as well to drop them. Options, registered builtins and
+// breakpoints are kept too.
+func (vm *VM) Reset(bytecode *compiler.Bytecode) {
+	mainFn := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		Lines:        bytecode.Lines,
+	}
 	mainClosure := &object.Closure{Fn: mainFn}
-	mainFrame := NewFrame(mainClosure, 0)
 
-	frames := make([]*Frame, MaxFrames)
-	frames[0] = mainFrame
+	vm.constants = bytecode.Constants
+	vm.globalNames = bytecode.Globals
+	vm.builtinNames = bytecode.Builtins
 
-	return &VM{
-		constants: bytecode.Constants,
+	// Drop references left by the previous run so they can be collected.
+	for i := range vm.stack {
+		vm.stack[i] = nil
+	}
+	vm.sp = 0
 
-		stack: make([]object.Object, StackSize),
-		sp:    0,
+	for i := range vm.frames {
+		vm.frames[i] = nil
+	}
+	vm.frames[0] = NewFrame(mainClosure, 0)
+	vm.framesIndex = 1
 
-		globals: make([]object.Object, GlobalSize),
+	vm.instructions = 0
+	vm.line = 0
+}
 
-		frames:      frames,
-		framesIndex: 1,
+// ResetGlobals clears the globals set by earlier runs, for programs that
+// mustn't see each other's state, like ones compiled after
+// Compiler.ResetState. A store passed to NewWithGlobalsStore is cleared in
+// place.
+func (vm *VM) ResetGlobals() {
+	for i := range vm.globals {
+		vm.globals[i] = nil
 	}
 }
 
-func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
-	vm := New(bytecode)
+// NewWithGlobalsStore creates a VM that keeps its globals in s, so they can
+// be carried over from an earlier VM. The VM writes to s in place until a
+// program defines more globals than s holds, and then grows a copy of it;
+// read the globals back with Globals rather than from s.
+func NewWithGlobalsStore(
+	bytecode *compiler.Bytecode,
+	s []object.Object,
+	opts ...Option,
+) *VM {
+	vm := New(bytecode, opts...)
 	vm.globals = s
 
 	return vm
@@ -64,207 +224,647 @@ func (vm *VM) LastPoppedStackElem() object.Object {
 	return vm.stack[vm.sp]
 }
 
+// Run executes the bytecode until the main function finishes. Runtime
+// failures are returned as *object.Error, annotated with the source line of
+// the failing instruction when the bytecode carries line information.
 func (vm *VM) Run() error {
-	var ip int
-	var ins code.Instructions
-	var op code.Opcode
+	return vm.RunContext(context.Background())
+}
 
-	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
-		vm.currentFrame().ip++
+// RunContext is like Run but stops early when ctx is cancelled or its
+// deadline passes, returning ctx.Err(). The context is checked every few
+// instructions, so a cancelled program may run slightly past the deadline.
+func (vm *VM) RunContext(ctx context.Context) error {
+	// A context that can never be cancelled doesn't need checking.
+	checkCtx := ctx.Done() != nil
+	untilCheck := cancelCheckInterval
+
+	for {
+		if checkCtx {
+			if untilCheck--; untilCheck == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				untilCheck = cancelCheckInterval
+			}
+		}
 
-		ip = vm.currentFrame().ip
-		ins = vm.currentFrame().Instructions()
-		op = code.Opcode(ins[ip])
+		done, err := vm.Step()
+		if err != nil || done {
+			return err
+		}
+	}
+}
 
-		switch op {
-		case code.OpConstant:
-			constIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+// Step executes exactly one instruction and reports whether the main
+// function has finished. Errors are reported like Run's; after an error
+// other than ErrBreakpoint the VM must not be stepped further. Run is a loop
+// over Step, so a debugger can interleave Step with the IP, StackTop and
+// Globals accessors and resume with Run.
+func (vm *VM) Step() (done bool, err error) {
+	if vm.finished() {
+		return true, nil
+	}
 
-			if err := vm.push(vm.constants[constIndex]); err != nil {
-				return err
-			}
+	if vm.reachedBreakpoint() {
+		return false, ErrBreakpoint
+	}
 
-		case code.OpPop:
-			vm.pop()
+	if err := vm.step(); err != nil {
+		return false, vm.annotate(err)
+	}
 
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
-			if err := vm.executeBinaryOperation(op); err != nil {
-				return err
-			}
+	return vm.finished(), nil
+}
 
-		case code.OpTrue:
-			if err := vm.push(True); err != nil {
-				return err
-			}
+// annotate sets the line of a runtime error to that of the instruction that
+// failed and records the stack trace, unless the error already has them.
+func (vm *VM) annotate(err error) error {
+	errObj, ok := err.(*object.Error)
+	if !ok {
+		return err
+	}
 
-		case code.OpFalse:
-			if err := vm.push(False); err != nil {
-				return err
-			}
+	if errObj.Line == 0 {
+		errObj.Line = vm.currentFrame().Line()
+	}
+	if errObj.Trace == nil {
+		errObj.Trace = vm.stackTrace()
+	}
 
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
-			if err := vm.executeComparison(op); err != nil {
-				return err
-			}
+	return err
+}
 
-		case code.OpBang:
-			if err := vm.executeBangOperator(); err != nil {
-				return err
-			}
+// stackTrace describes the active frames, innermost first.
+func (vm *VM) stackTrace() []object.StackFrame {
+	trace := make([]object.StackFrame, 0, vm.framesIndex)
 
-		case code.OpMinus:
-			if err := vm.executeMinusOperator(); err != nil {
-				return err
-			}
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+
+		name := frame.cl.Fn.Name
+		switch {
+		case i == 0:
+			name = "<main>"
+		case name == "":
+			name = "<anonymous>"
+		}
+
+		trace = append(trace, object.StackFrame{Function: name, Line: frame.Line()})
+	}
+
+	return trace
+}
+
+// Call calls the function stored in the global name with args and returns
+// its result, so Monkey functions can be used from Go once Run has defined
+// them. Errors are reported like Run's, and leave the VM ready for further
+// calls. Breakpoints are ignored.
+func (vm *VM) Call(name string, args ...object.Object) (object.Object, error) {
+	index, ok := vm.globalNames[name]
+	if !ok {
+		return nil, newError("undefined function %s", name)
+	}
 
-		case code.OpJump:
-			pos := int(code.ReadUint16(ins[ip+1:]))
+	callee := vm.getGlobal(index)
+	switch callee.(type) {
+	case *object.Closure, *object.Builtin:
+	default:
+		return nil, newError("%s is not a function: %s", name, callee.Type())
+	}
+
+	sp, framesIndex := vm.sp, vm.framesIndex
+	result, err := vm.call(callee, args)
+
+	// Drop whatever a failed call left behind.
+	vm.sp, vm.framesIndex = sp, framesIndex
+
+	return result, err
+}
+
+func (vm *VM) call(callee object.Object, args []object.Object) (object.Object, error) {
+	if err := vm.push(callee); err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		if err := vm.push(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	framesIndex := vm.framesIndex
+	if err := vm.executeCall(len(args)); err != nil {
+		return nil, err
+	}
+
+	// A closure runs in a new frame until it returns; a builtin has already
+	// pushed its result.
+	for vm.framesIndex > framesIndex {
+		if err := vm.step(); err != nil {
+			return nil, vm.annotate(err)
+		}
+	}
+
+	return vm.pop(), nil
+}
+
+// IP returns the offset of the instruction Step executes next, within the
+// instructions of the function currently running.
+func (vm *VM) IP() int {
+	return vm.currentFrame().ip + 1
+}
+
+// StackTop returns the value on top of the stack, or nil if it is empty.
+func (vm *VM) StackTop() object.Object {
+	if vm.sp == 0 {
+		return nil
+	}
+
+	return vm.stack[vm.sp-1]
+}
+
+// Globals returns the VM's global variables, indexed like OpGetGlobal's
+// operand. Globals the program hasn't set yet are nil.
+func (vm *VM) Globals() []object.Object {
+	return vm.globals
+}
+
+// SetBreakpoint makes Step and Run stop with ErrBreakpoint before executing
+// the first instruction of source line line, each time execution arrives at
+// it from another line. Calling Step or Run again resumes from there.
+func (vm *VM) SetBreakpoint(line int) {
+	if vm.breakpoints == nil {
+		vm.breakpoints = make(map[int]bool)
+	}
+
+	vm.breakpoints[line] = true
+}
+
+// ClearBreakpoint removes a breakpoint set by SetBreakpoint.
+func (vm *VM) ClearBreakpoint(line int) {
+	delete(vm.breakpoints, line)
+}
+
+// reachedBreakpoint reports whether the next instruction is where execution
+// arrives at a line with a breakpoint. The remaining instructions of that
+// line, including the one it stopped at, don't stop again.
+func (vm *VM) reachedBreakpoint() bool {
+	frame := vm.currentFrame()
+	line := frame.lineAt(frame.ip + 1)
+	if line == vm.line {
+		return false
+	}
+
+	vm.line = line
+	return vm.breakpoints[line]
+}
+
+// RegisterBuiltin makes fn callable from the program as the builtin name,
+// which the compiler must have been told about with
+// Compiler.RegisterBuiltin. Builtins are matched by name, so the order they
+// are registered in doesn't matter. Registering a name again replaces its
+// function. Register builtins before running.
+func (vm *VM) RegisterBuiltin(name string, fn func(args ...object.Object) object.Object) {
+	if vm.registered == nil {
+		vm.registered = make(map[string]*object.Builtin)
+	}
+
+	vm.registered[name] = &object.Builtin{Name: name, Fn: fn}
+}
+
+func (vm *VM) builtin(index int) (*object.Builtin, error) {
+	if index < len(object.Builtins) {
+		return object.Builtins[index].Builtin, nil
+	}
+
+	if index-len(object.Builtins) >= len(vm.builtinNames) {
+		return nil, newError("undefined builtin %d", index)
+	}
+
+	name := vm.builtinNames[index-len(object.Builtins)]
+	builtin, ok := vm.registered[name]
+	if !ok {
+		return nil, newError("undefined builtin %s", name)
+	}
+
+	return builtin, nil
+}
+
+func (vm *VM) finished() bool {
+	return vm.currentFrame().ip >= len(vm.currentFrame().Instructions())-1
+}
+
+// step executes the next instruction. A stack underflow takes precedence
+// over the error the instruction failed with, which is likely a consequence
+// of the Null pop returned.
+func (vm *VM) step() error {
+	err := vm.execute()
+	if vm.underflow {
+		vm.underflow = false
+		return newError("stack underflow")
+	}
+
+	return err
+}
+
+func (vm *VM) execute() error {
+	if vm.maxInstructions > 0 {
+		if vm.instructions >= vm.maxInstructions {
+			return newError("instruction limit exceeded")
+		}
+		vm.instructions++
+	}
+
+	vm.currentFrame().ip++
+
+	ip := vm.currentFrame().ip
+	ins := vm.currentFrame().Instructions()
+	op := code.Opcode(ins[ip])
+
+	// The dispatch is a plain switch on purpose: Go already compiles a dense
+	// switch over the opcodes into a jump table. Replacing it with a
+	// [256]func(*VM) error table of handlers was measured with
+	// BenchmarkRecursiveFibonacci and came out about 15% slower, the extra
+	// indirect call per instruction costing more than it saved.
+	switch op {
+	case code.OpConstant:
+		constIndex := code.ReadUint16(ins[ip+1:])
+		vm.currentFrame().ip += 2
+
+		if err := vm.push(vm.constants[constIndex]); err != nil {
+			return err
+		}
+
+	case code.OpConstantWide:
+		constIndex := code.ReadUint32(ins[ip+1:])
+		vm.currentFrame().ip += 4
+
+		if err := vm.push(vm.constants[constIndex]); err != nil {
+			return err
+		}
+
+	case code.OpPop:
+		vm.pop()
+
+	case code.OpDup:
+		if vm.sp == 0 {
+			return newError("stack underflow")
+		}
+		if err := vm.push(vm.stack[vm.sp-1]); err != nil {
+			return err
+		}
+
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpPow:
+		if err := vm.executeBinaryOperation(op); err != nil {
+			return err
+		}
+
+	case code.OpTrue:
+		if err := vm.push(True); err != nil {
+			return err
+		}
+
+	case code.OpFalse:
+		if err := vm.push(False); err != nil {
+			return err
+		}
+
+	case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan:
+		if err := vm.executeComparison(op); err != nil {
+			return err
+		}
+
+	case code.OpMatch:
+		if err := vm.executeMatch(); err != nil {
+			return err
+		}
+
+	case code.OpBang:
+		if err := vm.executeBangOperator(); err != nil {
+			return err
+		}
+
+	case code.OpMinus:
+		if err := vm.executeMinusOperator(); err != nil {
+			return err
+		}
+
+	case code.OpBitAnd, code.OpBitOr, code.OpBitXor,
+		code.OpShiftLeft, code.OpShiftRight:
+		if err := vm.executeBitwiseOperation(op); err != nil {
+			return err
+		}
+
+	case code.OpBitNot:
+		if err := vm.executeBitNotOperator(); err != nil {
+			return err
+		}
+
+	case code.OpJump:
+		pos := int(code.ReadUint32(ins[ip+1:]))
+		vm.currentFrame().ip = pos - 1
+
+	case code.OpJumpNotTruthy:
+		pos := int(code.ReadUint32(ins[ip+1:]))
+		vm.currentFrame().ip += 4
+
+		if condition := vm.pop(); !isTruthy(condition, vm.falseyZeroAndEmpty) {
 			vm.currentFrame().ip = pos - 1
+		}
 
-		case code.OpJumpNotTruthy:
-			pos := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+	case code.OpJumpTruthy:
+		pos := int(code.ReadUint32(ins[ip+1:]))
+		vm.currentFrame().ip += 4
 
-			if condition := vm.pop(); !isTruthy(condition) {
-				vm.currentFrame().ip = pos - 1
-			}
+		if condition := vm.pop(); isTruthy(condition, vm.falseyZeroAndEmpty) {
+			vm.currentFrame().ip = pos - 1
+		}
 
-		case code.OpNull:
-			if err := vm.push(Null); err != nil {
-				return err
-			}
+	case code.OpNull:
+		if err := vm.push(Null); err != nil {
+			return err
+		}
 
-		case code.OpSetGlobal:
-			globalIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+	case code.OpSetGlobal:
+		globalIndex := code.ReadUint16(ins[ip+1:])
+		vm.currentFrame().ip += 2
 
-			vm.globals[globalIndex] = vm.pop()
+		vm.setGlobal(int(globalIndex), vm.pop())
 
-		case code.OpGetGlobal:
-			globalIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+	case code.OpGetGlobal:
+		globalIndex := code.ReadUint16(ins[ip+1:])
+		vm.currentFrame().ip += 2
 
-			if err := vm.push(vm.globals[globalIndex]); err != nil {
-				return err
-			}
+		if err := vm.push(vm.getGlobal(int(globalIndex))); err != nil {
+			return err
+		}
 
-		case code.OpSetLocal:
-			localIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+	case code.OpSetGlobalWide:
+		globalIndex := code.ReadUint32(ins[ip+1:])
+		vm.currentFrame().ip += 4
 
-			frame := vm.currentFrame()
-			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+		vm.setGlobal(int(globalIndex), vm.pop())
 
-		case code.OpGetLocal:
-			localIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+	case code.OpGetGlobalWide:
+		globalIndex := code.ReadUint32(ins[ip+1:])
+		vm.currentFrame().ip += 4
 
-			frame := vm.currentFrame()
-			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
-			if err != nil {
-				return err
-			}
+		if err := vm.push(vm.getGlobal(int(globalIndex))); err != nil {
+			return err
+		}
 
-		case code.OpGetBuiltin:
-			buildinIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+	case code.OpSetLocal:
+		localIndex := code.ReadUint8(ins[ip+1:])
+		vm.currentFrame().ip += 1
 
-			definition := object.Builtins[buildinIndex]
-			if err := vm.push(definition.Builtin); err != nil {
-				return err
-			}
+		frame := vm.currentFrame()
+		vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
 
-		case code.OpArray:
-			numElements := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+	case code.OpGetLocal:
+		localIndex := code.ReadUint8(ins[ip+1:])
+		vm.currentFrame().ip += 1
 
-			array := vm.buildArray(vm.sp-numElements, vm.sp)
-			vm.sp = vm.sp - int(numElements)
+		frame := vm.currentFrame()
+		err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+		if err != nil {
+			return err
+		}
 
-			if err := vm.push(array); err != nil {
-				return err
-			}
+	case code.OpGetBuiltin:
+		buildinIndex := code.ReadUint8(ins[ip+1:])
+		vm.currentFrame().ip += 1
 
-		case code.OpHash:
-			numElements := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+		builtin, err := vm.builtin(int(buildinIndex))
+		if err != nil {
+			return err
+		}
 
-			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
-			if err != nil {
-				return err
-			}
-			vm.sp -= numElements
+		if err := vm.push(builtin); err != nil {
+			return err
+		}
 
-			if err := vm.push(hash); err != nil {
-				return err
-			}
+	case code.OpArray:
+		numElements := int(code.ReadUint16(ins[ip+1:]))
+		vm.currentFrame().ip += 2
 
-		case code.OpIndex:
-			index := vm.pop()
-			left := vm.pop()
+		if err := vm.ensureStack(numElements); err != nil {
+			return err
+		}
 
-			err := vm.executeIndexExpressions(left, index)
-			if err != nil {
-				return err
-			}
+		array := vm.buildArray(vm.sp-numElements, vm.sp)
+		vm.sp = vm.sp - int(numElements)
 
-		case code.OpCall:
-			numArgs := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+		if err := vm.push(array); err != nil {
+			return err
+		}
 
-			if err := vm.executeCall(int(numArgs)); err != nil {
-				return err
-			}
+	case code.OpHash:
+		numElements := int(code.ReadUint16(ins[ip+1:]))
+		vm.currentFrame().ip += 2
 
-		case code.OpClosure:
-			constIndex := code.ReadUint16(ins[ip+1:])
-			_ = code.ReadUint8(ins[ip+3:])
-			vm.currentFrame().ip += 3
+		if err := vm.ensureStack(numElements); err != nil {
+			return err
+		}
 
-			if err := vm.pushClosure(int(constIndex)); err != nil {
-				return err
-			}
+		hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
+		if err != nil {
+			return err
+		}
+		vm.sp -= numElements
 
-		case code.OpReturnValue:
-			returnValue := vm.pop()
+		if err := vm.push(hash); err != nil {
+			return err
+		}
 
-			frame := vm.popFrame()
-			vm.sp = frame.basePointer - 1
+	case code.OpIndex:
+		index := vm.pop()
+		left := vm.pop()
 
-			if err := vm.push(returnValue); err != nil {
-				return err
-			}
+		err := vm.executeIndexExpressions(left, index)
+		if err != nil {
+			return err
+		}
 
-		case code.OpReturn:
-			frame := vm.popFrame()
-			vm.sp = frame.basePointer - 1
+	case code.OpIterItems:
+		numVars := code.ReadUint8(ins[ip+1:])
+		vm.currentFrame().ip += 1
 
-			if err := vm.push(Null); err != nil {
-				return err
-			}
+		if err := vm.executeIterItems(vm.pop(), int(numVars)); err != nil {
+			return err
+		}
+
+	case code.OpSetIndex:
+		value := vm.pop()
+		index := vm.pop()
+		left := vm.pop()
+
+		if err := vm.executeSetIndex(left, index, value); err != nil {
+			return err
+		}
+
+	case code.OpSlice:
+		high := vm.pop()
+		low := vm.pop()
+		left := vm.pop()
+
+		if err := vm.executeSliceExpression(left, low, high); err != nil {
+			return err
+		}
+
+	case code.OpCall:
+		numArgs := code.ReadUint8(ins[ip+1:])
+		vm.currentFrame().ip += 1
+
+		if err := vm.executeCall(int(numArgs)); err != nil {
+			return err
+		}
+
+	case code.OpTailCall:
+		numArgs := code.ReadUint8(ins[ip+1:])
+		vm.currentFrame().ip += 1
+
+		if err := vm.executeTailCall(int(numArgs)); err != nil {
+			return err
+		}
+
+	case code.OpClosure:
+		constIndex := code.ReadUint16(ins[ip+1:])
+		numFree := code.ReadUint8(ins[ip+3:])
+		vm.currentFrame().ip += 3
+
+		err := vm.pushClosure(int(constIndex), int(numFree))
+		if err != nil {
+			return err
+		}
+
+	case code.OpGetFree:
+		freeIndex := code.ReadUint8(ins[ip+1:])
+		vm.currentFrame().ip += 1
+
+		currentClosure := vm.currentFrame().cl
+		if int(freeIndex) >= len(currentClosure.Free) {
+			return newError("free variable %d of %d",
+				freeIndex, len(currentClosure.Free))
+		}
+		if err := vm.push(currentClosure.Free[freeIndex]); err != nil {
+			return err
+		}
+
+	case code.OpCurrentClosure:
+		currentClosure := vm.currentFrame().cl
+		if err := vm.push(currentClosure); err != nil {
+			return err
+		}
+
+	case code.OpReturnValue:
+		returnValue := vm.pop()
+
+		if vm.framesIndex == 1 {
+			vm.returnFromMain(returnValue)
+			return nil
+		}
+
+		frame := vm.popFrame()
+		vm.sp = frame.basePointer - 1
+
+		if err := vm.push(returnValue); err != nil {
+			return err
+		}
+
+	case code.OpReturn:
+		if vm.framesIndex == 1 {
+			vm.returnFromMain(Null)
+			return nil
+		}
+
+		frame := vm.popFrame()
+		vm.sp = frame.basePointer - 1
+
+		if err := vm.push(Null); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+// returnFromMain ends the program at a return outside any function, leaving
+// value as the last popped element the way the evaluator makes it the
+// program's result.
+func (vm *VM) returnFromMain(value object.Object) {
+	vm.sp = 0
+	vm.stack[0] = value
 
+	frame := vm.currentFrame()
+	frame.ip = len(frame.Instructions()) - 1
+}
+
+// ensureStack reports a stack underflow unless n values are on the stack,
+// for instructions that consume as many values as their operand says.
+func (vm *VM) ensureStack(n int) error {
+	if n > vm.sp {
+		return newError("stack underflow")
 	}
 
 	return nil
 }
 
-func (vm *VM) pushClosure(constIndex int) error {
+// pushClosure wraps the compiled function at constIndex in a Closure,
+// capturing the numFree values sitting on top of the stack as its free
+// variables.
+func (vm *VM) pushClosure(constIndex, numFree int) error {
 	constant := vm.constants[constIndex]
 	function, ok := constant.(*object.CompiledFunction)
 	if !ok {
 		return fmt.Errorf("not a function: %+v", constant)
 	}
 
-	closure := &object.Closure{Fn: function}
+	if err := vm.ensureStack(numFree); err != nil {
+		return err
+	}
+
+	free := make([]object.Object, numFree)
+	for i := 0; i < numFree; i++ {
+		free[i] = vm.stack[vm.sp-numFree+i]
+	}
+	vm.sp = vm.sp - numFree
+
+	closure := &object.Closure{Fn: function, Free: free}
 
 	return vm.push(closure)
 }
 
+// setGlobal stores obj at index, growing the globals when the program
+// defines more than they hold. A store passed to NewWithGlobalsStore is
+// written in place as long as it is large enough; once it is outgrown the VM
+// continues with a copy, which Globals returns.
+func (vm *VM) setGlobal(index int, obj object.Object) {
+	if index >= len(vm.globals) {
+		size := 2 * len(vm.globals)
+		if size <= index {
+			size = index + 1
+		}
+
+		grown := make([]object.Object, size)
+		copy(grown, vm.globals)
+		vm.globals = grown
+	}
+
+	vm.globals[index] = obj
+}
+
+func (vm *VM) getGlobal(index int) object.Object {
+	if index >= len(vm.globals) || vm.globals[index] == nil {
+		return Null
+	}
+
+	return vm.globals[index]
+}
+
 func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overflow")
+	if vm.sp >= len(vm.stack) {
+		return newError("stack overflow")
 	}
 
 	vm.stack[vm.sp] = o
@@ -273,7 +873,15 @@ func (vm *VM) push(o object.Object) error {
 	return nil
 }
 
+// pop removes and returns the top of the stack. Only malformed bytecode pops
+// an empty stack; rather than have every caller check, pop returns Null and
+// step fails with a stack underflow once the instruction is done.
 func (vm *VM) pop() object.Object {
+	if vm.sp == 0 {
+		vm.underflow = true
+		return Null
+	}
+
 	o := vm.stack[vm.sp-1]
 	vm.sp--
 
@@ -287,29 +895,153 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	rightType := right.Type()
 	leftType := left.Type()
 
+	if op == code.OpMod && !(object.IsIntegral(left) && object.IsIntegral(right)) {
+		return newError("modulo requires INTEGER operands: %s %% %s",
+			leftType, rightType)
+	}
+
 	switch {
 	case leftType == object.INTEGER_OBJ &&
 		rightType == object.INTEGER_OBJ:
 		return vm.executeBinaryIntegerOperation(op, left, right)
 
+	case object.IsIntegral(left) && object.IsIntegral(right):
+		return vm.executeBinaryBigIntOperation(op, left, right)
+
+	case object.IsNumeric(left) && object.IsNumeric(right):
+		return vm.executeBinaryFloatOperation(op, left, right)
+
 	case leftType == object.STRING_OBJ &&
 		rightType == object.STRING_OBJ:
 		return vm.executeBinaryStringOperation(op, left, right)
 
+	case op == code.OpMul && leftType == object.STRING_OBJ &&
+		rightType == object.INTEGER_OBJ:
+		return vm.executeStringRepetition(left, right)
+
+	case op == code.OpMul && leftType == object.INTEGER_OBJ &&
+		rightType == object.STRING_OBJ:
+		return vm.executeStringRepetition(right, left)
+
+	case leftType == object.ARRAY_OBJ &&
+		rightType == object.ARRAY_OBJ:
+		return vm.executeBinaryArrayOperation(op, left, right)
+
+	case op == code.OpMul && leftType == object.ARRAY_OBJ &&
+		rightType == object.INTEGER_OBJ:
+		return vm.executeArrayRepetition(left, right)
+
+	case op == code.OpMul && leftType == object.INTEGER_OBJ &&
+		rightType == object.ARRAY_OBJ:
+		return vm.executeArrayRepetition(right, left)
+
+	default:
+		return binaryOperationError(op, left, right)
+	}
+}
+
+func (vm *VM) executeBinaryIntegerOperation(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+	leftValue := left.(*object.Integer).Value
+	rightValue := right.(*object.Integer).Value
+
+	if rightValue == 0 && (op == code.OpDiv || op == code.OpMod) {
+		return divisionByZeroError(op)
+	}
+
+	var result int64
+	var ok bool
+
+	switch op {
+	case code.OpAdd:
+		result, ok = addInt64(leftValue, rightValue)
+	case code.OpSub:
+		result, ok = subInt64(leftValue, rightValue)
+	case code.OpMul:
+		result, ok = mulInt64(leftValue, rightValue)
+	case code.OpDiv:
+		result, ok = divInt64(leftValue, rightValue)
+	case code.OpMod:
+		result, ok = leftValue%rightValue, true
+	case code.OpPow:
+		// There is no integer result for a negative exponent.
+		if rightValue < 0 {
+			return vm.executeBinaryFloatOperation(op, left, right)
+		}
+		result, ok = powInt64(leftValue, rightValue)
+	default:
+		return binaryOperationError(op, left, right)
+	}
+
+	if !ok {
+		switch vm.overflow {
+		case ErrorOnOverflow:
+			return newError("integer overflow")
+		case WrapOnOverflow:
+			// result already holds the wrapped value.
+		default:
+			return vm.executeBinaryBigIntOperation(op, left, right)
+		}
+	}
+
+	return vm.push(object.NewInteger(result))
+}
+
+// executeBinaryBigIntOperation handles integer arithmetic that does not fit
+// in an int64, either because an operand is already a BigInt or because the
+// int64 operation overflowed.
+func (vm *VM) executeBinaryBigIntOperation(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+	leftValue := object.ToBigInt(left)
+	rightValue := object.ToBigInt(right)
+
+	if rightValue.Sign() == 0 && (op == code.OpDiv || op == code.OpMod) {
+		return divisionByZeroError(op)
+	}
+
+	result := new(big.Int)
+
+	switch op {
+	case code.OpAdd:
+		result.Add(leftValue, rightValue)
+	case code.OpSub:
+		result.Sub(leftValue, rightValue)
+	case code.OpMul:
+		result.Mul(leftValue, rightValue)
+	case code.OpDiv:
+		result.Quo(leftValue, rightValue)
+	case code.OpMod:
+		result.Rem(leftValue, rightValue)
+	case code.OpPow:
+		// A negative exponent has no integer result.
+		if rightValue.Sign() < 0 {
+			return vm.executeBinaryFloatOperation(op, left, right)
+		}
+		result.Exp(leftValue, rightValue, nil)
 	default:
-		return fmt.Errorf("unsupported type for binary operations: %s %s",
-			leftType, rightType)
+		return binaryOperationError(op, left, right)
 	}
+
+	return vm.push(object.NormalizeBigInt(result))
 }
 
-func (vm *VM) executeBinaryIntegerOperation(
+// executeBinaryFloatOperation handles arithmetic where at least one operand
+// is a Float. Integers are promoted, so the result is always a Float.
+// Division by zero follows IEEE 754 and yields +Inf, -Inf or NaN rather than
+// an error, so float code can test for those values like in Go; only integer
+// division by zero is a runtime error.
+func (vm *VM) executeBinaryFloatOperation(
 	op code.Opcode,
 	left, right object.Object,
 ) error {
-	leftValue := left.(*object.Integer).Value
-	rightValue := right.(*object.Integer).Value
+	leftValue := object.ToFloat(left)
+	rightValue := object.ToFloat(right)
 
-	var result int64
+	var result float64
 
 	switch op {
 	case code.OpAdd:
@@ -320,11 +1052,13 @@ func (vm *VM) executeBinaryIntegerOperation(
 		result = leftValue * rightValue
 	case code.OpDiv:
 		result = leftValue / rightValue
+	case code.OpPow:
+		result = math.Pow(leftValue, rightValue)
 	default:
-		return fmt.Errorf("unknown integer operator: %d", op)
+		return binaryOperationError(op, left, right)
 	}
 
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(&object.Float{Value: result})
 }
 
 func (vm *VM) executeBinaryStringOperation(
@@ -332,7 +1066,7 @@ func (vm *VM) executeBinaryStringOperation(
 	left, right object.Object,
 ) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unknown string operator: %d", op)
+		return binaryOperationError(op, left, right)
 	}
 
 	leftValue := left.(*object.String).Value
@@ -341,23 +1075,141 @@ func (vm *VM) executeBinaryStringOperation(
 	return vm.push(&object.String{Value: leftValue + rightValue})
 }
 
+// executeStringRepetition pushes str repeated count times, or "" if count is
+// below 1.
+func (vm *VM) executeStringRepetition(str, count object.Object) error {
+	value := str.(*object.String).Value
+	times := count.(*object.Integer).Value
+	if times < 0 {
+		times = 0
+	}
+
+	if len(value) > 0 && times > int64(math.MaxInt/len(value)) {
+		return newError("string repetition too large: %d bytes * %d",
+			len(value), times)
+	}
+
+	return vm.push(&object.String{Value: strings.Repeat(value, int(times))})
+}
+
+func (vm *VM) executeBinaryArrayOperation(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+	if op != code.OpAdd {
+		return binaryOperationError(op, left, right)
+	}
+
+	leftElements := left.(*object.Array).Elements
+	rightElements := right.(*object.Array).Elements
+
+	elements := make([]object.Object, 0, len(leftElements)+len(rightElements))
+	elements = append(elements, leftElements...)
+	elements = append(elements, rightElements...)
+
+	return vm.push(&object.Array{Elements: elements})
+}
+
+// executeArrayRepetition pushes a new array holding the elements of array
+// count times over, or an empty one if count is below 1. The elements
+// themselves are shared, not copied.
+func (vm *VM) executeArrayRepetition(array, count object.Object) error {
+	elements := array.(*object.Array).Elements
+	times := count.(*object.Integer).Value
+	if times < 0 {
+		times = 0
+	}
+
+	if len(elements) > 0 && times > int64(math.MaxInt/len(elements)) {
+		return newError("array repetition too large: %d elements * %d",
+			len(elements), times)
+	}
+
+	repeated := make([]object.Object, 0, len(elements)*int(times))
+	for i := int64(0); i < times; i++ {
+		repeated = append(repeated, elements...)
+	}
+
+	return vm.push(&object.Array{Elements: repeated})
+}
+
 func (vm *VM) executeComparison(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	if left.Type() == object.INTEGER_OBJ ||
+	if left.Type() == object.INTEGER_OBJ &&
 		right.Type() == object.INTEGER_OBJ {
 		return vm.executeIntegerComparison(op, left, right)
 	}
 
+	if object.IsIntegral(left) && object.IsIntegral(right) {
+		return vm.executeBigIntComparison(op, left, right)
+	}
+
+	if object.IsNumeric(left) && object.IsNumeric(right) {
+		return vm.executeFloatComparison(op, left, right)
+	}
+
+	leftIsString := left.Type() == object.STRING_OBJ
+	rightIsString := right.Type() == object.STRING_OBJ
+	if leftIsString && rightIsString {
+		return vm.executeStringComparison(op, left, right)
+	}
+	if leftIsString || rightIsString {
+		return binaryOperationError(op, left, right)
+	}
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(object.Equals(left, right)))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(!object.Equals(left, right)))
+	default:
+		return binaryOperationError(op, left, right)
+	}
+}
+
+// executeMatch compares a switch subject with a case value. Numbers compare
+// by value whatever their type, as with ==; any other values match when
+// object.Equals holds, so a case of another type is skipped instead of
+// failing the program.
+func (vm *VM) executeMatch() error {
+	right := vm.pop()
+	left := vm.pop()
+
+	if object.IsNumeric(left) && object.IsNumeric(right) {
+		if left.Type() == object.INTEGER_OBJ &&
+			right.Type() == object.INTEGER_OBJ {
+			return vm.executeIntegerComparison(code.OpEqual, left, right)
+		}
+		if object.IsIntegral(left) && object.IsIntegral(right) {
+			return vm.executeBigIntComparison(code.OpEqual, left, right)
+		}
+		return vm.executeFloatComparison(code.OpEqual, left, right)
+	}
+
+	return vm.push(nativeBoolToBooleanObject(object.Equals(left, right)))
+}
+
+// executeStringComparison compares two Strings lexicographically by byte.
+func (vm *VM) executeStringComparison(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(right == left))
+		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(right != left))
+		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)",
-			op, left.Type(), right.Type())
+		return binaryOperationError(op, left, right)
 	}
 }
 
@@ -375,64 +1227,319 @@ func (vm *VM) executeIntegerComparison(
 		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	default:
+		return binaryOperationError(op, left, right)
+	}
+}
+
+func (vm *VM) executeBigIntComparison(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+	cmp := object.ToBigInt(left).Cmp(object.ToBigInt(right))
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(cmp == 0))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(cmp != 0))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(cmp > 0))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(cmp < 0))
+	default:
+		return binaryOperationError(op, left, right)
+	}
+}
+
+func (vm *VM) executeFloatComparison(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+	leftValue := object.ToFloat(left)
+	rightValue := object.ToFloat(right)
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue == leftValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
 	default:
-		return fmt.Errorf("unknown operator: %d", op)
+		return binaryOperationError(op, left, right)
 	}
 }
 
 func (vm *VM) executeBangOperator() error {
 	operand := vm.pop()
 
-	switch operand {
-	case True:
-		return vm.push(False)
-	case False:
-		return vm.push(True)
-	case Null:
-		return vm.push(True)
+	return vm.push(nativeBoolToBooleanObject(!isTruthy(operand, vm.falseyZeroAndEmpty)))
+}
+
+func (vm *VM) executeMinusOperator() error {
+	operand := vm.pop()
+
+	switch operand := operand.(type) {
+	case *object.Integer:
+		if operand.Value == math.MinInt64 {
+			switch vm.overflow {
+			case ErrorOnOverflow:
+				return newError("integer overflow")
+			case WrapOnOverflow:
+				return vm.push(operand)
+			default:
+				return vm.push(object.NormalizeBigInt(new(big.Int).Neg(object.ToBigInt(operand))))
+			}
+		}
+		return vm.push(object.NewInteger(-operand.Value))
+	case *object.BigInt:
+		return vm.push(object.NormalizeBigInt(new(big.Int).Neg(operand.Value)))
+	case *object.Float:
+		return vm.push(&object.Float{Value: -operand.Value})
 	default:
-		return vm.push(False)
+		return newError("unknown operator: -%s", operand.Type())
 	}
 }
 
-func (vm *VM) executeMinusOperator() error {
+// executeBitwiseOperation handles the bitwise and shift operators, which are
+// only defined for Integers. Shifts follow Go: bits shifted out are lost and
+// counts of 64 or more shift every bit out.
+func (vm *VM) executeBitwiseOperation(op code.Opcode) error {
+	right := vm.pop()
+	left := vm.pop()
+
+	leftInt, leftOk := left.(*object.Integer)
+	rightInt, rightOk := right.(*object.Integer)
+	if !leftOk || !rightOk {
+		return binaryOperationError(op, left, right)
+	}
+
+	leftValue, rightValue := leftInt.Value, rightInt.Value
+
+	var result int64
+
+	switch op {
+	case code.OpBitAnd:
+		result = leftValue & rightValue
+	case code.OpBitOr:
+		result = leftValue | rightValue
+	case code.OpBitXor:
+		result = leftValue ^ rightValue
+	case code.OpShiftLeft, code.OpShiftRight:
+		if rightValue < 0 {
+			return newError("negative shift count: %d", rightValue)
+		}
+		if op == code.OpShiftLeft {
+			result = leftValue << rightValue
+		} else {
+			result = leftValue >> rightValue
+		}
+	default:
+		return binaryOperationError(op, left, right)
+	}
+
+	return vm.push(object.NewInteger(result))
+}
+
+func (vm *VM) executeBitNotOperator() error {
 	operand := vm.pop()
 
-	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type for negativon: %s",
-			operand.Type())
+	integer, ok := operand.(*object.Integer)
+	if !ok {
+		return newError("unknown operator: ~%s", operand.Type())
 	}
 
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
+	return vm.push(object.NewInteger(^integer.Value))
 }
 
 func (vm *VM) executeIndexExpressions(left, index object.Object) error {
 	switch {
-	case left.Type() == object.ARRAY_OBJ &&
-		left.Type() == object.ARRAY_OBJ:
+	case left.Type() == object.ARRAY_OBJ:
 		return vm.executeArrayIndex(left, index)
 
-	case left.Type() == object.HASH_OBJ &&
-		left.Type() == object.HASH_OBJ:
+	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndex(left, index)
 
+	case left.Type() == object.STRING_OBJ:
+		return vm.executeStringIndex(left, index)
+
 	default:
-		return fmt.Errorf("index operator not supported: %s",
-			left.Type())
+		return indexError(left, index)
 	}
 }
 
+// executeArrayIndex pushes the element at index, counting from the end when
+// index is negative, or null when it is out of range.
 func (vm *VM) executeArrayIndex(array, index object.Object) error {
 	arrayObject := array.(*object.Array)
-	i := index.(*object.Integer).Value
-	max := int64(len(arrayObject.Elements) - 1)
+	i, ok := index.(*object.Integer)
+	if !ok {
+		return indexError(array, index)
+	}
+
+	idx, ok := resolveIndex(i.Value, len(arrayObject.Elements))
+	if !ok {
+		return vm.push(Null)
+	}
+
+	return vm.push(arrayObject.Elements[idx])
+}
 
-	if i < 0 || i > max {
+// executeStringIndex pushes the character at index as a String, following
+// the same rules as executeArrayIndex. Strings are indexed by character, not
+// byte, like len counts them.
+func (vm *VM) executeStringIndex(str, index object.Object) error {
+	value := str.(*object.String).Value
+	i, ok := index.(*object.Integer)
+	if !ok {
+		return indexError(str, index)
+	}
+
+	runes := []rune(value)
+	idx, ok := resolveIndex(i.Value, len(runes))
+	if !ok {
 		return vm.push(Null)
 	}
 
-	return vm.push(arrayObject.Elements[i])
+	return vm.push(&object.String{Value: string(runes[idx])})
+}
+
+// executeSetIndex stores value in the array element or hash entry left[index]
+// and pushes it. Arrays take the same indexes as executeArrayIndex but can't
+// grow; assigning out of range is an error. Hashes gain the key if it's new.
+func (vm *VM) executeSetIndex(left, index, value object.Object) error {
+	switch left := left.(type) {
+	case *object.Array:
+		i, ok := index.(*object.Integer)
+		if !ok {
+			return setIndexError(left, index)
+		}
+
+		idx, ok := resolveIndex(i.Value, len(left.Elements))
+		if !ok {
+			return newError("index out of range: %d with length %d",
+				i.Value, len(left.Elements))
+		}
+
+		left.Elements[idx] = value
+
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+
+		left.Set(key.HashKey(), object.HashPair{Key: index, Value: value})
+
+	default:
+		return setIndexError(left, index)
+	}
+
+	return vm.push(value)
+}
+
+// resolveIndex turns a possibly negative index into an offset into a
+// sequence of length elements, reporting false when it is out of range.
+func resolveIndex(index int64, length int) (int64, bool) {
+	if index < 0 {
+		index += int64(length)
+	}
+
+	return index, index >= 0 && index < int64(length)
+}
+
+// executeIterItems pushes the array a for loop over iterable walks, given
+// the number of loop variables: the elements of an array or the keys of a
+// hash for one, the indexes of an array or the keys of a hash for two.
+func (vm *VM) executeIterItems(iterable object.Object, numVars int) error {
+	switch iterable := iterable.(type) {
+	case *object.Array:
+		if numVars == 1 {
+			return vm.push(iterable)
+		}
+
+		indexes := make([]object.Object, len(iterable.Elements))
+		for i := range indexes {
+			indexes[i] = object.NewInteger(int64(i))
+		}
+		return vm.push(&object.Array{Elements: indexes})
+
+	case *object.Hash:
+		return vm.push(&object.Array{Elements: iterable.Keys()})
+
+	default:
+		return newError("cannot iterate over %s", iterable.Type())
+	}
+}
+
+// executeSliceExpression pushes the elements of an array, or the characters
+// of a string, from low up to but not including high. Negative bounds count from
+// the end, null bounds default to the start and end, and bounds out of range
+// are clamped, so slicing never fails on valid operand types.
+func (vm *VM) executeSliceExpression(left, low, high object.Object) error {
+	var length int64
+	var runes []rune
+	switch left := left.(type) {
+	case *object.Array:
+		length = int64(len(left.Elements))
+	case *object.String:
+		runes = []rune(left.Value)
+		length = int64(len(runes))
+	default:
+		return newError("slice operator not supported: %s", left.Type())
+	}
+
+	start, err := sliceBound(low, 0, length)
+	if err != nil {
+		return err
+	}
+	end, err := sliceBound(high, length, length)
+	if err != nil {
+		return err
+	}
+	if end < start {
+		end = start
+	}
+
+	switch left := left.(type) {
+	case *object.Array:
+		elements := make([]object.Object, end-start)
+		copy(elements, left.Elements[start:end])
+		return vm.push(&object.Array{Elements: elements})
+	default:
+		return vm.push(&object.String{Value: string(runes[start:end])})
+	}
+}
+
+// sliceBound resolves a slice bound against length, returning def for null.
+func sliceBound(bound object.Object, def, length int64) (int64, error) {
+	if bound == Null {
+		return def, nil
+	}
+
+	i, ok := bound.(*object.Integer)
+	if !ok {
+		return 0, newError("slice bound must be INTEGER, got %s", bound.Type())
+	}
+
+	idx := i.Value
+	if idx < 0 {
+		idx += length
+	}
+
+	switch {
+	case idx < 0:
+		return 0, nil
+	case idx > length:
+		return length, nil
+	default:
+		return idx, nil
+	}
 }
 
 func (vm *VM) executeHashIndex(hash, index object.Object) error {
@@ -440,7 +1547,7 @@ func (vm *VM) executeHashIndex(hash, index object.Object) error {
 
 	key, ok := index.(object.Hashable)
 	if !ok {
-		return fmt.Errorf("unusable as hash key: %s", index.Type())
+		return newError("unusable as hash key: %s", index.Type())
 	}
 
 	pair, ok := hashObject.Pairs[key.HashKey()]
@@ -452,6 +1559,10 @@ func (vm *VM) executeHashIndex(hash, index object.Object) error {
 }
 
 func (vm *VM) executeCall(numArgs int) error {
+	if err := vm.ensureStack(numArgs + 1); err != nil {
+		return err
+	}
+
 	callee := vm.stack[vm.sp-1-numArgs]
 	switch callee := callee.(type) {
 	case *object.Closure:
@@ -459,28 +1570,89 @@ func (vm *VM) executeCall(numArgs int) error {
 	case *object.Builtin:
 		return vm.callBuiltin(callee, numArgs)
 	default:
-		return fmt.Errorf("calling non-closure and non-built-in")
+		return newError("calling non-closure and non-built-in")
 	}
 }
 
 func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
 	if numArgs != cl.Fn.NumParameters {
-		return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
+		return newError("wrong number of arguments: want=%d, got=%d",
 			cl.Fn.NumParameters, numArgs)
 	}
 
 	frame := NewFrame(cl, vm.sp-int(numArgs))
-	vm.pushFrame(frame)
+	if frame.basePointer+cl.Fn.NumLocals >= len(vm.stack) {
+		return newError("stack overflow")
+	}
+
+	if err := vm.pushFrame(frame); err != nil {
+		return err
+	}
 
 	vm.sp = frame.basePointer + cl.Fn.NumLocals
 
 	return nil
 }
 
+// executeTailCall calls a closure in place of the current frame instead of
+// on top of it, so tail recursion runs in constant frame and stack space. The
+// callee and its arguments are moved down to where the current closure and
+// its arguments sit, and the frame is restarted with the new closure; the
+// caller's locals are dead at this point and are overwritten. Anything else
+// is called normally and returned by the OpReturnValue that follows.
+func (vm *VM) executeTailCall(numArgs int) error {
+	if err := vm.ensureStack(numArgs + 1); err != nil {
+		return err
+	}
+
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok || vm.framesIndex == 1 {
+		return vm.executeCall(numArgs)
+	}
+
+	if numArgs != cl.Fn.NumParameters {
+		return newError("wrong number of arguments: want=%d, got=%d",
+			cl.Fn.NumParameters, numArgs)
+	}
+
+	basePointer := vm.currentFrame().basePointer
+	if basePointer+cl.Fn.NumLocals >= len(vm.stack) {
+		return newError("stack overflow")
+	}
+
+	copy(vm.stack[basePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+
+	vm.frames[vm.framesIndex-1] = NewFrame(cl, basePointer)
+	vm.sp = basePointer + cl.Fn.NumLocals
+
+	return nil
+}
+
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp]
 
-	result := builtin.Fn(args...)
+	var result object.Object
+	var callErr error
+	switch {
+	case builtin.CallbackFn != nil:
+		result = builtin.CallbackFn(func(fn object.Object, args ...object.Object) (object.Object, error) {
+			if callErr != nil {
+				return nil, callErr
+			}
+			result, err := vm.call(fn, args)
+			callErr = err
+			return result, err
+		}, args...)
+	case builtin.OutputFn != nil:
+		result = builtin.OutputFn(vm.out, args...)
+	default:
+		result = builtin.Fn(args...)
+	}
+	// A runtime error in a callback aborts the program like any other,
+	// whatever the builtin made of it.
+	if callErr != nil {
+		return callErr
+	}
 	vm.sp = vm.sp - numArgs - 1
 
 	if result != nil {
@@ -502,7 +1674,7 @@ func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
 }
 
 func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
-	hashedPairs := make(map[object.HashKey]object.HashPair)
+	hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
 
 	for i := startIndex; i < endIndex; i += 2 {
 		key := vm.stack[i]
@@ -512,23 +1684,30 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 
 		hashKey, ok := key.(object.Hashable)
 		if !ok {
-			return nil, fmt.Errorf("unusable as hash key: %s",
+			return nil, newError("unusable as hash key: %s",
 				key.Type())
 		}
 
-		hashedPairs[hashKey.HashKey()] = pair
+		hash.Set(hashKey.HashKey(), pair)
 	}
 
-	return &object.Hash{Pairs: hashedPairs}, nil
+	return hash, nil
 }
 
 func (vm *VM) currentFrame() *Frame {
 	return vm.frames[vm.framesIndex-1]
 }
 
-func (vm *VM) pushFrame(f *Frame) {
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= len(vm.frames) {
+		return newError("maximum call stack depth exceeded (%d)",
+			len(vm.frames))
+	}
+
 	vm.frames[vm.framesIndex] = f
 	vm.framesIndex++
+
+	return nil
 }
 
 func (vm *VM) popFrame() *Frame {
@@ -544,7 +1723,127 @@ func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	return False
 }
 
-func isTruthy(obj object.Object) bool {
+// operatorSymbols spells binary opcodes the way they are written in source,
+// for error messages.
+var operatorSymbols = map[code.Opcode]string{
+	code.OpAdd:         "+",
+	code.OpSub:         "-",
+	code.OpMul:         "*",
+	code.OpDiv:         "/",
+	code.OpMod:         "%",
+	code.OpPow:         "**",
+	code.OpEqual:       "==",
+	code.OpNotEqual:    "!=",
+	code.OpGreaterThan: ">",
+	code.OpLessThan:    "<",
+	code.OpBitAnd:      "&",
+	code.OpBitOr:       "|",
+	code.OpBitXor:      "^",
+	code.OpShiftLeft:   "<<",
+	code.OpShiftRight:  ">>",
+}
+
+// binaryOperationError reports that op can't be applied to left and right,
+// in the evaluator's words: a "type mismatch" when the operand types differ
+// and an "unknown operator" when the type doesn't support op.
+func binaryOperationError(op code.Opcode, left, right object.Object) *object.Error {
+	symbol, ok := operatorSymbols[op]
+	if !ok {
+		symbol = fmt.Sprintf("<opcode %d>", op)
+	}
+
+	if left.Type() != right.Type() {
+		return newError("type mismatch: %s %s %s",
+			left.Type(), symbol, right.Type())
+	}
+
+	return newError("unknown operator: %s %s %s",
+		left.Type(), symbol, right.Type())
+}
+
+// indexError reports that left can't be indexed with index.
+func indexError(left, index object.Object) *object.Error {
+	return newError("index operator not supported: %s[%s]",
+		left.Type(), index.Type())
+}
+
+func setIndexError(left, index object.Object) *object.Error {
+	return newError("index assignment not supported: %s[%s]",
+		left.Type(), index.Type())
+}
+
+// newError builds the object.Error the VM halts with on runtime failures.
+func newError(format string, a ...any) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
+
+func divisionByZeroError(op code.Opcode) *object.Error {
+	if op == code.OpMod {
+		return newError("modulo by zero")
+	}
+
+	return newError("division by zero")
+}
+
+// addInt64, subInt64, mulInt64, divInt64 and powInt64 perform checked int64
+// arithmetic, reporting false when the result overflows. The result is then
+// the wrapped around value.
+func addInt64(a, b int64) (int64, bool) {
+	c := a + b
+	return c, (c > a) == (b > 0)
+}
+
+func subInt64(a, b int64) (int64, bool) {
+	c := a - b
+	return c, (c < a) == (b > 0)
+}
+
+func mulInt64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+
+	c := a * b
+	if (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return c, false
+	}
+
+	return c, c/b == a
+}
+
+// powInt64 raises base to exp, which must not be negative, by repeated
+// squaring.
+func powInt64(base, exp int64) (int64, bool) {
+	result, ok := int64(1), true
+	for exp > 0 {
+		var stepOk bool
+		if exp&1 == 1 {
+			result, stepOk = mulInt64(result, base)
+			ok = ok && stepOk
+		}
+
+		exp >>= 1
+		if exp > 0 {
+			base, stepOk = mulInt64(base, base)
+			ok = ok && stepOk
+		}
+	}
+
+	return result, ok
+}
+
+func divInt64(a, b int64) (int64, bool) {
+	if a == math.MinInt64 && b == -1 {
+		return a, false
+	}
+
+	return a / b, true
+}
+
+// isTruthy decides every condition the VM tests. Only false and null are
+// false, unless falseyZeroAndEmpty also makes zero and the empty string false,
+// see WithFalseyZeroAndEmpty.
+func isTruthy(obj object.Object, falseyZeroAndEmpty bool) bool {
 	switch obj := obj.(type) {
 
 	case *object.Boolean:
@@ -553,6 +1852,15 @@ func isTruthy(obj object.Object) bool {
 	case *object.Null:
 		return false
 
+	case *object.Integer:
+		return !falseyZeroAndEmpty || obj.Value != 0
+
+	case *object.Float:
+		return !falseyZeroAndEmpty || obj.Value != 0
+
+	case *object.String:
+		return !falseyZeroAndEmpty || obj.Value != ""
+
 	default:
 		return true
 	}
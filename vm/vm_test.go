@@ -1,10 +1,19 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ZeroBl21/go-interpreter/ast"
+	"github.com/ZeroBl21/go-interpreter/code"
 	"github.com/ZeroBl21/go-interpreter/compiler"
 	"github.com/ZeroBl21/go-interpreter/lexer"
 	"github.com/ZeroBl21/go-interpreter/object"
@@ -35,16 +44,334 @@ func TestIntegerArithmetic(t *testing.T) {
 		{"-10", -10},
 		{"-50 + 100 + -50", 0},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"6 % 3", 0},
+		{"2 + 7 % 3 * 2", 4},
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", -4},
+		{"(-2) ** 3", -8},
+		{"2 * 3 ** 2", 18},
+		{"7 ** 0", 1},
+		{"0 ** 0", 1},
 	}
 
 	runVmTests(t, tests)
 }
 
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"2.5", 2.5},
+		{"1 + 2.5", 3.5},
+		{"2.5 + 1", 3.5},
+		{"5.0 - 0.5", 4.5},
+		{"1.5 * 2", 3.0},
+		{"-1.5", -1.5},
+		// Integer division stays integral; use a float operand to get 1.5.
+		{"3 / 2", 1},
+		{"3 / 2.0", 1.5},
+		{"2.0 == 2", true},
+		{"2 != 2.5", true},
+		{"2.5 > 2", true},
+		{"1 < 0.5", false},
+		{"0.5 < 1", true},
+		// Float division by zero follows IEEE 754 instead of erroring.
+		{"1.0 / 0", math.Inf(1)},
+		{"-1 / 0.0", math.Inf(-1)},
+		{"0.0 / 0", math.NaN()},
+		{"1.0 / 0 > 9999999999", true},
+		{"1.5 ** 2", 2.25},
+		{"4 ** 0.5", 2.0},
+		// There is no integer result for a negative exponent.
+		{"2 ** -1", 0.5},
+		{"(9223372036854775807 + 1) ** -1", 1.0 / 9223372036854775808.0},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBigIntArithmetic(t *testing.T) {
+	bigInt := func(s string) *big.Int {
+		v, _ := new(big.Int).SetString(s, 10)
+		return v
+	}
+
+	tests := []vmTestCase{
+		{"9999999999 * 9999999999", bigInt("99999999980000000001")},
+		{"9223372036854775807 + 1", bigInt("9223372036854775808")},
+		{"-9223372036854775807 - 2", bigInt("-9223372036854775809")},
+		{"-(-9223372036854775807 - 1)", bigInt("9223372036854775808")},
+		{"(-9223372036854775807 - 1) / -1", bigInt("9223372036854775808")},
+		{"9999999999 * 9999999999 * 10", bigInt("999999999800000000010")},
+		// Results that fit again are folded back into an Integer.
+		{"9999999999 * 9999999999 - 9999999999 * 9999999998", 9999999999},
+		{"(9223372036854775807 + 1) / 2", 4611686018427387904},
+		{"(9223372036854775807 + 1) % 10", 8},
+		{"(9223372036854775807 + 1) % (9223372036854775807 + 2)", bigInt("9223372036854775808")},
+		{"9999999999 * 9999999999 > 9223372036854775807", true},
+		{"9223372036854775807 < 9999999999 * 9999999999", true},
+		{"9223372036854775807 + 1 == 9223372036854775807 + 1", true},
+		{"9223372036854775807 + 1 != 1", true},
+		{"2 ** 64", bigInt("18446744073709551616")},
+		{"(-2) ** 63", -9223372036854775808},
+		{"(2 ** 64) ** 2 / 2 ** 120", 256},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestIntegerOverflow(t *testing.T) {
+	bigInt := func(s string) *big.Int {
+		v, _ := new(big.Int).SetString(s, 10)
+		return v
+	}
+
+	const maxInt = "9223372036854775807"
+	const minInt = "(-9223372036854775807 - 1)"
+
+	tests := []struct {
+		input    string
+		mode     IntegerOverflow
+		expected any // an error message when a string
+	}{
+		{maxInt + " + 1", PromoteOnOverflow, bigInt("9223372036854775808")},
+		{maxInt + " + 1", ErrorOnOverflow, "integer overflow"},
+		{maxInt + " + 1", WrapOnOverflow, math.MinInt64},
+		{minInt + " - 1", ErrorOnOverflow, "integer overflow"},
+		{minInt + " - 1", WrapOnOverflow, math.MaxInt64},
+		{maxInt + " * 2", ErrorOnOverflow, "integer overflow"},
+		{maxInt + " * 2", WrapOnOverflow, -2},
+		{minInt + " / -1", ErrorOnOverflow, "integer overflow"},
+		{minInt + " / -1", WrapOnOverflow, math.MinInt64},
+		{"-" + minInt, ErrorOnOverflow, "integer overflow"},
+		{"-" + minInt, WrapOnOverflow, math.MinInt64},
+		{"2 ** 64", ErrorOnOverflow, "integer overflow"},
+		{"2 ** 64", WrapOnOverflow, 0},
+		{"3 ** 41", WrapOnOverflow, -420491770248316829},
+		// Results that fit are unaffected.
+		{maxInt + " - 1 + 1", ErrorOnOverflow, math.MaxInt64},
+		{"(-2) ** 63", ErrorOnOverflow, math.MinInt64},
+		{"2 ** -1", ErrorOnOverflow, 0.5},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode(), WithIntegerOverflow(tt.mode))
+		err := vm.Run()
+
+		if msg, ok := tt.expected.(string); ok {
+			if err == nil || err.Error() != msg {
+				t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, msg, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func BenchmarkIntegerArithmetic(b *testing.B) {
+	runBenchmark(b, `
+	let sum = fn(a, b) { a + b * 2 - 1 };
+	sum(sum(sum(1, 2), sum(3, 4)), sum(sum(5, 6), sum(7, 8)));
+	`)
+}
+
+// BenchmarkRecursiveFibonacci is dominated by instruction dispatch and
+// calls, see the comment on the dispatch switch in VM.execute.
+func BenchmarkRecursiveFibonacci(b *testing.B) {
+	runBenchmark(b, `
+	let fibonacci = fn(x) {
+		if (x < 2) { return x; }
+		fibonacci(x - 1) + fibonacci(x - 2)
+	};
+	fibonacci(30);
+	`)
+}
+
+// BenchmarkSmallIntegerLoop runs a loop whose arithmetic mostly produces
+// integers in the range object.NewInteger interns.
+func BenchmarkSmallIntegerLoop(b *testing.B) {
+	runBenchmark(b, `
+	let i = 0;
+	let acc = 0;
+	while (i < 1000) {
+		acc = (acc * 3 + i % 7 - 2) % 100;
+		i = i + 1;
+	}
+	acc
+	`)
+}
+
+func BenchmarkArithmeticLoop(b *testing.B) {
+	runBenchmark(b, `
+	let i = 0;
+	let sum = 0;
+	while (i < 10000) {
+		sum = sum + i * 2 - i / 3;
+		i = i + 1;
+	}
+	sum
+	`)
+}
+
+func BenchmarkArrayConstruction(b *testing.B) {
+	runBenchmark(b, `
+	let i = 0;
+	let total = 0;
+	while (i < 10000) {
+		let a = [i, i + 1, i + 2, [i, i], "x"];
+		total = total + len(a) + a[3][1];
+		i = i + 1;
+	}
+	total
+	`)
+}
+
+func BenchmarkHashConstruction(b *testing.B) {
+	runBenchmark(b, `
+	let i = 0;
+	let total = 0;
+	while (i < 10000) {
+		let h = {"a": i, "b": i + 1, 1: true, i: "v"};
+		total = total + h["a"] + h["b"];
+		i = i + 1;
+	}
+	total
+	`)
+}
+
+func BenchmarkStringConcatenation(b *testing.B) {
+	runBenchmark(b, `
+	let i = 0;
+	let s = "";
+	while (i < 1000) {
+		s = s + "ab" + "c";
+		i = i + 1;
+	}
+	len(s)
+	`)
+}
+
+func TestBitwiseOperations(t *testing.T) {
+	tests := []vmTestCase{
+		{"12 & 10", 8},
+		{"-1 & 255", 255},
+		{"12 | 10", 14},
+		{"0 | 0", 0},
+		{"12 ^ 10", 6},
+		{"5 ^ 5", 0},
+		{"~0", -1},
+		{"~5", -6},
+		{"~-1", 0},
+		{"1 << 4", 16},
+		{"1 << 63", math.MinInt64},
+		{"1 << 64", 0},
+		{"256 >> 4", 16},
+		{"-16 >> 2", -4},
+		{"-1 >> 64", -1},
+		{"1 + 1 << 2", 5},
+		{"(1 + 1) << 2", 8},
+		{"6 & 3 == 2", true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBitwiseErrors(t *testing.T) {
+	tests := []vmTestCase{
+		{"1 & true", "type mismatch: INTEGER & BOOLEAN"},
+		{`"a" | 1`, "type mismatch: STRING | INTEGER"},
+		{"1.5 ^ 1", "type mismatch: FLOAT ^ INTEGER"},
+		{"1 << 1.0", "type mismatch: INTEGER << FLOAT"},
+		{"[1] >> 1", "type mismatch: ARRAY >> INTEGER"},
+		{"1.5 & 2.5", "unknown operator: FLOAT & FLOAT"},
+		{"1 << -1", "negative shift count: -1"},
+		{"8 >> -2", "negative shift count: -2"},
+		{"~true", "unknown operator: ~BOOLEAN"},
+		{"~1.5", "unknown operator: ~FLOAT"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err := vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error message for %q. want=%q, got=%q",
+				tt.input, tt.expected, err.Error())
+		}
+	}
+}
+
 func TestStringExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{`"monkey"`, "monkey"},
 		{`"mon" + "key"`, "monkey"},
 		{`"mon" + "key" + "banana"`, "monkeybanana"},
+		{`"foo" + "bar"`, "foobar"},
+		{`"" + ""`, ""},
+		{`"ab" * 3`, "ababab"},
+		{`3 * "ab"`, "ababab"},
+		{`"ab" * 1`, "ab"},
+		{`"ab" * 0`, ""},
+		{`"ab" * -2`, ""},
+		{`"" * 5`, ""},
+		{`"-" * 2 + "|"`, "--|"},
+		{`let s = "x"; let t = s * 2; s`, "x"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTemplateStrings(t *testing.T) {
+	tests := []vmTestCase{
+		{`let name = "bob"; "hi ${name}!"`, "hi bob!"},
+		{`let n = 3; "${n} * 2 = ${n * 2}"`, "3 * 2 = 6"},
+		{`"${[1, 2]} ${true} ${1.5}"`, "[1, 2] true 1.5"},
+		{`let f = fn(x) { "<${x}>" }; "${f("a")}${f(1)}"`, "<a><1>"},
+		{`let x = 1; "a ${"b ${x + 1}"} c"`, "a b 2 c"},
+		{`"${ {"k": 5}["k"] }"`, "5"},
+		{`let x = 1; "\${x} is ${x}"`, "${x} is 1"},
+		{`"${""}"`, ""},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestStringComparisons(t *testing.T) {
+	tests := []vmTestCase{
+		{`"a" == "a"`, true},
+		{`"a" == "b"`, false},
+		{`"a" != "b"`, true},
+		{`"a" != "a"`, false},
+		{`"mon" + "key" == "monkey"`, true},
+		{`"abc" < "abd"`, true},
+		{`"abd" < "abc"`, false},
+		{`"abc" > "abd"`, false},
+		{`"b" > "abc"`, true},
+		{`"ab" < "abc"`, true},
+		{`"" < "a"`, true},
+		{`"a" < "a"`, false},
+		{`"Z" < "a"`, true},
+		{`("a" < "b") == true`, true},
 	}
 
 	runVmTests(t, tests)
@@ -78,16 +405,122 @@ func TestBooleanExpressions(t *testing.T) {
 		{"!!false", false},
 		{"!!5", true},
 		{"!(if (false) { 5; })", true},
+		{`"a" == "a"`, true},
+		{`"a" != "b"`, true},
+		{"[1, 2] == [1, 2]", true},
+		{"[1, 2] == [2, 1]", false},
+		{"[1, [2]] != [1, [2]]", false},
+		{`{"a": 1} == {"a": 1}`, true},
+		{`{"a": 1} == {"a": 2}`, false},
+		{`{"a": 1} != {"b": 1}`, true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCollectionEquality(t *testing.T) {
+	tests := []vmTestCase{
+		{"[] == []", true},
+		{"[1, 2] == [1, 2, 3]", false},
+		{"[1, 2] != [1, 2, 3]", true},
+		{`[1, "a", true] == [1, "a", true]`, true},
+		{"[1, [2, [3]]] == [1, [2, [3]]]", true},
+		{"[1, [2, [3]]] == [1, [2, [4]]]", false},
+		{"[1] == 1", false},
+		{"[1.0] == [1]", false},
+		{"{} == {}", true},
+		{`{"a": 1, "b": 2} == {"b": 2, "a": 1}`, true},
+		{`{"a": 1, "b": 2} == {"a": 1}`, false},
+		{`{"a": [1, {"b": 2}]} == {"a": [1, {"b": 2}]}`, true},
+		{`{"a": [1, {"b": 2}]} != {"a": [1, {"b": 3}]}`, true},
+		{`[{1: true}, {2: false}] == [{1: true}, {2: false}]`, true},
+		{"let a = [1, 2]; a == a", true},
 	}
 
 	runVmTests(t, tests)
 }
 
+func TestBooleanSingletons(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected object.Object
+	}{
+		{"true", object.TRUE},
+		{"1 < 2", object.TRUE},
+		{"!false", object.TRUE},
+		{`"a" == "a"`, object.TRUE},
+		{"1.5 > 2.5", object.FALSE},
+		{"!!0", object.TRUE},
+		{"if (false) { 1 }", object.NULL},
+		{"puts()", object.NULL},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode(), WithOutput(io.Discard))
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if got := vm.LastPoppedStackElem(); got != tt.expected {
+			t.Errorf("%q: result is not the %s singleton. got=%p, want=%p",
+				tt.input, tt.expected.Inspect(), got, tt.expected)
+		}
+	}
+}
+
 func TestArrayLiterals(t *testing.T) {
 	tests := []vmTestCase{
 		{"[]", []int{}},
 		{"[1, 2, 3]", []int{1, 2, 3}},
 		{"[1 + 2, 3 * 4, 5 + 6]", []int{3, 12, 11}},
+		{"[3, 2, 1]", []int{3, 2, 1}},
+		{"let a = 1; [a, a + 1, [a][0] + 2]", []int{1, 2, 3}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestArrayOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2] + [3]", []int{1, 2, 3}},
+		{"[] + [1]", []int{1}},
+		{"[] + []", []int{}},
+		{"[1] + [2] + [3, 4]", []int{1, 2, 3, 4}},
+		{"[0] * 3", []int{0, 0, 0}},
+		{"[1, 2] * 2", []int{1, 2, 1, 2}},
+		{"2 * [1, 2]", []int{1, 2, 1, 2}},
+		{"[1] * 0", []int{}},
+		{"[1] * -2", []int{}},
+		{"[] * 5", []int{}},
+		{"let a = [1]; let b = a + [2]; a", []int{1}},
+		{"let a = [1]; let b = a * 3; a", []int{1}},
+		{"let a = [1, 2]; len(a + a) + len(a * 2)", 8},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestIndexAssignments(t *testing.T) {
+	tests := []vmTestCase{
+		{"let a = [1, 2, 3]; a[0] = 9; a", []int{9, 2, 3}},
+		{"let a = [1, 2, 3]; a[-1] = 9; a", []int{1, 2, 9}},
+		{"let a = [1, 2]; a[1] = 5", 5},
+		{"let a = [1, 2]; a[0] = a[1] = 7; a", []int{7, 7}},
+		{"let a = [1, 2]; let b = a; b[0] = 3; a", []int{3, 2}},
+		{"let a = [[1, 2], [3]]; a[0][1] = 5; a[0]", []int{1, 5}},
+		{"let a = [0, 0]; let i = 0; while (i < 2) { a[i] = i + 1; i = i + 1 }; a",
+			[]int{1, 2}},
+		{"let set = fn(a) { fn(v) { a[0] = v } }; let a = [1]; set(a)(4); a",
+			[]int{4}},
+		{`let h = {"a": 1}; h["a"] = 2; h["a"]`, 2},
+		{`let h = {}; h["b"] = 1; h[2] = 2; h[true] = 3; h["b"] + h[2] + h[true]`, 6},
+		{`let h = {"a": 1}; h["a"] = h["a"] + 1; h["a"] = h["a"] + 1; h["a"]`, 3},
+		{`let h = {"a": 1}; h["a"] = 5; len(keys(h))`, 1},
 	}
 
 	runVmTests(t, tests)
@@ -103,6 +536,13 @@ func TestHashLiterals(t *testing.T) {
 				(&object.Integer{Value: 2}).HashKey(): 3,
 			},
 		},
+		{
+			"{1: 2, 3: 4}",
+			map[object.HashKey]int64{
+				(&object.Integer{Value: 1}).HashKey(): 2,
+				(&object.Integer{Value: 3}).HashKey(): 4,
+			},
+		},
 		{
 			"{1 + 1: 2 * 2, 3 + 3: 4 * 4}",
 			map[object.HashKey]int64{
@@ -115,6 +555,40 @@ func TestHashLiterals(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestHashInspectOrder(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"b": 1, "a": 2, 3: true}`, `{b: 1, a: 2, 3: true}`},
+		{`{"z": 1, "y": {2: "x", 1: "w"}}`, `{z: 1, y: {2: x, 1: w}}`},
+		{`{"a": 1, "b": 2, "a": 3}`, `{a: 3, b: 2}`},
+		{`let k = "key"; {k + "2": 2, k + "1": 1}`, `{key2: 2, key1: 1}`},
+		{`let h = {"b": 1}; h["a"] = 2; h["b"] = 3; h`, `{b: 3, a: 2}`},
+	}
+
+	// Go randomizes map iteration, so an order that isn't kept explicitly
+	// would show up as a mismatch over a few runs.
+	for run := 0; run < 20; run++ {
+		for _, tt := range tests {
+			comp := compiler.New()
+			if err := comp.Compile(parse(tt.input)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			vm := New(comp.Bytecode())
+			if err := vm.Run(); err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+
+			if got := vm.LastPoppedStackElem().Inspect(); got != tt.expected {
+				t.Fatalf("wrong order for %s. want=%s, got=%s",
+					tt.input, tt.expected, got)
+			}
+		}
+	}
+}
+
 func TestIndexExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{"[1, 2, 3][1]", 2},
@@ -122,11 +596,89 @@ func TestIndexExpressions(t *testing.T) {
 		{"[[1, 1, 1]][0][0]", 1},
 		{"[][0]", Null},
 		{"[1, 2, 3][99]", Null},
-		{"[1][-1]", Null},
+		{"[1][-1]", 1},
+		{"[1, 2, 3][-1]", 3},
+		{"[1, 2, 3][-2]", 2},
+		{"[1, 2, 3][-3]", 1},
+		{"[1, 2, 3][-4]", Null},
+		{"[][-1]", Null},
+		{"[1, 2, 3][-9223372036854775807 - 1]", Null},
+		{"{-1: 1, 2: 2}[-1]", 1},
+		{"{1: 1, 2: 2}[-1]", Null},
+		{`"hello"[0]`, "h"},
+		{`"hello"[1]`, "e"},
+		{`"hello"[4]`, "o"},
+		{`"hello"[-1]`, "o"},
+		{`"hello"[-5]`, "h"},
+		{`"hello"[5]`, Null},
+		{`"hello"[-6]`, Null},
+		{`""[0]`, Null},
+		{`"hello"[1] + "hello"[-1]`, "eo"},
+		// Strings are indexed by character.
+		{`"héllo"[1]`, "é"},
+		{`"héllo"[2]`, "l"},
+		{`"héllo"[-4]`, "é"},
+		{`"héllo"[5]`, Null},
+		{`let s = "日本語"; s[len(s) - 1]`, "語"},
 		{"{1: 1, 2: 2}[1]", 1},
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
 		{"{}[0]", Null},
+		{`{"a": 1}["a"]`, 1},
+		{`{"a": 1}["b"]`, Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSliceExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2, 3, 4][1:3]", []int{2, 3}},
+		{"[1, 2, 3, 4][:2]", []int{1, 2}},
+		{"[1, 2, 3, 4][2:]", []int{3, 4}},
+		{"[1, 2, 3, 4][:]", []int{1, 2, 3, 4}},
+		{"[1, 2, 3, 4][-2:]", []int{3, 4}},
+		{"[1, 2, 3, 4][:-1]", []int{1, 2, 3}},
+		{"[1, 2, 3, 4][-3:-1]", []int{2, 3}},
+		{"[1, 2, 3, 4][-10:2]", []int{1, 2}},
+		{"[1, 2, 3, 4][2:99]", []int{3, 4}},
+		{"[1, 2, 3, 4][3:1]", []int{}},
+		{"[1, 2, 3, 4][5:]", []int{}},
+		{"[][0:1]", []int{}},
+		{"let a = [1, 2, 3]; let b = a[:]; a == b", true},
+		{`"monkey"[1:3]`, "on"},
+		{`"monkey"[:3]`, "mon"},
+		{`"monkey"[3:]`, "key"},
+		{`"monkey"[-3:]`, "key"},
+		{`"monkey"[4:2]`, ""},
+		{`"monkey"[-99:99]`, "monkey"},
+		{`"héllo"[1:3]`, "él"},
+		{`"héllo"[-4:]`, "éllo"},
+		{`"日本語"[:2]`, "日本"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLogicalExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || false", false},
+		{"false || true", true},
+		{"true || false", true},
+		{"1 && 2", true},
+		{"0 || false", true},
+		{"if (false) { 1 } || false", false},
+		{"1 < 2 && 2 < 3 || false", true},
+		// The right operand is only evaluated when needed.
+		{"let called = false; let f = fn() { called = true }; false && f(); called", false},
+		{"let called = false; let f = fn() { called = true }; true && f(); called", true},
+		{"let called = false; let f = fn() { called = true }; true || f(); called", false},
+		{"let called = false; let f = fn() { called = true }; false || f(); called", true},
+		{"false && (1 + true)", false},
+		{"true || (1 + true)", true},
 	}
 
 	runVmTests(t, tests)
@@ -143,16 +695,293 @@ func TestConditionals(t *testing.T) {
 		{"if (1 > 2) { 10 }", Null},
 		{"if (false) { 10 }", Null},
 		{"if ((if (false) { 10 })) { 10 } else { 20 }", 20},
+		// Branches that don't end in an expression evaluate to null.
+		{"let i = 0; if (true) { while (i < 3) { i = i + 1 } }; i", 3},
+		{"if (true) { while (false) {} }", Null},
+		{"if (true) { do { 1 } while (false) }", Null},
+		{"if (true) { for (x in [1, 2]) { x } }", Null},
+		{"if (false) { 1 } else { let a = 2; }", Null},
+		{"fn() { if (true) { while (false) {} } }()", Null},
+		{"fn() { if (true) { do { 1 } while (false) } }()", Null},
+		{"fn() { if (true) { for (x in [7, 8]) { x } } }()", Null},
+		{"fn() { if (false) { 1 } else { for (x in [7, 8]) { x } } }()", Null},
 	}
 
 	runVmTests(t, tests)
 }
 
+func TestTruthiness(t *testing.T) {
+	tests := []struct {
+		input        string
+		monkey       any
+		zeroAndEmpty any
+	}{
+		{"if (0) { 10 } else { 20 }", 10, 20},
+		{"if (0.0) { 10 } else { 20 }", 10, 20},
+		{`if ("") { 10 } else { 20 }`, 10, 20},
+		{"if (1) { 10 } else { 20 }", 10, 10},
+		{`if ("a") { 10 } else { 20 }`, 10, 10},
+		{"if ([]) { 10 } else { 20 }", 10, 10},
+		{"if (if (false) { 1 }) { 10 } else { 20 }", 20, 20},
+		{"!0", false, true},
+		{`!""`, false, true},
+		{"!5", false, false},
+		{"!false", true, true},
+		{"0 || 5", true, true},
+		{"0 && 5", true, false},
+		{"let i = 3; let n = 0; while (i && n < 5) { i = i - 1; n = n + 1 }; n", 5, 3},
+	}
+
+	for _, tt := range tests {
+		for _, falseyZeroAndEmpty := range []bool{false, true} {
+			comp := compiler.New()
+			if err := comp.Compile(parse(tt.input)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			vm := New(comp.Bytecode(), WithFalseyZeroAndEmpty(falseyZeroAndEmpty))
+			if err := vm.Run(); err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+
+			expected := tt.monkey
+			if falseyZeroAndEmpty {
+				expected = tt.zeroAndEmpty
+			}
+			testExpectedObject(t, expected, vm.LastPoppedStackElem())
+		}
+	}
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []vmTestCase{
 		{"let one = 1; one", 1},
 		{"let one = 1; let two = 2; one + two", 3},
 		{"let one = 1; let two = one + one; one + two", 3},
+		// Redefining a global rebinds it, also for functions defined earlier.
+		{"let one = 1; let one = one + 1; one", 2},
+		{"let one = 1; let get = fn() { one }; let one = 2; get()", 2},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestManyGlobals(t *testing.T) {
+	// Identifiers can't contain digits, so spell the index in letters.
+	name := func(i int) string {
+		var b strings.Builder
+		b.WriteByte('g')
+		for ; i > 0; i /= 26 {
+			b.WriteByte(byte('a' + i%26))
+		}
+		return b.String()
+	}
+
+	// Globals past GlobalSize don't fit OpSetGlobal's operand and mustn't
+	// alias the first ones.
+	var input strings.Builder
+	for i := 0; i < GlobalSize+10; i++ {
+		fmt.Fprintf(&input, "let %s = %d;\n", name(i), i)
+	}
+	fmt.Fprintf(&input, "%s = %s + 1;\n", name(GlobalSize), name(GlobalSize))
+	fmt.Fprintf(&input, "[%s, %s, %s, %s]", name(0), name(2500),
+		name(GlobalSize), name(GlobalSize+9))
+
+	runVmTests(t, []vmTestCase{{
+		input:    input.String(),
+		expected: []int{0, 2500, GlobalSize + 1, GlobalSize + 9},
+	}})
+}
+
+func TestGlobalsStore(t *testing.T) {
+	// The store is smaller than the program needs, so the VM has to grow
+	// its globals past it.
+	store := make([]object.Object, 2)
+
+	comp := compiler.New()
+	if err := comp.Compile(parse("let a = 1; let b = 2; let c = 3; a + b + c")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := NewWithGlobalsStore(comp.Bytecode(), store)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if err := testIntegerObject(6, vm.LastPoppedStackElem()); err != nil {
+		t.Errorf("testIntegerObject failed: %s", err)
+	}
+
+	if err := testIntegerObject(1, store[0]); err != nil {
+		t.Errorf("store not written in place: %s", err)
+	}
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; while (i < 3) { i = i + 1 }; i", 3},
+		{"let i = 10; while (i < 3) { i = i + 1 }; i", 10},
+		{`
+		let sum = fn(n) {
+			let total = 0;
+			let i = 1;
+			while (i < n + 1) {
+				total = total + i;
+				i = i + 1;
+			}
+			total
+		};
+		sum(10)
+		`, 55},
+		{"let a = 1; let b = 2; a = b = 5; a + b", 10},
+		{"let i = 0; while (true) { i = i + 1; if (i > 4) { break } }; i", 5},
+		{`
+		let i = 0;
+		let odd = 0;
+		while (i < 10) {
+			i = i + 1;
+			if (i / 2 * 2 == i) { continue }
+			odd = odd + 1;
+		}
+		odd
+		`, 5},
+		{`
+		let outer = 0;
+		let inner = 0;
+		while (outer < 3) {
+			outer = outer + 1;
+			while (true) {
+				inner = inner + 1;
+				break;
+			}
+		}
+		outer * 10 + inner
+		`, 33},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDoWhileLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; do { i = i + 1 } while (i < 3); i", 3},
+		{"let i = 10; do { i = i + 1 } while (false); i", 11},
+		{"let i = 0; do { i = i + 1; if (i > 4) { break } } while (true); i", 5},
+		{`
+		let i = 0;
+		let odd = 0;
+		do {
+			i = i + 1;
+			if (i % 2 == 0) { continue }
+			odd = odd + 1;
+		} while (i < 10);
+		odd
+		`, 5},
+		{`
+		let count = fn(n) {
+			let i = 0;
+			do { i = i + 1 } while (i < n);
+			i
+		};
+		[count(0), count(4)]
+		`, []int{1, 4}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestForEachLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let sum = 0; for (x in [1, 2, 3]) { sum = sum + x }; sum", 6},
+		{"let n = 0; for (x in []) { n = n + 1 }; n", 0},
+		{"let s = 0; for (i, x in [5, 6, 7]) { s = s + i * x }; s", 20},
+		{`let s = ""; for (k in {"a": 1, "b": 2}) { s = s + k }; len(s)`, 2},
+		{"let s = 0; for (k, v in {1: 10, 2: 20}) { s = s + k * v }; s", 50},
+		{"let last = 0; for (k in {3: 1, 1: 2, 2: 3}) { last = k }; last", 2},
+		{`let s = ""; for (k, v in {"b": 1, "a": 2}) { s = s + k + str(v) }; s`, "b1a2"},
+		{`
+		let found = -1;
+		for (i, x in [4, 8, 15, 16]) {
+			if (x % 2 == 1) { found = i; break }
+		}
+		found
+		`, 2},
+		{`
+		let odd = 0;
+		for (x in [1, 2, 3, 4, 5]) {
+			if (x % 2 == 0) { continue }
+			odd = odd + x;
+		}
+		odd
+		`, 9},
+		{`
+		let flatten = fn(rows) {
+			let out = [];
+			for (row in rows) {
+				for (x in row) { out = push(out, x) }
+			}
+			out
+		};
+		flatten([[1, 2], [], [3]])
+		`, []int{1, 2, 3}},
+		{`
+		let makeAdders = fn() {
+			let adders = [];
+			for (n in [1, 2]) { adders = push(adders, fn(x) { x + n }) }
+			adders
+		};
+		let adders = makeAdders();
+		adders[0](10) + adders[1](10)
+		`, 23},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSwitchStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{"switch (2) { case 1: 10 case 2: 20 default: 30 }", 20},
+		{"switch (5) { case 1: 10 case 2: 20 default: 30 }", 30},
+		{"switch (5) { case 1: 10 case 2: 20 }", Null},
+		{"switch (1) { case 1: let a = 1; }", Null},
+		{"switch (1) { case 1: default: 30 }", Null},
+		{`switch ("b") { case "a": 1 case "b": 2 }`, 2},
+		{"switch (1 + 1) { case 1 + 1: 10 case 2: 20 }", 10},
+		// Cases of another type don't match instead of failing.
+		{`let x = 1; switch (x) { case "a": 1 }`, Null},
+		{`switch ("a") { case 1: 1 case true: 2 case "a": 3 }`, 3},
+		{"let n = if (false) { 1 }; switch (n) { case 0: 1 case false: 2 case n: 3 }", 3},
+		{"switch ([1, 2]) { case [1]: 1 case [1, 2]: 2 }", 2},
+		{"switch (2) { case 2.0: 1 default: 2 }", 1},
+		{"switch (9223372036854775807 + 1) { case 9223372036854775807 + 1: 1 }", 1},
+		{`
+		let calls = 0;
+		let next = fn() { calls = calls + 1; calls };
+		switch (next()) { case 0: 0 case 2: 2 case 1: 1 };
+		calls
+		`, 1},
+		{`
+		let name = fn(n) {
+			switch (n) {
+			case 1: "one";
+			case 2: "two";
+			default: "many";
+			}
+		};
+		name(1) + name(2) + name(3)
+		`, "onetwomany"},
+		{`
+		let i = 0;
+		let odd = 0;
+		while (i < 6) {
+			i = i + 1;
+			switch (i % 2) {
+			case 0: continue;
+			default: odd = odd + 1;
+			}
+		}
+		odd
+		`, 3},
 	}
 
 	runVmTests(t, tests)
@@ -214,6 +1043,35 @@ func TestFunctionsWithoutReturnValue(t *testing.T) {
       noReturnTwo();`,
 			expected: Null,
 		},
+		{
+			input: `
+      let onlyBindings = fn() { let a = 1; let b = 2; };
+      onlyBindings();`,
+			expected: Null,
+		},
+		{
+			input: `
+      let noReturn = fn() { };
+      noReturn(); noReturn();
+      3;`,
+			expected: 3,
+		},
+		{
+			input:    `fn() { let x = 5; x * 2 }();`,
+			expected: 10,
+		},
+		{
+			input:    `fn(a) { if (a) { return 1; } 2 }(false);`,
+			expected: 2,
+		},
+		{
+			input:    `fn(a) { if (a) { return 1; } 2 }(true);`,
+			expected: 1,
+		},
+		{
+			input:    `fn(a) { if (a) { 1 } else { 2 } }(false);`,
+			expected: 2,
+		},
 	}
 
 	runVmTests(t, tests)
@@ -284,6 +1142,42 @@ func TestCallingFunctionsWithBindings(t *testing.T) {
       minusOne() + minusTwo();`,
 			expected: 97,
 		},
+		{
+			input: `
+      let num = 1;
+      let shadow = fn() { let num = 2; num = num + 10; num };
+      [shadow(), num];`,
+			expected: []int{12, 1},
+		},
+		{
+			input: `
+      let a = 1;
+      let scale = fn(a) { a = a * 10; a };
+      [scale(5), a];`,
+			expected: []int{50, 1},
+		},
+		{
+			input: `
+      let x = 1;
+      let outer = fn() {
+        let x = 2;
+        let inner = fn() { let x = 3; x };
+        inner() * 10 + x
+      }
+      outer() * 10 + x;`,
+			expected: 321,
+		},
+		{
+			input: `
+      let count = fn(n) {
+        let local = n;
+        if (n == 0) { return 0; }
+        count(n - 1);
+        local
+      }
+      count(3);`,
+			expected: 3,
+		},
 	}
 
 	runVmTests(t, tests)
@@ -368,6 +1262,23 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 			input:    `fn(a, b) { a + b; }(1);`,
 			expected: `wrong number of arguments: want=2, got=1`,
 		},
+		{
+			input:    `fn(a) { a; }(1, 2);`,
+			expected: `wrong number of arguments: want=1, got=2`,
+		},
+		{
+			input:    `let adder = fn(a) { fn(b) { a + b } }; adder(1)(2, 3);`,
+			expected: `wrong number of arguments: want=1, got=2`,
+		},
+		{
+			// Calls in tail position take a different path through the VM.
+			input:    `let f = fn(a) { a }; let g = fn() { f(1, 2) }; g();`,
+			expected: `wrong number of arguments: want=1, got=2`,
+		},
+		{
+			input:    `let f = fn(n) { if (n == 0) { 0 } else { f() } }; f(1);`,
+			expected: `wrong number of arguments: want=1, got=0`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -391,50 +1302,1557 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	}
 }
 
+func TestRuntimeErrors(t *testing.T) {
+	tests := []vmTestCase{
+		{`1 + true`, "type mismatch: INTEGER + BOOLEAN"},
+		{`"foo" + 1`, "type mismatch: STRING + INTEGER"},
+		{`[1] + "foo"`, "type mismatch: ARRAY + STRING"},
+		{`true * false`, "unknown operator: BOOLEAN * BOOLEAN"},
+		{`[1] - [2]`, "unknown operator: ARRAY - ARRAY"},
+		{`[1] + 1`, "type mismatch: ARRAY + INTEGER"},
+		{`1 + [1]`, "type mismatch: INTEGER + ARRAY"},
+		{`[1] * [2]`, "unknown operator: ARRAY * ARRAY"},
+		{`[1] * "a"`, "type mismatch: ARRAY * STRING"},
+		{`[1] * 1.5`, "type mismatch: ARRAY * FLOAT"},
+		{`[1] / 2`, "type mismatch: ARRAY / INTEGER"},
+		{`"ab" * "c"`, "unknown operator: STRING * STRING"},
+		{`"ab" * 1.5`, "type mismatch: STRING * FLOAT"},
+		{`"ab" * true`, "type mismatch: STRING * BOOLEAN"},
+		{`"ab" * 9223372036854775807`,
+			"string repetition too large: 2 bytes * 9223372036854775807"},
+		{`let a = [1]; a[1] = 2`, "index out of range: 1 with length 1"},
+		{`let a = [1]; a[-2] = 2`, "index out of range: -2 with length 1"},
+		{`let a = []; a[0] = 1`, "index out of range: 0 with length 0"},
+		{`let a = [1]; a["x"] = 2`,
+			"index assignment not supported: ARRAY[STRING]"},
+		{`let s = "ab"; s[0] = "c"`,
+			"index assignment not supported: STRING[INTEGER]"},
+		{`let h = {}; h[[1]] = 2`, "unusable as hash key: ARRAY"},
+		{`[1, 2] * 9223372036854775807`,
+			"array repetition too large: 2 elements * 9223372036854775807"},
+		{`-"monkey"`, "unknown operator: -STRING"},
+		{`"a" - "b"`, "unknown operator: STRING - STRING"},
+		{`1[0]`, "index operator not supported: INTEGER[INTEGER]"},
+		{`[1, 2]["a"]`, "index operator not supported: ARRAY[STRING]"},
+		{`{}[fn() {}]`, "unusable as hash key: CLOSURE"},
+		{`{[1]: 2}`, "unusable as hash key: ARRAY"},
+		{`{"a": 1, {}: 2}`, "unusable as hash key: HASH"},
+		{`1 / 0`, "division by zero"},
+		{`let f = fn(x) { 10 / x }; f(0)`, "division by zero"},
+		{`(9223372036854775807 + 1) / 0`, "division by zero"},
+		{`(9223372036854775807 + 1) % 0`, "modulo by zero"},
+		{`1 % 0`, "modulo by zero"},
+		{`5.5 % 2`, "modulo requires INTEGER operands: FLOAT % INTEGER"},
+		{`"a" % 2`, "modulo requires INTEGER operands: STRING % INTEGER"},
+		{`"a" ** 2`, "type mismatch: STRING ** INTEGER"},
+		{`[1] ** [2]`, "unknown operator: ARRAY ** ARRAY"},
+		{`for (x in 5) { x }`, "cannot iterate over INTEGER"},
+		{`"a" == 1`, "type mismatch: STRING == INTEGER"},
+		{`1[0:1]`, "slice operator not supported: INTEGER"},
+		{`[1, 2]["a":]`, "slice bound must be INTEGER, got STRING"},
+		{`"ab"[:true]`, "slice bound must be INTEGER, got BOOLEAN"},
+		{`"ab"["a"]`, "index operator not supported: STRING[STRING]"},
+		{`true != "true"`, "type mismatch: BOOLEAN != STRING"},
+		{`"1" > 0.5`, "type mismatch: STRING > FLOAT"},
+		{`[] > "a"`, "type mismatch: ARRAY > STRING"},
+		{`[] > []`, "unknown operator: ARRAY > ARRAY"},
+		{`[] < "a"`, "type mismatch: ARRAY < STRING"},
+		{`1 < "a"`, "type mismatch: INTEGER < STRING"},
+		{`true < false`, "unknown operator: BOOLEAN < BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err := vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		errObj, ok := err.(*object.Error)
+		if !ok {
+			t.Fatalf("error is not *object.Error. got=%T (%+v)", err, err)
+		}
+
+		if errObj.Message != tt.expected {
+			t.Errorf("wrong error message. want=%q, got=%q",
+				tt.expected, errObj.Message)
+		}
+	}
+}
+
+func TestCallDepth(t *testing.T) {
+	countDown := `
+	let countDown = fn(n) { if (n > 0) { 1 + countDown(n - 1) } else { 0 } };
+	countDown(%d)`
+
+	tests := []vmLimitTestCase{
+		{
+			input:    "let f = fn() { 1 + f() }; f()",
+			expected: "maximum call stack depth exceeded (1024)",
+		},
+		{
+			input:    "let f = fn() { let g = fn() { 1 + f() }; 1 + g() }; f()",
+			opts:     []Option{WithMaxCallDepth(100)},
+			expected: "maximum call stack depth exceeded (100)",
+		},
+		{
+			input:    "let f = fn() { 1 + f() }; f()",
+			opts:     []Option{WithMaxCallDepth(10)},
+			expected: "maximum call stack depth exceeded (10)",
+		},
+		{
+			// The main program and nine calls fill ten frames.
+			input: fmt.Sprintf(countDown, 8),
+			opts:  []Option{WithMaxCallDepth(10)},
+		},
+		{
+			input:    fmt.Sprintf(countDown, 9),
+			opts:     []Option{WithMaxCallDepth(10)},
+			expected: "maximum call stack depth exceeded (10)",
+		},
+		{
+			// Large frames use up the value stack before the depth limit.
+			input:    "let f = fn(a, b, c) { let d = a; 1 + f(a, b, c) }; f(1, 2, 3)",
+			expected: "stack overflow",
+		},
+	}
+
+	runVmLimitTests(t, tests)
+}
+
+func TestTopLevelReturn(t *testing.T) {
+	tests := []vmTestCase{
+		{"return 5; 1", 5},
+		{"let a = 1; if (a > 0) { return a + 1 }; 10", 2},
+		{"let a = 1; if (a > 5) { return a }; 10", 10},
+		{"let f = fn() { 3 }; return f(); 4", 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestStackUnderflow(t *testing.T) {
+	tests := []code.Instructions{
+		code.Make(code.OpPop),
+		code.Make(code.OpDup),
+		append(code.Make(code.OpTrue), code.Make(code.OpAdd)...),
+	}
+
+	for _, ins := range tests {
+		machine := New(&compiler.Bytecode{Instructions: ins})
+
+		err := machine.Run()
+		if err == nil || err.Error() != "stack underflow" {
+			t.Errorf("%s: expected a stack underflow, got=%v", ins, err)
+		}
+	}
+}
+
+func TestStackSize(t *testing.T) {
+	// Every pending call keeps the callee, its argument and the 1 on the
+	// stack, so a thousand levels need about 3000 slots.
+	countDown := `
+	let countDown = fn(n) { if (n > 0) { 1 + countDown(n - 1) } else { 0 } };
+	countDown(1000)`
+
+	tests := []vmLimitTestCase{
+		{
+			input:    "[1, 2, 3, 4, 5]",
+			opts:     []Option{WithStackSize(4)},
+			expected: "stack overflow",
+		},
+		{
+			input: "[1, 2, 3, 4]",
+			opts:  []Option{WithStackSize(4)},
+		},
+		{
+			input:    "let f = fn(a, b) { let c = a + b; c }; f(1, 2)",
+			opts:     []Option{WithStackSize(4)},
+			expected: "stack overflow",
+		},
+		{
+			input:    countDown,
+			expected: "stack overflow",
+		},
+		{
+			input: countDown,
+			opts:  []Option{WithStackSize(4096)},
+		},
+	}
+
+	runVmLimitTests(t, tests)
+}
+
+func TestMaxInstructions(t *testing.T) {
+	tests := []vmLimitTestCase{
+		{
+			input:    "while (true) {}",
+			opts:     []Option{WithMaxInstructions(1000)},
+			expected: "instruction limit exceeded",
+		},
+		{
+			// Tail calls don't grow the stack, so only the limit stops this.
+			input:    "let f = fn() { f() }; f()",
+			opts:     []Option{WithMaxInstructions(1000)},
+			expected: "instruction limit exceeded",
+		},
+		{
+			// OpConstant, OpConstant, OpArray and OpPop.
+			input: "[1, 2]",
+			opts:  []Option{WithMaxInstructions(4)},
+		},
+		{
+			input:    "[1, 2]",
+			opts:     []Option{WithMaxInstructions(3)},
+			expected: "instruction limit exceeded",
+		},
+		{
+			input: "let i = 0; while (i < 1000) { i = i + 1 }; i",
+			opts:  []Option{WithMaxInstructions(100000)},
+		},
+	}
+
+	runVmLimitTests(t, tests)
+}
+
+func TestRunContext(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("while (true) {}")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := New(comp.Bytecode()).RunContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wrong error. want=%v, got=%v", context.DeadlineExceeded, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	err = New(comp.Bytecode()).RunContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error. want=%v, got=%v", context.Canceled, err)
+	}
+}
+
+func TestStep(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("1 + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+
+	steps := []struct {
+		expectedIP   int
+		expectedTop  any // nil when the stack must be empty
+		expectedDone bool
+	}{
+		{3, 1, false},  // OpConstant 0
+		{6, 2, false},  // OpConstant 1
+		{7, 3, false},  // OpAdd
+		{8, nil, true}, // OpPop
+	}
+
+	if vm.IP() != 0 || vm.StackTop() != nil {
+		t.Fatalf("wrong initial state. ip=%d, top=%v", vm.IP(), vm.StackTop())
+	}
+
+	for i, tt := range steps {
+		done, err := vm.Step()
+		if err != nil {
+			t.Fatalf("step %d: vm error: %s", i, err)
+		}
+
+		if done != tt.expectedDone {
+			t.Errorf("step %d: wrong done. want=%t, got=%t",
+				i, tt.expectedDone, done)
+		}
+
+		if vm.IP() != tt.expectedIP {
+			t.Errorf("step %d: wrong ip. want=%d, got=%d", i, tt.expectedIP, vm.IP())
+		}
+
+		if tt.expectedTop == nil {
+			if vm.StackTop() != nil {
+				t.Errorf("step %d: stack not empty. got=%s",
+					i, vm.StackTop().Inspect())
+			}
+			continue
+		}
+		testExpectedObject(t, tt.expectedTop, vm.StackTop())
+	}
+
+	testExpectedObject(t, 3, vm.LastPoppedStackElem())
+
+	if done, err := vm.Step(); !done || err != nil {
+		t.Errorf("step after the end: want done, got done=%t err=%v", done, err)
+	}
+}
+
+func TestGlobalsAccessor(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let a = 5; let b = a * 2;")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	globals := vm.Globals()
+	testExpectedObject(t, 5, globals[0])
+	testExpectedObject(t, 10, globals[1])
+}
+
+func TestBreakpoints(t *testing.T) {
+	input := `let double = fn(x) {
+  x * 2
+};
+let a = double(1);
+let b = double(a);
+b`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.SetBreakpoint(5)
+	vm.SetBreakpoint(2)
+
+	// double's body is reached once per call, line 5 in between.
+	stops := []struct {
+		line     int
+		expected []any // globals a and b, nil while unset
+	}{
+		{2, []any{nil, nil}},
+		{5, []any{2, nil}},
+		{2, []any{2, nil}},
+	}
+
+	for i, tt := range stops {
+		if err := vm.Run(); err != ErrBreakpoint {
+			t.Fatalf("stop %d: want ErrBreakpoint, got %v", i, err)
+		}
+
+		if line := vm.currentFrame().lineAt(vm.IP()); line != tt.line {
+			t.Errorf("stop %d: stopped at wrong line. want=%d, got=%d",
+				i, tt.line, line)
+		}
+
+		for j, want := range tt.expected {
+			var got object.Object
+			if globals := vm.Globals(); j+1 < len(globals) {
+				got = globals[j+1]
+			}
+
+			if want == nil {
+				if got != nil {
+					t.Errorf("stop %d: global %d already set to %s",
+						i, j+1, got.Inspect())
+				}
+				continue
+			}
+			testExpectedObject(t, want, got)
+		}
+	}
+
+	// Returning from double would arrive at line 5 again.
+	vm.ClearBreakpoint(5)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error after clearing breakpoint: %s", err)
+	}
+	testExpectedObject(t, 4, vm.LastPoppedStackElem())
+}
+
+func TestRegisterBuiltin(t *testing.T) {
+	scale := func(by int64) func(args ...object.Object) object.Object {
+		return func(args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return &object.Error{Message: "takes one argument"}
+			}
+
+			n, ok := args[0].(*object.Integer)
+			if !ok {
+				return &object.Error{Message: "takes an INTEGER"}
+			}
+
+			return &object.Integer{Value: n.Value * by}
+		}
+	}
+
+	comp := compiler.New()
+	for _, name := range []string{"double", "triple"} {
+		if err := comp.RegisterBuiltin(name); err != nil {
+			t.Fatalf("register error: %s", err)
+		}
+	}
+	if err := comp.Compile(parse("double(len([1, 2])) + triple(20)")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// The VM finds builtins by name, whatever order they are registered in.
+	vm := New(comp.Bytecode())
+	vm.RegisterBuiltin("triple", scale(3))
+	vm.RegisterBuiltin("double", scale(2))
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 64, vm.LastPoppedStackElem())
+
+	// The VM wasn't told about a builtin the program was compiled with.
+	vm = New(comp.Bytecode())
+	vm.RegisterBuiltin("triple", scale(3))
+	err := vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	if expected := "undefined builtin double"; err.Error() != expected {
+		t.Errorf("wrong error message. want=%q, got=%q", expected, err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	input := `
+	let add = fn(a, b) { a + b };
+	let fibonacci = fn(x) { if (x < 2) { x } else { fibonacci(x - 1) + fibonacci(x - 2) } };
+	let fail = fn() { 1 + true };
+	let answer = 42;
+	let size = len;
+	`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []object.Object
+		expected any // a string is the expected error message
+	}{
+		{"add", []object.Object{&object.Integer{Value: 2}, &object.Integer{Value: 3}}, 5},
+		{"fibonacci", []object.Object{&object.Integer{Value: 15}}, 610},
+		{"size", []object.Object{&object.String{Value: "four"}}, 4},
+		{"add", []object.Object{&object.Integer{Value: 2}}, "wrong number of arguments: want=2, got=1"},
+		{"answer", nil, "answer is not a function: INTEGER"},
+		{"missing", nil, "undefined function missing"},
+		{"fail", nil, "type mismatch: INTEGER + BOOLEAN"},
+		// Failed calls must not leave the VM unusable.
+		{"add", []object.Object{&object.Integer{Value: 20}, &object.Integer{Value: 22}}, 42},
+	}
+
+	for _, tt := range tests {
+		result, err := vm.Call(tt.name, tt.args...)
+
+		message, wantErr := tt.expected.(string)
+		if !wantErr {
+			if err != nil {
+				t.Errorf("unexpected error calling %s: %s", tt.name, err)
+				continue
+			}
+			testExpectedObject(t, tt.expected, result)
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("expected error calling %s but resulted in none.", tt.name)
+			continue
+		}
+
+		if err.Error() != message {
+			t.Errorf("wrong error message. want=%q, got=%q", message, err)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	programs := []struct {
+		input    string
+		expected any
+	}{
+		{"let a = 1; let f = fn(x) { x * 10 }; f(a) + 2", 12},
+		{`let s = "a"; s + "b"`, "ab"},
+		{"let x = [1, 2, 3]; len(x)", 3},
+	}
+
+	var vm *VM
+	for _, tt := range programs {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		if vm == nil {
+			vm = New(comp.Bytecode())
+		} else {
+			vm.Reset(comp.Bytecode())
+		}
+
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+
+	// A run that fails part way through mustn't affect the next one.
+	comp := compiler.New()
+	if err := comp.Compile(parse("let f = fn() { 1 + f() }; f()")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm.Reset(comp.Bytecode())
+	if err := vm.Run(); err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	comp = compiler.New()
+	if err := comp.Compile(parse("1 + 1")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm.Reset(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error after reset: %s", err)
+	}
+	testExpectedObject(t, 2, vm.LastPoppedStackElem())
+}
+
+func TestResetGlobals(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let a = 1; let b = [a]; b")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	comp.ResetState()
+	if err := comp.Compile(parse("let c = 2; c")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm.Reset(comp.Bytecode())
+	vm.ResetGlobals()
+	for i, global := range vm.Globals() {
+		if global != nil {
+			t.Fatalf("global %d not cleared. got=%s", i, global.Inspect())
+		}
+	}
+
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 2, vm.LastPoppedStackElem())
+
+	if globals := vm.Globals(); globals[1] != nil {
+		t.Errorf("global of the earlier run still set. got=%s",
+			globals[1].Inspect())
+	}
+}
+
+func TestRuntimeErrorLines(t *testing.T) {
+	input := `let f = fn(x) {
+  let y = x * 2;
+  y + true
+};
+let a = 1;
+f(a);`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err := vm.Run()
+
+	errObj, ok := err.(*object.Error)
+	if !ok {
+		t.Fatalf("error is not *object.Error. got=%T (%+v)", err, err)
+	}
+
+	if errObj.Line != 3 {
+		t.Errorf("wrong error line. want=3, got=%d", errObj.Line)
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	// None of the calls is in tail position, so every frame survives.
+	input := `let inner = fn(x) {
+  x + true
+};
+let middle = fn(x) {
+  inner(x) * 2
+};
+let outer = fn(x) {
+  1 + middle(x)
+};
+let run = fn() { outer(1) + 1 };
+run();`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := New(comp.Bytecode()).Run()
+
+	errObj, ok := err.(*object.Error)
+	if !ok {
+		t.Fatalf("error is not *object.Error. got=%T (%+v)", err, err)
+	}
+
+	expected := []object.StackFrame{
+		{Function: "inner", Line: 2},
+		{Function: "middle", Line: 5},
+		{Function: "outer", Line: 8},
+		{Function: "run", Line: 10},
+		{Function: "<main>", Line: 11},
+	}
+
+	trace := errObj.StackTrace()
+	if len(trace) != len(expected) {
+		t.Fatalf("wrong trace length. want=%d, got=%d (%v)",
+			len(expected), len(trace), trace)
+	}
+
+	for i, want := range expected {
+		if trace[i] != want {
+			t.Errorf("wrong trace entry %d. want=%s, got=%s", i, want, trace[i])
+		}
+	}
+
+	comp = compiler.New()
+	if err := comp.Compile(parse("fn() { 1 / 0 }() + 1")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = New(comp.Bytecode()).Run()
+	trace = err.(*object.Error).StackTrace()
+	if len(trace) != 2 || trace[0].Function != "<anonymous>" {
+		t.Errorf("wrong trace for anonymous function. got=%v", trace)
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []vmTestCase{
-		{`len("")`, 0},
-		{`len("four")`, 4},
-		{`len("hello world")`, 11},
+		{`len("")`, 0},
+		{`len("four")`, 4},
+		{`len("hello world")`, 11},
+		{`len("héllo")`, 5},
+		{
+			`len(1)`,
+			&object.Error{
+				Message: "argument to `len` not supported, got INTEGER",
+			},
+		},
+		{`len("one", "two")`,
+			&object.Error{
+				Message: "wrong number of arguments. got=2, want=1",
+			},
+		},
+		{`len([1, 2])`, 2},
+		{`len([1, 2, 3])`, 3},
+		{`len([])`, 0},
+		{`print("hello", "world!")`, Null},
+		{`first([1, 2, 3])`, 1},
+		{`first([])`, Null},
+		{`first(1)`,
+			&object.Error{
+				Message: "argument to `first` must be ARRAY, got INTEGER",
+			},
+		},
+		{`last([1, 2, 3])`, 3},
+		{`last([])`, Null},
+		{`last(1)`,
+			&object.Error{
+				Message: "argument to `last` must be ARRAY, got INTEGER",
+			},
+		},
+		{`rest([1, 2, 3])`, []int{2, 3}},
+		{`rest([])`, Null},
+		{`rest([1])`, []int{}},
+		{`rest(1)`,
+			&object.Error{
+				Message: "argument to `rest` must be ARRAY, got INTEGER",
+			},
+		},
+		{`push([], 1)`, []int{1}},
+		{`push([1, 2], 3)`, []int{1, 2, 3}},
+		{`let a = [1]; push(a, 2); a`, []int{1}},
+		{`let a = [1, 2]; rest(a); a`, []int{1, 2}},
+		{`push(1, 1)`,
+			&object.Error{
+				Message: "argument to `push` must be ARRAY, got INTEGER",
+			},
+		},
+		{`first()`,
+			&object.Error{
+				Message: "wrong number of arguments. got=0, want=1",
+			},
+		},
+		{`last([1], [2])`,
+			&object.Error{
+				Message: "wrong number of arguments. got=2, want=1",
+			},
+		},
+		{`rest()`,
+			&object.Error{
+				Message: "wrong number of arguments. got=0, want=1",
+			},
+		},
+		{`push([1])`,
+			&object.Error{
+				Message: "wrong number of arguments. got=1, want=2",
+			},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBuiltinsAsValues(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("abc")`, 3},
+		{`len("abc") + len("de")`, 5},
+		{`let f = len; f("abc")`, 3},
+		{`fn(g) { g("abc") }(len)`, 3},
+		{`let get = fn() { len }; get()("abc")`, 3},
+		{`[len, first][0]("abc")`, 3},
+		{`let n = 0; let i = 0;
+		while (i < 100) { n = n + len("abc"); i = i + 1 };
+		n`, 300},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestMathBuiltins(t *testing.T) {
+	minInt := new(big.Int).Neg(big.NewInt(math.MinInt64))
+
+	tests := []vmTestCase{
+		{`abs(5)`, 5},
+		{`abs(-5)`, 5},
+		{`abs(-2.5)`, 2.5},
+		{`abs(-9223372036854775807 - 1)`, minInt},
+		{`abs("a")`,
+			&object.Error{
+				Message: "argument to `abs` must be INTEGER or FLOAT, got STRING",
+			},
+		},
+		{`abs()`,
+			&object.Error{
+				Message: "wrong number of arguments. got=0, want=1",
+			},
+		},
+		{`min(3, 1, 2)`, 1},
+		{`min(7)`, 7},
+		{`min(2, 1.5)`, 1.5},
+		{`min(1, 1.0)`, 1},
+		{`max(3, 1, 2)`, 3},
+		{`max(2, 2.5, -1)`, 2.5},
+		{`max(1.0, 1)`, 1.0},
+		{`max()`,
+			&object.Error{
+				Message: "wrong number of arguments. got=0, want at least 1",
+			},
+		},
+		{`min(1, "two")`,
+			&object.Error{
+				Message: "argument to `min` must be INTEGER or FLOAT, got STRING",
+			},
+		},
+		{`pow(2, 10)`, 1024},
+		{`pow(2, 0)`, 1},
+		{`pow(2, 64)`, new(big.Int).Lsh(big.NewInt(1), 64)},
+		{`pow(2, -1)`, 0.5},
+		{`pow(2.0, 3)`, 8.0},
+		{`pow(4, 0.5)`, 2.0},
+		{`pow(2)`,
+			&object.Error{
+				Message: "wrong number of arguments. got=1, want=2",
+			},
+		},
+		{`pow(2, [])`,
+			&object.Error{
+				Message: "argument to `pow` must be INTEGER or FLOAT, got ARRAY",
+			},
+		},
+		{`sqrt(16)`, 4.0},
+		{`sqrt(2.25)`, 1.5},
+		{`sqrt(0)`, 0.0},
+		{`sqrt(-4)`,
+			&object.Error{
+				Message: "argument to `sqrt` must not be negative, got -4",
+			},
+		},
+		{`sqrt(true)`,
+			&object.Error{
+				Message: "argument to `sqrt` must be INTEGER or FLOAT, got BOOLEAN",
+			},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestStringBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`split("a,b,c", ",")`, []string{"a", "b", "c"}},
+		{`split("abc", ",")`, []string{"abc"}},
+		{`split("", ",")`, []string{""}},
+		{`split("a,b", 1)`,
+			&object.Error{
+				Message: "second argument to `split` must be STRING, got INTEGER",
+			},
+		},
+		{`split(["a"], ",")`,
+			&object.Error{
+				Message: "first argument to `split` must be STRING, got ARRAY",
+			},
+		},
+		{`join(["a", "b"], "-")`, "a-b"},
+		{`join([], "-")`, ""},
+		{`join(split("a,b,c", ","), ", ")`, "a, b, c"},
+		{`join(["a", 1], "-")`,
+			&object.Error{
+				Message: "elements passed to `join` must be STRING, got INTEGER at index 1",
+			},
+		},
+		{`join("ab", "-")`,
+			&object.Error{
+				Message: "first argument to `join` must be ARRAY, got STRING",
+			},
+		},
+		{`join(["a"])`,
+			&object.Error{
+				Message: "wrong number of arguments. got=1, want=2",
+			},
+		},
+		{`trim("  monkey  ")`, "monkey"},
+		{`upper("Monkey")`, "MONKEY"},
+		{`lower("Monkey")`, "monkey"},
+		{`upper(1)`,
+			&object.Error{
+				Message: "argument to `upper` must be STRING, got INTEGER",
+			},
+		},
+		{`trim("a", "b")`,
+			&object.Error{
+				Message: "wrong number of arguments. got=2, want=1",
+			},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHigherOrderBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`map([1, 2, 3], fn(x) { x * 2 })`, []int{2, 4, 6}},
+		{`map([], fn(x) { x * 2 })`, []int{}},
+		{`let double = fn(x) { x * 2 }; map([1, 2], double)`, []int{2, 4}},
+		{`map(["a", "b"], upper)`, []string{"A", "B"}},
+		{`filter([1, 2, 3, 4], fn(x) { x > 2 })`, []int{3, 4}},
+		{`filter([1, 2, 3], fn(x) { false })`, []int{}},
+		{`reduce([1, 2, 3], fn(acc, x) { acc + x }, 0)`, 6},
+		{`reduce([], fn(acc, x) { acc + x }, 10)`, 10},
+		{`
+		let n = 10;
+		let addN = fn(xs) { map(xs, fn(x) { x + n }) };
+		addN([1, 2])
+		`, []int{11, 12}},
+		{`map([[1], [2, 3]], fn(xs) { reduce(xs, fn(a, b) { a + b }, 0) })`,
+			[]int{1, 5}},
+		{`map(1, fn(x) { x })`,
+			&object.Error{
+				Message: "first argument to `map` must be ARRAY, got INTEGER",
+			},
+		},
+		{`filter([1], 1)`,
+			&object.Error{
+				Message: "second argument to `filter` must be a function, got INTEGER",
+			},
+		},
+		{`reduce([1], fn(a, b) { a })`,
+			&object.Error{
+				Message: "wrong number of arguments. got=2, want=3",
+			},
+		},
+		// An error returned by the callback ends the builtin with it.
+		{`map([1], len)`,
+			&object.Error{
+				Message: "argument to `len` not supported, got INTEGER",
+			},
+		},
+		{`filter(["a", 1], len)`,
+			&object.Error{
+				Message: "argument to `len` not supported, got INTEGER",
+			},
+		},
+		{`reduce([1, 2], fn(acc, x) { len(x) }, 0)`,
+			&object.Error{
+				Message: "argument to `len` not supported, got INTEGER",
+			},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHigherOrderBuiltinErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`map([1], fn(x) { x + true })`, "type mismatch: INTEGER + BOOLEAN"},
+		{`map([1], fn(x, y) { x })`, "wrong number of arguments: want=2, got=1"},
+		{`reduce([1, 2], fn(a, b) { -"s" }, 0)`, "unknown operator: -STRING"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err := vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestTypeBuiltin(t *testing.T) {
+	tests := []vmTestCase{
+		{`type(1)`, "INTEGER"},
+		{`type(9223372036854775807 + 1)`, "BIGINT"},
+		{`type(1.5)`, "FLOAT"},
+		{`type("a")`, "STRING"},
+		{`type(true)`, "BOOLEAN"},
+		{`type([1])`, "ARRAY"},
+		{`type({})`, "HASH"},
+		{`type(if (false) { 1 })`, "NULL"},
+		{`type(fn() {})`, "CLOSURE"},
+		{`let n = 1; type(fn() { n })`, "CLOSURE"},
+		{`type(len)`, "BUILTIN"},
+		{`type(type)`, "BUILTIN"},
+		{`type()`,
+			&object.Error{
+				Message: "wrong number of arguments. got=0, want=1",
+			},
+		},
+		{`type(1, 2)`,
+			&object.Error{
+				Message: "wrong number of arguments. got=2, want=1",
+			},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestConversionBuiltins(t *testing.T) {
+	bigInt := func(s string) *big.Int {
+		v, _ := new(big.Int).SetString(s, 10)
+		return v
+	}
+
+	tests := []vmTestCase{
+		{`int("42")`, 42},
+		{`int("-7")`, -7},
+		{`int("99999999999999999999")`, bigInt("99999999999999999999")},
+		{`int(3.9)`, 3},
+		{`int(-3.9)`, -3},
+		{`int(5)`, 5},
+		{`int(true)`, 1},
+		{`int(false)`, 0},
+		{`int("4x")`,
+			&object.Error{Message: `cannot convert "4x" to INTEGER`},
+		},
+		{`int("")`,
+			&object.Error{Message: `cannot convert "" to INTEGER`},
+		},
+		{`int([1])`,
+			&object.Error{Message: "argument to `int` not supported, got ARRAY"},
+		},
+		{`float(3)`, 3.0},
+		{`float(2.5)`, 2.5},
+		{`float("2.5")`, 2.5},
+		{`float("two")`,
+			&object.Error{Message: `cannot convert "two" to FLOAT`},
+		},
+		{`float(true)`,
+			&object.Error{Message: "argument to `float` not supported, got BOOLEAN"},
+		},
+		{`str(42)`, "42"},
+		{`str(2.5)`, "2.5"},
+		{`str("a")`, "a"},
+		{`str(true)`, "true"},
+		{`str([1, 2])`, "[1, 2]"},
+		{`str(if (false) { 1 })`, "null"},
+		{`str()`,
+			&object.Error{Message: "wrong number of arguments. got=0, want=1"},
+		},
+		{`bool(0)`, true},
+		{`bool("")`, true},
+		{`bool(false)`, false},
+		{`bool(if (false) { 1 })`, false},
+		{`bool(1, 2)`,
+			&object.Error{Message: "wrong number of arguments. got=2, want=1"},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHashBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		// keys and values list pairs in insertion order, like Inspect.
+		{`keys({3: "c", -1: "a", 2: "b"})`, []int{3, -1, 2}},
+		{`values({3: 30, -1: 10, 2: 20})`, []int{30, 10, 20}},
+		{`let h = {"b": 1, "a": 2}; join(keys(h), "") + str(values(h))`, "ba[1, 2]"},
+		{`let h = {"b": 1}; h["a"] = 2; h["b"] = 3; keys(h)[0] + str(values(h))`, "b[3, 2]"},
+		{`keys({})`, []int{}},
+		{`let h = {"a": 1, "b": 2}; len(keys(h))`, 2},
+		{`let h = {"a": 1, "b": 2}; let ks = keys(h); h[ks[0]] + h[ks[1]]`, 3},
+		{`let h = {"a": 1, "b": 2}; let ks = keys(h); h[ks[0]] == values(h)[0]`, true},
+		{`has({"a": 1}, "a")`, true},
+		{`has({"a": 1}, "b")`, false},
+		{`has({1: 1}, 1)`, true},
+		{`has({true: 1}, false)`, false},
+		{`has({}, [1])`,
+			&object.Error{Message: "unusable as hash key: ARRAY"},
+		},
+		{`has([1], 1)`,
+			&object.Error{Message: "first argument to `has` must be HASH, got ARRAY"},
+		},
+		{`keys([1])`,
+			&object.Error{Message: "argument to `keys` must be HASH, got ARRAY"},
+		},
+		{`values("a")`,
+			&object.Error{Message: "argument to `values` must be HASH, got STRING"},
+		},
+		{`has({})`,
+			&object.Error{Message: "wrong number of arguments. got=1, want=2"},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestOutputBuiltins(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedOutput string
+	}{
+		{`puts("hi")`, "hi\n"},
+		{`puts()`, ""},
+		{`puts(1, [2, 3], "four")`, "1\n[2, 3]\nfour\n"},
+		{`let f = fn(x) { puts(x * 2) }; f(21)`, "42\n"},
+		{`print("hello", "world!")`, "hello\nworld!\n"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var out bytes.Buffer
+		vm := New(comp.Bytecode(), WithOutput(&out))
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if out.String() != tt.expectedOutput {
+			t.Errorf("wrong output for %q. want=%q, got=%q",
+				tt.input, tt.expectedOutput, out.String())
+		}
+
+		testExpectedObject(t, Null, vm.LastPoppedStackElem())
+	}
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
 		{
-			`len(1)`,
-			&object.Error{
-				Message: "argument to `len` not supported, got INTEGER",
-			},
+			input: `
+			let newClosure = fn(a) {
+				fn() { a; };
+			};
+			let closure = newClosure(99);
+			closure();
+			`,
+			expected: 99,
 		},
-		{`len("one", "two")`,
-			&object.Error{
-				Message: "wrong number of arguments. got=2, want=1",
-			},
+		{
+			input: `
+			let newAdder = fn(a, b) {
+				fn(c) { a + b + c };
+			};
+			let adder = newAdder(1, 2);
+			adder(8);
+			`,
+			expected: 11,
 		},
-		{`len([1, 2, 3])`, 3},
-		{`len([])`, 0},
-		{`print("hello", "world!")`, Null},
-		{`first([1, 2, 3])`, 1},
-		{`first([])`, Null},
-		{`first(1)`,
-			&object.Error{
-				Message: "argument to `first` must be ARRAY, got INTEGER",
-			},
+		{
+			input: `
+			let newAdder = fn(a, b) {
+				let c = a + b;
+				fn(d) { c + d };
+			};
+			let adder = newAdder(1, 2);
+			adder(8);
+			`,
+			expected: 11,
 		},
-		{`last([1, 2, 3])`, 3},
-		{`last([])`, Null},
-		{`last(1)`,
-			&object.Error{
-				Message: "argument to `last` must be ARRAY, got INTEGER",
+		{
+			input: `
+			let newAdderOuter = fn(a, b) {
+				let c = a + b;
+				fn(d) {
+					let e = d + c;
+					fn(f) { e + f; };
+				};
+			};
+			let newAdderInner = newAdderOuter(1, 2)
+			let adder = newAdderInner(3);
+			adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+			let a = 1;
+			let newAdderOuter = fn(b) {
+				fn(c) {
+					fn(d) { a + b + c + d };
+				};
+			};
+			let newAdderInner = newAdderOuter(2)
+			let adder = newAdderInner(3);
+			adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+			let newClosure = fn(a, b) {
+				let one = fn() { a; };
+				let two = fn() { b; };
+				fn() { one() + two(); };
+			};
+			let closure = newClosure(9, 90);
+			closure();
+			`,
+			expected: 99,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let countDown = fn(x) {
+				if (x == 0) {
+					return 0;
+				} else {
+					countDown(x - 1);
+				}
+			};
+			countDown(1);
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) {
+					if (x == 0) {
+						return 0;
+					} else {
+						countDown(x - 1);
+					}
+				};
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expected: 0,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFibonacci(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let fibonacci = fn(x) {
+				if (x == 0) {
+					return 0;
+				} else {
+					if (x == 1) {
+						return 1;
+					} else {
+						fibonacci(x - 1) + fibonacci(x - 2);
+					}
+				}
+			};
+			fibonacci(15);
+			`,
+			expected: 610,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			// Far deeper than the call depth limit.
+			input: `
+			let sum = fn(n, acc) {
+				if (n == 0) { acc } else { sum(n - 1, acc + n) }
+			};
+			sum(1000000, 0);
+			`,
+			expected: 500000500000,
+		},
+		{
+			input: `
+			let sum = fn(n, acc) {
+				if (n == 0) { return acc; }
+				return sum(n - 1, acc + n);
+			};
+			sum(100000, 0);
+			`,
+			expected: 5000050000,
+		},
+		{
+			// Tail calls alternating between two closures.
+			input: `
+			let isEven = fn(n, isOdd) {
+				if (n == 0) { true } else { isOdd(n - 1, isEven) }
+			};
+			let isOdd = fn(n, isEven) {
+				if (n == 0) { false } else { isEven(n - 1, isOdd) }
+			};
+			isEven(100001, isOdd);
+			`,
+			expected: false,
+		},
+		{
+			// The callee has more locals than the caller.
+			input: `
+			let wide = fn(a) { let b = a * 2; let c = b + 1; c };
+			let narrow = fn(a) { wide(a) };
+			narrow(20) + narrow(1);
+			`,
+			expected: 44,
+		},
+		{
+			// Free variables of the callee survive replacing the frame.
+			input: `
+			let adder = fn(x) { fn(y) { x + y } };
+			let addTwo = adder(2);
+			let apply = fn(f, v) { f(v) };
+			apply(addTwo, 40);
+			`,
+			expected: 42,
+		},
+		{
+			input:    `let count = fn(a) { len(a) }; count([1, 2, 3]) + 1;`,
+			expected: 4,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestWideOperands(t *testing.T) {
+	// Enough statements to need more than 65535 constants and to push the
+	// jumps of the trailing if expression past 65535 bytes.
+	var body strings.Builder
+	for i := 0; i <= 70000; i++ {
+		fmt.Fprintf(&body, "%d;\n", i)
+	}
+
+	tests := []vmTestCase{
+		{body.String(), 70000},
+		{"if (true) { " + body.String() + " }", 70000},
+		{"if (false) { " + body.String() + " } else { -1 }", -1},
+		{"let x = 0; while (x < 3) { " + body.String() + " x = x + 1 }; x", 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLoadedBytecode(t *testing.T) {
+	inputs := []string{
+		`let fibonacci = fn(x) {
+			if (x < 2) { return x; }
+			fibonacci(x - 1) + fibonacci(x - 2);
+		};
+		fibonacci(15);`,
+		`let newAdder = fn(a) { fn(b) { a + b } };
+		let addTwo = newAdder(2);
+		[addTwo(1), addTwo(1.5), len("four")]`,
+		`let h = {"a": 9999999999 * 9999999999, true: "yes"};
+		h["a"] / 3 + 1`,
+	}
+
+	for _, input := range inputs {
+		comp := compiler.New()
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		original := New(comp.Bytecode())
+		if err := original.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		var buf bytes.Buffer
+		if err := comp.Bytecode().Marshal(&buf); err != nil {
+			t.Fatalf("marshal error: %s", err)
+		}
+
+		loaded, err := compiler.LoadBytecode(&buf)
+		if err != nil {
+			t.Fatalf("load error: %s", err)
+		}
+
+		vm := New(loaded)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error on loaded bytecode: %s", err)
+		}
+
+		want := original.LastPoppedStackElem()
+		got := vm.LastPoppedStackElem()
+		if !object.Equals(want, got) {
+			t.Errorf("loaded bytecode gave a different result. want=%s, got=%s",
+				want.Inspect(), got.Inspect())
+		}
+	}
+}
+
+// Loading only checks operands, so bytecode that pops more than it pushed
+// loads and fails when run.
+// TestLoadedBytecodeErrors runs bytecode that LoadBytecode accepts but no
+// compiler emits, which must fail with an error rather than a panic.
+func TestLoadedBytecodeErrors(t *testing.T) {
+	noFree := &object.CompiledFunction{
+		Instructions: append(
+			code.Make(code.OpGetFree, 3),
+			code.Make(code.OpReturnValue)...,
+		),
+	}
+
+	tests := []struct {
+		bytecode *compiler.Bytecode
+		expected string
+	}{
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpPop)},
+			"stack underflow",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpArray, 5)},
+			"stack underflow",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpHash, 4)},
+			"stack underflow",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpCall, 4)},
+			"stack underflow",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpTailCall, 4)},
+			"stack underflow",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: code.Make(code.OpClosure, 0, 4),
+				Constants:    []object.Object{noFree},
 			},
+			"stack underflow",
 		},
-		{`rest([1, 2, 3])`, []int{2, 3}},
-		{`rest([])`, Null},
-		{`push([], 1)`, []int{1}},
-		{`push(1, 1)`,
-			&object.Error{
-				Message: "argument to `push` must be ARRAY, got INTEGER",
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpReturnValue)},
+			"stack underflow",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpGetFree, 0)},
+			"free variable 0 of 0",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: code.Instructions(bytes.Join([][]byte{
+					code.Make(code.OpClosure, 0, 0),
+					code.Make(code.OpCall, 0),
+					code.Make(code.OpPop),
+				}, nil)),
+				Constants: []object.Object{noFree},
 			},
+			"free variable 3 of 0",
 		},
 	}
 
-	runVmTests(t, tests)
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := tt.bytecode.Marshal(&buf); err != nil {
+			t.Fatalf("marshal error: %s", err)
+		}
+
+		loaded, err := compiler.LoadBytecode(&buf)
+		if err != nil {
+			t.Fatalf("load error: %s", err)
+		}
+
+		err = New(loaded).Run()
+		if err == nil || !strings.HasPrefix(err.Error(), tt.expected) {
+			t.Errorf("%s: expected error %q, got=%v",
+				tt.bytecode.Instructions, tt.expected, err)
+		}
+	}
+}
+
+// vmLimitTestCase runs input on a VM configured with opts, expecting it to
+// fail with the expected error message, or to succeed if expected is empty.
+type vmLimitTestCase struct {
+	input    string
+	opts     []Option
+	expected string
+}
+
+func runVmLimitTests(t *testing.T, tests []vmLimitTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode(), tt.opts...)
+		err := vm.Run()
+
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("unexpected vm error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error message. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"quote(1 + 2)", "QUOTE((1 + 2))"},
+		{"let f = fn() { quote(a * b) }; f()", "QUOTE((a * b))"},
+		{"quote(1 + unquote(2 + 3))", "QUOTE((1 + 5))"},
+		{"quote(unquote(2 * 2) * unquote(!false))", "QUOTE((4 * true))"},
+		{`quote(unquote("a" + "b") + unquote(-1.5))`, `QUOTE((ab + -1.5))`},
+		// A quote the program defines is called like any other function.
+		{"let quote = fn(x) { x * 2 }; quote(21)", "42"},
+		{"fn(quote) { quote(1 + 2) }(fn(x) { -x })", "-3"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		got := vm.LastPoppedStackElem().Inspect()
+		if got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q",
+				tt.input, tt.expected, got)
+		}
+	}
+}
+
+// compileBenchmark compiles input for a benchmark, failing it on errors.
+func compileBenchmark(b *testing.B, input string) *compiler.Bytecode {
+	b.Helper()
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+
+	return comp.Bytecode()
+}
+
+// runBenchmark compiles input once and times running it, reusing one VM so
+// that only execution is measured.
+func runBenchmark(b *testing.B, input string) {
+	b.Helper()
+
+	bytecode := compileBenchmark(b, input)
+	vm := New(bytecode)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm.Reset(bytecode)
+		if err := vm.Run(); err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+	}
 }
 
 func runVmTests(t *testing.T, tests []vmTestCase) {
@@ -479,6 +2897,22 @@ func testExpectedObject(
 		if err != nil {
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
+	case *big.Int:
+		result, ok := actual.(*object.BigInt)
+		if !ok {
+			t.Errorf("object is not BigInt. got=%T (%+v)", actual, actual)
+			return
+		}
+
+		if result.Value.Cmp(expected) != 0 {
+			t.Errorf("object has wrong value. got=%s want=%s",
+				result.Value, expected)
+		}
+	case float64:
+		err := testFloatObject(expected, actual)
+		if err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
 	case string:
 		err := testStringObject(expected, actual)
 		if err != nil {
@@ -510,6 +2944,27 @@ func testExpectedObject(
 			}
 		}
 
+	case []string:
+		array, ok := actual.(*object.Array)
+		if !ok {
+			t.Errorf("object not Array: %T (%+v)",
+				actual, actual)
+			return
+		}
+
+		if len(array.Elements) != len(expected) {
+			t.Errorf("wrong num of elements. want=%d, got=%d",
+				len(expected), len(array.Elements))
+			return
+		}
+
+		for i, expectedElem := range expected {
+			err := testStringObject(expectedElem, array.Elements[i])
+			if err != nil {
+				t.Errorf("testStringObject failed: %s", err)
+			}
+		}
+
 	case map[object.HashKey]int64:
 		hash, ok := actual.(*object.Hash)
 		if !ok {
@@ -570,6 +3025,25 @@ func testIntegerObject(expect int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expect float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)",
+			actual, actual)
+	}
+
+	if math.IsNaN(expect) && math.IsNaN(result.Value) {
+		return nil
+	}
+
+	if result.Value != expect {
+		return fmt.Errorf("object has wrong value. got=%g want=%g",
+			result.Value, expect)
+	}
+
+	return nil
+}
+
 func testStringObject(expect string, actual object.Object) error {
 	result, ok := actual.(*object.String)
 	if !ok {